@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+/* ===================== Token 预算 ===================== */
+
+const (
+	// minContextWindow 是 context_window 的下限，再小放不下系统提示词和工具定义
+	minContextWindow = 8000
+	// 每条消息的固定开销（角色、分隔符等）
+	messageOverheadTokens = 4
+	// 上下文超过 context_window 的该百分比时压缩历史，给模型回复留出空间
+	compactAtPercent = 75
+	// 压缩时保留最近几轮的完整工具结果
+	keepRecentRounds = 2
+	// 笔记中每条工具结果摘要和分析文本的最大字符数
+	maxNoteRunes = 200
+	// 笔记最多保留的条数，超出时丢弃最早的
+	maxNoteLines = 200
+)
+
+// notesHeader 是压缩后笔记消息的开头，用来识别已有的笔记
+const notesHeader = "【此前的审查笔记】为节省上下文，较早轮次的工具结果已移除，以下是当时的分析和结果摘要；需要细节时重新调用对应工具。"
+
+// budgetExhaustedReminder 在 token 预算用完时要求模型立即提交
+const budgetExhaustedReminder = "本次审查的 token 预算已用完，请不要再调用其他工具，立即根据已有信息调用 submit_review 提交审查结果。"
+
+// estimateTokens 按字符粗略估算 token 数：ASCII 约 4 个字符一个 token，中文等其他字符约一个字符一个 token
+func estimateTokens(s string) int {
+	ascii, other := 0, 0
+	for i := 0; i < len(s); {
+		if s[i] < utf8.RuneSelf {
+			ascii++
+			i++
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		other++
+		i += size
+	}
+	return (ascii+3)/4 + other
+}
+
+// messageTokens 估算一条消息的 token 数，包括工具调用的名称和参数
+func messageTokens(m Message) int {
+	n := messageOverheadTokens + estimateTokens(m.Content)
+	for _, tc := range m.ToolCalls {
+		n += messageOverheadTokens + estimateTokens(tc.Function.Name) + estimateTokens(tc.Function.Arguments)
+	}
+	return n
+}
+
+func messagesTokens(msgs []Message) int {
+	n := 0
+	for _, m := range msgs {
+		n += messageTokens(m)
+	}
+	return n
+}
+
+// toolsTokens 估算工具定义占用的 token 数，每轮请求都会发送
+func toolsTokens(defs []Tool) int {
+	data, _ := json.Marshal(defs)
+	return estimateTokens(string(data))
+}
+
+// BudgetUsage 是一次审查的 token 用量，按字符估算，与服务端计费可能有出入
+type BudgetUsage struct {
+	// TokenBudget 是本次审查的预算，0 表示不限制
+	TokenBudget   int `json:"token_budget"`
+	ContextWindow int `json:"context_window"`
+	// EstimatedTokens 是各轮请求和回复的 token 数之和
+	EstimatedTokens int `json:"estimated_tokens"`
+	// PeakContextTokens 是单轮请求的最大 token 数
+	PeakContextTokens int `json:"peak_context_tokens"`
+	// Compactions 是压缩历史消息的次数
+	Compactions int `json:"compactions"`
+	// Exhausted 表示预算用完，模型被要求立即提交结果
+	Exhausted bool `json:"exhausted,omitempty"`
+}
+
+// tokenBudget 跟踪一次审查的 token 用量，在请求前压缩历史消息
+type tokenBudget struct {
+	usage      BudgetUsage
+	toolTokens int
+}
+
+func newTokenBudget(cfg *Config, defs []Tool) *tokenBudget {
+	return &tokenBudget{
+		usage:      BudgetUsage{TokenBudget: cfg.TokenBudget, ContextWindow: cfg.ContextWindow},
+		toolTokens: toolsTokens(defs),
+	}
+}
+
+// exhausted 判断累计用量是否已达到预算
+func (b *tokenBudget) exhausted() bool {
+	return b.usage.TokenBudget > 0 && b.usage.EstimatedTokens >= b.usage.TokenBudget
+}
+
+// record 累计一轮请求和回复的用量，返回本轮请求和回复的估算值
+func (b *tokenBudget) record(req []Message, reply Message) (prompt, completion int) {
+	prompt = messagesTokens(req) + b.toolTokens
+	completion = messageTokens(reply)
+	if prompt > b.usage.PeakContextTokens {
+		b.usage.PeakContextTokens = prompt
+	}
+	b.usage.EstimatedTokens += prompt + completion
+	return prompt, completion
+}
+
+// fit 在上下文超过阈值时压缩消息，返回压缩后的消息和说明；无需或无法压缩时说明为空
+func (b *tokenBudget) fit(msgs []Message) ([]Message, string) {
+	limit := b.usage.ContextWindow*compactAtPercent/100 - b.toolTokens
+	before := messagesTokens(msgs)
+	if before <= limit {
+		return msgs, ""
+	}
+	compacted := compactMessages(msgs, limit)
+	after := messagesTokens(compacted)
+	if after == before {
+		// 只有当前一轮，无法再压缩
+		return msgs, ""
+	}
+	msgs = compacted
+	b.usage.Compactions++
+	note := fmt.Sprintf("上下文约 %d tokens，超过 %d，压缩后约 %d tokens", before+b.toolTokens, limit+b.toolTokens, after+b.toolTokens)
+	log.Printf("压缩历史消息: %s", note)
+	return msgs, note
+}
+
+/* ===================== 历史压缩 ===================== */
+
+// compactMessages 把 msgs 压缩到 limit 个 token 以内，依次：
+//  1. 去掉之后被相同调用取代的工具结果（如重复读取同一文件）
+//  2. 把较早轮次整理为笔记，只保留最近 keepRecentRounds 轮，不够时只保留最近一轮
+//
+// msgs[0] 是系统提示词，msgs[1] 是用户请求，始终保留；压缩以轮为单位，assistant 的
+// tool_calls 和对应的 tool 结果总是一起保留或移除
+func compactMessages(msgs []Message, limit int) []Message {
+	msgs = dropSupersededResults(msgs)
+	for keep := keepRecentRounds; keep >= 1 && messagesTokens(msgs) > limit; keep-- {
+		msgs = foldRounds(msgs, keep)
+	}
+	return msgs
+}
+
+// supersededResult 替换被后续调用取代的工具结果
+const supersededResult = "（结果已省略：之后用相同参数再次调用了该工具，以后面的结果为准）"
+
+// dropSupersededResults 把之后有相同调用（同名、同参数）的工具结果替换为简短说明；
+// read_file 之后完整读到了覆盖其行范围的内容时（未因 read_file_max_bytes 截断），之前的读取也视为被取代
+func dropSupersededResults(msgs []Message) []Message {
+	calls := pairToolCalls(msgs)
+	latest := make(map[string]int)
+	reads := make(map[string][]fileRead)
+	for i, m := range msgs {
+		tc, ok := calls[i]
+		if !ok {
+			continue
+		}
+		latest[toolCallKey(tc)] = i
+		if path, r, ok := readFileCall(tc); ok && completeRead(m.Content) {
+			reads[path] = append(reads[path], fileRead{index: i, lines: r})
+		}
+	}
+
+	out := make([]Message, len(msgs))
+	copy(out, msgs)
+	for i, m := range out {
+		tc, ok := calls[i]
+		if !ok || m.Content == supersededResult {
+			continue
+		}
+		superseded := latest[toolCallKey(tc)] > i
+		if path, r, ok := readFileCall(tc); ok {
+			for _, later := range reads[path] {
+				if later.index > i && later.lines.covers(r) {
+					superseded = true
+				}
+			}
+		}
+		if superseded && estimateTokens(m.Content) > estimateTokens(supersededResult) {
+			out[i].Content = supersededResult
+		}
+	}
+	return out
+}
+
+// fileRead 是一次完整的 read_file 结果在消息中的位置和读取的行范围
+type fileRead struct {
+	index int
+	lines lineRange
+}
+
+// covers 判断 r 是否包含 o 的所有行，End 为 0 表示读到文件末尾
+func (r lineRange) covers(o lineRange) bool {
+	if max(r.Start, 1) > max(o.Start, 1) {
+		return false
+	}
+	return r.End == 0 || (o.End != 0 && r.End >= o.End)
+}
+
+// completeRead 判断 read_file 的结果是否成功且没有被截断（截断提示见 renderLines）
+func completeRead(content string) bool {
+	return strings.HasPrefix(content, "=== ") &&
+		!strings.Contains(content, "字节上限，第 ") && !strings.Contains(content, "(该行过长，已截断)")
+}
+
+// pairToolCalls 把每条工具结果与它之前最近一条 assistant 消息中的调用配对，按消息下标索引。
+// 本地模型每轮都从 call_0 开始编号，ID 只在同一条 assistant 消息内唯一，不能跨轮查找；
+// 该消息中找不到对应 ID 时按位置配对
+func pairToolCalls(msgs []Message) map[int]ToolCall {
+	calls := make(map[int]ToolCall)
+	var round []ToolCall
+	pos := 0
+	for i, m := range msgs {
+		switch m.Role {
+		case "assistant":
+			round, pos = m.ToolCalls, 0
+		case "tool":
+			tc, ok := ToolCall{}, false
+			for _, c := range round {
+				if c.ID == m.ToolCallID {
+					tc, ok = c, true
+					break
+				}
+			}
+			if !ok && pos < len(round) {
+				tc, ok = round[pos], true
+			}
+			pos++
+			if ok {
+				calls[i] = tc
+			}
+		}
+	}
+	return calls
+}
+
+// toolCallKey 用工具名和规范化后的参数标识一次调用
+func toolCallKey(tc ToolCall) string {
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+		return tc.Function.Name + "\x00" + tc.Function.Arguments
+	}
+	// json.Marshal 按键排序，参数顺序不同的相同调用得到相同的 key
+	data, _ := json.Marshal(args)
+	return tc.Function.Name + "\x00" + string(data)
+}
+
+// readFileCall 返回 read_file 调用读取的路径和行范围，其他工具返回 false
+func readFileCall(tc ToolCall) (string, lineRange, bool) {
+	if tc.Function.Name != "read_file" {
+		return "", lineRange{}, false
+	}
+	var args map[string]interface{}
+	json.Unmarshal([]byte(tc.Function.Arguments), &args)
+	path := getStringArg(args, "file_path", "")
+	return path, lineRangeFromArgs(args), path != ""
+}
+
+// foldRounds 把最近 keep 轮之前的轮次整理为笔记，合并到 msgs[2] 的笔记消息中
+func foldRounds(msgs []Message, keep int) []Message {
+	head := 2
+	var notes []string
+	if len(msgs) > head && msgs[head].Role == "user" && strings.HasPrefix(msgs[head].Content, notesHeader) {
+		notes = strings.Split(strings.TrimPrefix(msgs[head].Content, notesHeader+"\n"), "\n")
+		head++
+	}
+
+	// 每个 assistant 消息开始新的一轮
+	var starts []int
+	for i := head; i < len(msgs); i++ {
+		if msgs[i].Role == "assistant" {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) <= keep {
+		return msgs
+	}
+	cut := starts[len(starts)-keep]
+
+	calls := pairToolCalls(msgs[head:cut])
+	for i, m := range msgs[head:cut] {
+		switch m.Role {
+		case "assistant":
+			if text := strings.TrimSpace(m.Content); text != "" {
+				notes = append(notes, "- 分析："+abbreviate(text, maxNoteRunes))
+			}
+		case "tool":
+			tc := calls[i]
+			notes = append(notes, fmt.Sprintf("- %s %s → %s（约 %d tokens）",
+				tc.Function.Name, abbreviate(tc.Function.Arguments, maxNoteRunes), summarizeResult(m.Content), estimateTokens(m.Content)))
+		}
+	}
+	if len(notes) > maxNoteLines {
+		notes = append([]string{"- （更早的笔记已省略）"}, notes[len(notes)-maxNoteLines+1:]...)
+	}
+
+	out := append([]Message(nil), msgs[:2]...)
+	out = append(out, Message{Role: "user", Content: notesHeader + "\n" + strings.Join(notes, "\n")})
+	return append(out, msgs[cut:]...)
+}
+
+// summarizeResult 取工具结果的第一行非空内容作为摘要
+func summarizeResult(content string) string {
+	if content == supersededResult {
+		return "已被后续调用取代"
+	}
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return abbreviate(line, maxNoteRunes)
+		}
+	}
+	return "（空）"
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	for s, want := range map[string]int{
+		"":        0,
+		"abcd":    1,
+		"abcde":   2,
+		"中文":      2,
+		"read 文件": 4,
+	} {
+		if got := estimateTokens(s); got != want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
+
+// toolRound 构造一轮：assistant 调用一次工具，以及对应的工具结果
+func toolRound(id, name, args, result string) []Message {
+	return []Message{
+		{Role: "assistant", Content: "分析 " + id, ToolCalls: []ToolCall{mockToolCall(id, name, args)}},
+		{Role: "tool", ToolCallID: id, Content: result},
+	}
+}
+
+func TestCompactMessages(t *testing.T) {
+	big := func(name string) string {
+		return fmt.Sprintf("=== %s (共 400 行) ===\n", name) + strings.Repeat("     1\tfunc x() {}\n", 400)
+	}
+	msgs := []Message{{Role: "system", Content: "system"}, {Role: "user", Content: "review"}}
+	msgs = append(msgs, toolRound("c1", "read_file", `{"file_path": "a.go", "start_line": 1}`, big("a.go"))...)
+	msgs = append(msgs, toolRound("c2", "read_file", `{"file_path": "b.go"}`, big("b.go"))...)
+	msgs = append(msgs, toolRound("c3", "read_file", `{"file_path": "a.go"}`, big("a.go"))...)
+	todos := strings.Repeat("a.go L1: // TODO: 处理错误\n", 20)
+	msgs = append(msgs, toolRound("c4", "search_in_files", `{"pattern": "TODO", "directory": "."}`, todos)...)
+	msgs = append(msgs, toolRound("c5", "search_in_files", `{"directory": ".", "pattern": "TODO"}`, todos)...)
+
+	// 只去掉被取代的结果就够了：c1 被整文件读取 c3 取代，c4 与 c5 参数相同
+	dropped := compactMessages(msgs, messagesTokens(msgs)-messageTokens(msgs[3])+100)
+	if len(dropped) != len(msgs) || dropped[3].Content != supersededResult || dropped[9].Content != supersededResult {
+		t.Errorf("superseded results not dropped")
+	}
+	if dropped[5].Content != msgs[5].Content || msgs[3].Content == supersededResult {
+		t.Errorf("unexpected changes to other messages")
+	}
+
+	compacted := compactMessages(msgs, 1000)
+	if messagesTokens(compacted) > 1000 {
+		t.Errorf("tokens = %d, want <= 1000", messagesTokens(compacted))
+	}
+	notes := compacted[2]
+	if notes.Role != "user" || !strings.HasPrefix(notes.Content, notesHeader) ||
+		!strings.Contains(notes.Content, `- read_file {"file_path": "b.go"} → === b.go (共 400 行) ===（约 `) ||
+		!strings.Contains(notes.Content, "- 分析：分析 c1") {
+		t.Errorf("notes:\n%s", notes.Content)
+	}
+	// 每个工具结果前都有对应的 tool_calls
+	calls := map[string]bool{}
+	for _, m := range compacted[3:] {
+		for _, tc := range m.ToolCalls {
+			calls[tc.ID] = true
+		}
+		if m.Role == "tool" && !calls[m.ToolCallID] {
+			t.Errorf("orphan tool result %s", m.ToolCallID)
+		}
+	}
+	if last := compacted[len(compacted)-1]; last.ToolCallID != "c5" || last.Content != todos {
+		t.Errorf("last round not kept: %+v", last)
+	}
+
+	// 再次压缩时追加到已有笔记，而不是新建一条
+	again := append(compacted, toolRound("c6", "read_file", `{"file_path": "c.go"}`, big("c.go"))...)
+	again = append(again, toolRound("c7", "read_file", `{"file_path": "d.go"}`, big("d.go"))...)
+	again = compactMessages(again, 2000)
+	if strings.Count(again[2].Content, notesHeader) != 1 || !strings.Contains(again[2].Content, "b.go") ||
+		!strings.Contains(again[2].Content, "c.go") || again[3].Role != "assistant" {
+		t.Errorf("notes not merged:\n%s", again[2].Content)
+	}
+}
+
+func TestDropSupersededResults(t *testing.T) {
+	lines := strings.Repeat("     1\tfunc x() {}\n", 50)
+	truncated := "=== a.go (第 1-49 行，共 400 行) ===\n" + lines +
+		"... (输出已达 1000 字节上限，第 50-400 行未显示，继续读取请使用 start_line=50)\n"
+	msgs := []Message{{Role: "system", Content: "system"}, {Role: "user", Content: "review"}}
+	msgs = append(msgs, toolRound("c1", "read_file", `{"file_path": "a.go", "start_line": 100, "end_line": 120}`, "=== a.go (第 100-120 行，共 400 行) ===\n"+lines)...)
+	msgs = append(msgs, toolRound("c2", "read_file", `{"file_path": "a.go"}`, truncated)...)
+	msgs = append(msgs, toolRound("c3", "read_file", `{"file_path": "b.go", "offset": 4, "limit": 10}`, "=== b.go (第 5-14 行，共 80 行) ===\n"+lines)...)
+	msgs = append(msgs, toolRound("c4", "read_file", `{"file_path": "b.go", "start_line": 10}`, "=== b.go (第 10-80 行，共 80 行) ===\n"+lines)...)
+	msgs = append(msgs, toolRound("c5", "read_file", `{"file_path": "b.go", "start_line": 1}`, "=== b.go (第 1-80 行，共 80 行) ===\n"+lines)...)
+
+	out := dropSupersededResults(msgs)
+	// 截断的整文件读取没有读到第 100-120 行，不能取代 c1
+	if out[3].Content == supersededResult || out[5].Content != truncated {
+		t.Errorf("truncated read superseded earlier range")
+	}
+	// c4 没有覆盖第 5-9 行，c5 覆盖了 c3 和 c4
+	if out[7].Content != supersededResult || out[9].Content != supersededResult || out[11].Content == supersededResult {
+		t.Errorf("b.go reads: %q, %q, %q", out[7].Content, out[9].Content, out[11].Content)
+	}
+	if dropSupersededResults(msgs[:10])[7].Content == supersededResult {
+		t.Errorf("partial later read superseded a wider range")
+	}
+}
+
+func TestCompactMessagesReusedCallIDs(t *testing.T) {
+	// 本地模型每轮都从 call_0 开始编号
+	big := "=== a.go (第 1-400 行，共 400 行) ===\n" + strings.Repeat("     1\tfunc x() {}\n", 400)
+	listing := "找到 1 个文件：\n" + strings.Repeat("- a.go (10 bytes)\n", 50)
+	msgs := []Message{{Role: "system", Content: "system"}, {Role: "user", Content: "review"}}
+	msgs = append(msgs, toolRound("call_0", "read_file", `{"file_path": "a.go"}`, big)...)
+	msgs = append(msgs, toolRound("call_0", "search_in_files", `{"pattern": "TODO"}`, "a.go L1: // TODO")...)
+	msgs = append(msgs, toolRound("call_0", "list_files", `{"directory": "."}`, listing)...)
+
+	if out := dropSupersededResults(msgs); out[3].Content != big {
+		t.Errorf("read_file result dropped though a.go was never read again")
+	}
+	folded := foldRounds(msgs, 1)
+	if notes := folded[2].Content; !strings.Contains(notes, `- read_file {"file_path": "a.go"} → === a.go`) ||
+		!strings.Contains(notes, `- search_in_files {"pattern": "TODO"} → a.go L1`) || strings.Contains(notes, "list_files") {
+		t.Errorf("notes:\n%s", notes)
+	}
+}
+
+func TestCodeReviewTokenBudget(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\n\n"+strings.Repeat("// 很长的注释，用来占用上下文\n", 300))
+	args, _ := json.Marshal(map[string]string{"file_path": "a.go"})
+	read := func(id string) Message {
+		return Message{ToolCalls: []ToolCall{mockToolCall(id, "read_file", string(args))}}
+	}
+
+	cfg := defaultConfig()
+	cfg.ContextWindow = minContextWindow
+	cfg.TokenBudget = 20000
+	var events []ReviewEvent
+	mock := NewMockProvider(read("c1"), read("c2"), read("c3"), read("c4"), mockSubmit("预算内完成"))
+	result, err := codeReview(context.Background(), ReviewOptions{
+		Provider: mock, Config: cfg, Workspace: dir,
+		OnEvent: func(ev ReviewEvent) { events = append(events, ev) },
+	}, "review")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := result.Budget
+	if usage == nil || usage.Compactions == 0 || !usage.Exhausted || usage.EstimatedTokens < cfg.TokenBudget {
+		t.Fatalf("budget = %+v", usage)
+	}
+	compactEvents := 0
+	for _, ev := range events {
+		if ev.Type == EventCompact {
+			compactEvents++
+		}
+	}
+	if compactEvents != usage.Compactions {
+		t.Errorf("compact events = %d, compactions = %d", compactEvents, usage.Compactions)
+	}
+	for i, req := range mock.Requests {
+		if got := messagesTokens(req.Messages) + toolsTokens(req.Tools); got > cfg.ContextWindow {
+			t.Errorf("request %d: %d tokens exceeds context window", i, got)
+		}
+	}
+
+	last := mock.Requests[len(mock.Requests)-1]
+	if len(last.Tools) != 1 || last.Tools[0].Function.Name != submitReviewTool ||
+		last.Messages[len(last.Messages)-1].Content != budgetExhaustedReminder {
+		t.Errorf("final round not restricted to submit_review: %d tools", len(last.Tools))
+	}
+
+	// 预算用完后仍不提交时结束审查
+	mock = NewMockProvider(read("c1"), read("c2"), read("c3"), read("c4"), read("c5"), read("c6"))
+	if _, err := codeReview(context.Background(), ReviewOptions{Provider: mock, Config: cfg, Workspace: dir}, "review"); err == nil ||
+		!strings.Contains(err.Error(), "超出 token 预算") {
+		t.Errorf("err = %v", err)
+	}
+}
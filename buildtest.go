@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===================== 沙箱执行 ===================== */
+
+const (
+	// 命令输出最多保留的字节数，超出部分丢弃
+	maxCommandOutput = 4 << 20
+	// 构建和测试命令最多使用的并行度，避免占满审查服务所在机器的 CPU
+	commandParallelism = 2
+	// 超时后先发中断信号，等待该时间仍未退出则强制结束
+	commandKillDelay = 5 * time.Second
+	// 输出中最多列出的失败数
+	maxFailures = 50
+	// 每个失败测试最多保留的输出行数
+	maxFailureOutputLines = 20
+)
+
+// commandPassEnv 是传给构建和测试命令的环境变量，其余变量（API Key 等）一律不传
+var commandPassEnv = []string{
+	"PATH", "HOME", "USER", "LANG", "LC_ALL", "TMPDIR", "TEMP", "TMP", "SYSTEMROOT",
+	"GOPATH", "GOROOT", "GOCACHE", "GOMODCACHE", "GOPROXY", "GOPRIVATE", "GONOPROXY",
+	"GONOSUMDB", "GOSUMDB", "GOINSECURE", "GOFLAGS", "GOTOOLCHAIN", "CGO_ENABLED", "CC", "CXX",
+}
+
+// commandEnv 返回清理后的环境变量
+func (env *ToolEnv) commandEnv() []string {
+	var vars []string
+	for _, name := range append(append([]string(nil), commandPassEnv...), env.Config.CommandEnv...) {
+		if value, ok := os.LookupEnv(name); ok {
+			vars = append(vars, name+"="+value)
+		}
+	}
+	return append(vars, "GOMAXPROCS="+strconv.Itoa(commandParallelism), "CI=true")
+}
+
+// commandResult 是一次沙箱执行的结果
+type commandResult struct {
+	Output    []byte
+	Truncated bool
+	Duration  time.Duration
+	TimedOut  bool
+	// Err 是非 0 退出等错误，命令无法启动时 run 直接返回错误
+	Err error
+}
+
+// cappedBuffer 只保留前 max 字节
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// runSandboxed 在 dir 中执行 argv：超时后终止，限制 CPU 时间和输出大小，只传递 commandPassEnv 中的环境变量
+func runSandboxed(ctx context.Context, env *ToolEnv, dir string, argv []string) (*commandResult, error) {
+	timeout := time.Duration(env.Config.CommandTimeout) * time.Second
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	name, args := argv[0], argv[1:]
+	if runtime.GOOS != "windows" {
+		if sh, err := exec.LookPath("sh"); err == nil {
+			// ulimit -t 限制每个进程的 CPU 时间（秒）；参数按位置传递，不拼接进脚本
+			cpu := strconv.Itoa(env.Config.CommandTimeout * commandParallelism)
+			args = append([]string{"-c", `ulimit -t "$0" 2>/dev/null; exec "$@"`, cpu, name}, args...)
+			name = sh
+		}
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env.commandEnv()
+	// 先发中断信号，go test 会结束子进程并输出已有结果
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = commandKillDelay
+	out := &cappedBuffer{max: maxCommandOutput}
+	cmd.Stdout, cmd.Stderr = out, out
+
+	start := time.Now()
+	err := cmd.Run()
+	result := &commandResult{Output: out.Bytes(), Truncated: out.truncated, Duration: time.Since(start), Err: err}
+	if parent.Err() != nil {
+		// 审查被取消或工具超时，由调用方报告
+		return nil, parent.Err()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		result.TimedOut = true
+		return result, nil
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("运行 %s 失败: %w", argv[0], err)
+	}
+	return result, nil
+}
+
+/* ===================== run_build / run_tests ===================== */
+
+// buildFailure 是一条编译错误或失败的测试，路径相对工作区
+type buildFailure struct {
+	Package string
+	// Test 为空表示编译错误或包级失败
+	Test    string
+	File    string
+	Line    int
+	Column  int
+	Message string
+	// Output 是失败测试的输出（已截断）
+	Output []string
+}
+
+func (f buildFailure) location() string {
+	switch {
+	case f.File == "":
+		return ""
+	case f.Column > 0:
+		return fmt.Sprintf("%s:%d:%d", f.File, f.Line, f.Column)
+	default:
+		return fmt.Sprintf("%s:%d", f.File, f.Line)
+	}
+}
+
+// commandRequest 是 run_build / run_tests 的参数
+type commandRequest struct {
+	// Packages 是文件、目录或 dir/... 形式的包模式，为空时表示整个工作区
+	Packages []string
+	// Run 是 go test -run 的正则
+	Run       string
+	BuildTags []string
+}
+
+func commandRequestFromArgs(args map[string]interface{}, cfg *Config) commandRequest {
+	return commandRequest{
+		Packages:  getStringSliceArg(args, "packages"),
+		Run:       getStringArg(args, "run", ""),
+		BuildTags: buildTagsArg(args, cfg),
+	}
+}
+
+// goTargets 把 req.Packages 映射为各 Go 模块中的包模式，路径必须位于工作区内
+func (req commandRequest) goTargets(env *ToolEnv) ([]*goModuleTarget, error) {
+	patterns := req.Packages
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	var modules []*goModuleTarget
+	for _, pattern := range patterns {
+		recursive := pattern == "..." || strings.HasSuffix(pattern, "/...")
+		dir := strings.TrimSuffix(strings.TrimSuffix(pattern, "..."), "/")
+		path, err := env.resolve(dir)
+		if err != nil {
+			return nil, err
+		}
+		root, pkg, ok := env.goPackageOf(path)
+		if !ok {
+			return nil, fmt.Errorf("%s 不在 Go 模块内（未找到 go.mod），其他语言请在 .ai-cr.yaml 中配置 build_command / test_command", pattern)
+		}
+		if recursive {
+			pkg = strings.TrimSuffix(pkg, "/.") + "/..."
+		}
+		moduleTarget(&modules, root).addPackage(pkg)
+	}
+	return modules, nil
+}
+
+// goFlags 是 go build / go test 共用的参数
+func (req commandRequest) goFlags() []string {
+	flags := []string{"-p", strconv.Itoa(commandParallelism)}
+	if len(req.BuildTags) > 0 {
+		flags = append(flags, "-tags", strings.Join(req.BuildTags, ","))
+	}
+	return flags
+}
+
+func runBuild(ctx context.Context, env *ToolEnv, req commandRequest) (string, error) {
+	if len(env.Config.BuildCommand) > 0 {
+		return runCustomCommand(ctx, env, "build_command", env.Config.BuildCommand)
+	}
+	modules, err := req.goTargets(env)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, m := range modules {
+		argv := append(append([]string{"go", "build", "-o", os.DevNull}, req.goFlags()...), m.pkgs...)
+		res, err := runSandboxed(ctx, env, m.root, argv)
+		if err != nil {
+			return "", err
+		}
+		title := fmt.Sprintf("go build %s", strings.Join(m.pkgs, " "))
+		failures := parseCompileErrors(env, m.root, res.Output)
+		sb.WriteString(renderCommandResult(env, title, res, failures))
+	}
+	return sb.String(), nil
+}
+
+func runTests(ctx context.Context, env *ToolEnv, req commandRequest) (string, error) {
+	if req.Run != "" {
+		if _, err := regexp.Compile(req.Run); err != nil {
+			return "", fmt.Errorf("无效的 run 正则 %q: %v", req.Run, err)
+		}
+	}
+	if len(env.Config.TestCommand) > 0 {
+		return runCustomCommand(ctx, env, "test_command", env.Config.TestCommand)
+	}
+	modules, err := req.goTargets(env)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, m := range modules {
+		timeout := time.Duration(env.Config.CommandTimeout) * time.Second
+		argv := append([]string{"go", "test", "-json", "-count=1", "-timeout", timeout.String()}, req.goFlags()...)
+		if req.Run != "" {
+			argv = append(argv, "-run="+req.Run)
+		}
+		argv = append(argv, m.pkgs...)
+		res, err := runSandboxed(ctx, env, m.root, argv)
+		if err != nil {
+			return "", err
+		}
+		failures, summary := parseTestEvents(ctx, env, m.root, res.Output)
+		title := fmt.Sprintf("go test %s（%s）", strings.Join(m.pkgs, " "), summary)
+		sb.WriteString(renderCommandResult(env, title, res, failures))
+	}
+	return sb.String(), nil
+}
+
+// runCustomCommand 执行配置中的命令，在工作区根目录运行
+func runCustomCommand(ctx context.Context, env *ToolEnv, key string, argv []string) (string, error) {
+	res, err := runSandboxed(ctx, env, env.Root, argv)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", key, err)
+	}
+	return renderCommandResult(env, strings.Join(argv, " "), res, parseCompileErrors(env, env.Root, res.Output)), nil
+}
+
+func renderCommandResult(env *ToolEnv, title string, res *commandResult, failures []buildFailure) string {
+	var sb strings.Builder
+	switch {
+	case res.TimedOut:
+		sb.WriteString(fmt.Sprintf("⏱️ %s 超时（%d 秒），已终止\n", title, env.Config.CommandTimeout))
+	case res.Err == nil:
+		sb.WriteString(fmt.Sprintf("✅ %s 成功（耗时 %.1fs）\n", title, res.Duration.Seconds()))
+		return sb.String()
+	default:
+		sb.WriteString(fmt.Sprintf("❌ %s 失败（耗时 %.1fs）\n", title, res.Duration.Seconds()))
+	}
+
+	for i, f := range failures {
+		if i == maxFailures {
+			sb.WriteString(fmt.Sprintf("... (还有 %d 处失败未显示)\n", len(failures)-i))
+			break
+		}
+		switch {
+		case f.Test != "":
+			sb.WriteString(fmt.Sprintf("--- FAIL: %s (%s)", f.Test, f.Package))
+			if loc := f.location(); loc != "" {
+				sb.WriteString(" " + loc)
+			}
+			sb.WriteString("\n")
+			for _, line := range f.Output {
+				sb.WriteString("    " + line + "\n")
+			}
+		case f.location() != "":
+			sb.WriteString(fmt.Sprintf("  %s: %s\n", f.location(), f.Message))
+		default:
+			sb.WriteString(fmt.Sprintf("  %s: %s\n", f.Package, f.Message))
+		}
+	}
+
+	// 没有解析出具体失败时附上输出末尾，便于模型判断原因
+	if len(failures) == 0 && len(res.Output) > 0 {
+		tail := res.Output
+		if len(tail) > env.Config.ReadFileMaxBytes {
+			tail = tail[len(tail)-env.Config.ReadFileMaxBytes:]
+			sb.WriteString("... (仅显示输出末尾)\n")
+		}
+		sb.WriteString(strings.ToValidUTF8(string(tail), ""))
+		if !bytes.HasSuffix(tail, []byte("\n")) {
+			sb.WriteString("\n")
+		}
+	}
+	if res.Truncated {
+		sb.WriteString(fmt.Sprintf("... (输出超过 %d 字节，已截断)\n", maxCommandOutput))
+	}
+	return sb.String()
+}
+
+// compileErrorRe 匹配编译器和多数工具的错误格式：file:line[:col]: message
+var compileErrorRe = regexp.MustCompile(`^(?:vet: )?([^\s:][^:]*\.\w+):(\d+)(?::(\d+))?:\s*(.+)$`)
+
+// parseCompileErrors 解析 go build 等命令输出中的 file:line:col: message，路径相对 dir
+func parseCompileErrors(env *ToolEnv, dir string, out []byte) []buildFailure {
+	var failures []buildFailure
+	pkg := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "# ") {
+			pkg = strings.TrimPrefix(line, "# ")
+			continue
+		}
+		if f, ok := parseCompileLine(env, dir, line); ok {
+			f.Package = pkg
+			failures = append(failures, f)
+		}
+	}
+	return failures
+}
+
+func parseCompileLine(env *ToolEnv, dir, line string) (buildFailure, bool) {
+	m := compileErrorRe.FindStringSubmatch(line)
+	if m == nil {
+		return buildFailure{}, false
+	}
+	n, _ := strconv.Atoi(m[2])
+	col, _ := strconv.Atoi(m[3])
+	return buildFailure{File: env.normalizePathFrom(dir, m[1]), Line: n, Column: col, Message: m[4]}, true
+}
+
+// testEvent 是 go test -json（test2json）的一条事件
+type testEvent struct {
+	Action     string
+	Package    string
+	Test       string
+	Output     string
+	ImportPath string
+}
+
+// testFileLineRe 匹配 t.Errorf 等输出的位置前缀，文件名相对包目录
+var testFileLineRe = regexp.MustCompile(`^\s*([\w.\-/]+\.go):(\d+): (.*)$`)
+
+// parseTestEvents 解析 go test -json 的输出，返回失败的测试（含 file:line）和包级失败，以及统计摘要
+func parseTestEvents(ctx context.Context, env *ToolEnv, dir string, out []byte) ([]buildFailure, string) {
+	type key struct{ pkg, test string }
+	outputs := make(map[key][]string)
+	var failures []buildFailure
+	passed, failed, skipped := 0, 0, 0
+	failedPkgs := make(map[string]bool)
+	testedPkgs := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	pkg := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		var ev testEvent
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &ev) != nil {
+			// 非 JSON 行是编译错误（旧版本 go 直接输出到 stderr）
+			if strings.HasPrefix(line, "# ") {
+				pkg = strings.TrimPrefix(line, "# ")
+			} else if f, ok := parseCompileLine(env, dir, line); ok {
+				f.Package = pkg
+				failures = append(failures, f)
+			}
+			continue
+		}
+		switch ev.Action {
+		case "build-output":
+			if f, ok := parseCompileLine(env, dir, strings.TrimRight(ev.Output, "\n")); ok {
+				f.Package = ev.ImportPath
+				failures = append(failures, f)
+			}
+		case "output":
+			k := key{ev.Package, ev.Test}
+			outputs[k] = append(outputs[k], strings.TrimRight(ev.Output, "\n"))
+		case "pass", "fail", "skip":
+			if ev.Test == "" {
+				testedPkgs[ev.Package] = true
+				if ev.Action == "fail" {
+					failedPkgs[ev.Package] = true
+				}
+				continue
+			}
+			switch ev.Action {
+			case "pass":
+				passed++
+			case "skip":
+				skipped++
+			case "fail":
+				failed++
+				failures = append(failures, buildFailure{Package: ev.Package, Test: ev.Test, Output: outputs[key{ev.Package, ev.Test}]})
+			}
+		}
+	}
+
+	// 包失败但没有失败的测试：panic、TestMain 失败或编译失败
+	var pkgNames []string
+	for p := range failedPkgs {
+		pkgNames = append(pkgNames, p)
+	}
+	sort.Strings(pkgNames)
+	for _, p := range pkgNames {
+		hasTest := false
+		for _, f := range failures {
+			if f.Package == p {
+				hasTest = true
+				break
+			}
+		}
+		if !hasTest {
+			lines := outputs[key{p, ""}]
+			failures = append(failures, buildFailure{Package: p, Test: "(包)", Output: lines})
+		}
+	}
+
+	dirs := goPackageDirs(ctx, env, dir, failures)
+	for i := range failures {
+		f := &failures[i]
+		if f.Test == "" {
+			continue
+		}
+		f.Output = trimTestOutput(f.Output)
+		// 取第一处 file:line 作为失败位置，转换为相对工作区的路径
+		for _, line := range f.Output {
+			if m := testFileLineRe.FindStringSubmatch(line); m != nil {
+				f.Line, _ = strconv.Atoi(m[2])
+				f.File = env.normalizePathFrom(dirs[f.Package], m[1])
+				f.Message = m[3]
+				break
+			}
+		}
+	}
+
+	summary := fmt.Sprintf("%d 个包，%d 通过，%d 失败", len(testedPkgs), passed, failed)
+	if skipped > 0 {
+		summary += fmt.Sprintf("，%d 跳过", skipped)
+	}
+	return failures, summary
+}
+
+// trimTestOutput 去掉 === RUN 等框架输出，只保留最后 maxFailureOutputLines 行
+func trimTestOutput(lines []string) []string {
+	var kept []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "=== ") || strings.HasPrefix(trimmed, "--- FAIL") ||
+			trimmed == "FAIL" || strings.HasPrefix(trimmed, "FAIL\t") || strings.HasPrefix(trimmed, "exit status") {
+			continue
+		}
+		kept = append(kept, strings.TrimRight(line, " \t"))
+	}
+	if len(kept) > maxFailureOutputLines {
+		kept = append([]string{"..."}, kept[len(kept)-maxFailureOutputLines:]...)
+	}
+	return kept
+}
+
+// goPackageDirs 用 go list 查出失败测试所在包的目录，测试输出中的文件名相对包目录
+func goPackageDirs(ctx context.Context, env *ToolEnv, dir string, failures []buildFailure) map[string]string {
+	var pkgs []string
+	for _, f := range failures {
+		if f.Test != "" && !containsString(pkgs, f.Package) {
+			pkgs = append(pkgs, f.Package)
+		}
+	}
+	dirs := make(map[string]string)
+	if len(pkgs) == 0 {
+		return dirs
+	}
+	// go list 同样在被审查仓库的模块中运行，使用与 go test 相同的沙箱；stderr 混在输出中，不含制表符的行会被忽略
+	res, err := runSandboxed(ctx, env, dir, append([]string{"go", "list", "-e", "-f", "{{.ImportPath}}\t{{.Dir}}", "--"}, pkgs...))
+	if err != nil || res.TimedOut || res.Err != nil {
+		return dirs
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(res.Output)), "\n") {
+		if importPath, pkgDir, ok := strings.Cut(line, "\t"); ok {
+			dirs[importPath] = pkgDir
+		}
+	}
+	return dirs
+}
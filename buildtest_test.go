@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newGoModule 创建临时 Go 模块，files 的键是相对路径；没有 go 时跳过测试
+func newGoModule(t *testing.T, files map[string]string) *ToolEnv {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	root := t.TempDir()
+	writeTestFile(t, root, "go.mod", "module example.com/demo\n\ngo 1.21\n")
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, root, name, content)
+	}
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestRunBuild(t *testing.T) {
+	env := newGoModule(t, map[string]string{
+		"ok/ok.go":   "package ok\n\nfunc OK() int { return 1 }\n",
+		"bad/bad.go": "package bad\n\nfunc Bad() int {\n\treturn \"x\"\n}\n",
+	})
+
+	out, err := runBuild(context.Background(), env, commandRequest{Packages: []string{"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "✅ go build ./ok 成功") {
+		t.Errorf("build ok:\n%s", out)
+	}
+
+	out, err = runBuild(context.Background(), env, commandRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "❌ go build ./... 失败") || !strings.Contains(out, "  bad/bad.go:4:9: ") {
+		t.Errorf("build bad:\n%s", out)
+	}
+
+	for _, pkgs := range [][]string{{"../"}, {"/etc/..."}} {
+		if _, err := runBuild(context.Background(), env, commandRequest{Packages: pkgs}); err == nil {
+			t.Errorf("%v: expected error", pkgs)
+		}
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	t.Setenv("AI_CR_TEST_SECRET", "s3cr3t")
+	env := newGoModule(t, map[string]string{
+		"calc/calc.go": "package calc\n\nfunc Add(a, b int) int { return a - b }\n",
+		"calc/calc_test.go": `package calc
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	if got := Add(1, 2); got != 3 {
+		t.Errorf("Add(1, 2) = %d, want 3", got)
+	}
+}
+
+func TestPass(t *testing.T) {}
+
+func TestEnv(t *testing.T) {
+	if os.Getenv("AI_CR_TEST_SECRET") != "" {
+		t.Error("secret leaked")
+	}
+	if os.Getenv("GOMAXPROCS") != "2" {
+		t.Error("GOMAXPROCS not limited")
+	}
+}
+`,
+	})
+
+	out, err := runTests(context.Background(), env, commandRequest{Packages: []string{"calc/..."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"❌ go test ./calc/...（1 个包，2 通过，1 失败）",
+		"--- FAIL: TestAdd (example.com/demo/calc) calc/calc_test.go:10",
+		"    calc_test.go:10: Add(1, 2) = -1, want 3",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "TestEnv") || strings.Contains(out, "=== RUN") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	out, err = runTests(context.Background(), env, commandRequest{Packages: []string{"calc"}, Run: "^TestPass$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "✅ go test ./calc（1 个包，1 通过，0 失败）") {
+		t.Errorf("run filter:\n%s", out)
+	}
+
+	if _, err := runTests(context.Background(), env, commandRequest{Run: "("}); err == nil {
+		t.Error("invalid run regexp: expected error")
+	}
+}
+
+func TestRunCustomCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	root := t.TempDir()
+	cfg := defaultConfig()
+	cfg.TestCommand = []string{"sh", "-c", `echo "src/app.js:12:5: expected 3"; exit 1`}
+	cfg.CommandTimeout = 1
+	cfg.BuildCommand = []string{"sleep", "10"}
+	env, err := newToolEnv(cfg, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runTests(context.Background(), env, commandRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "  src/app.js:12:5: expected 3") {
+		t.Errorf("custom test command:\n%s", out)
+	}
+
+	out, err = runBuild(context.Background(), env, commandRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "超时（1 秒），已终止") {
+		t.Errorf("timeout:\n%s", out)
+	}
+}
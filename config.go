@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/* ===================== 配置文件 ===================== */
+
+// 项目级配置文件名，从被审查的路径向上查找
+const projectConfigName = ".ai-cr.yaml"
+
+// Config 是 .ai-cr.yaml 的内容。合并顺序: 默认值 < 用户级 ~/.ai-cr.yaml < 项目级 < CLI 参数。
+// 标量字段非零即覆盖；focus、ignore、command_env 逐级追加；tool_timeouts 按工具名、prices 按模型名覆盖；code_extensions、build_tags 和命令整体替换。
+type Config struct {
+	// SystemPrompt 替换默认的系统提示词
+	SystemPrompt string `yaml:"system_prompt"`
+	// Focus 是追加到系统提示词中的自定义审查重点
+	Focus []string `yaml:"focus"`
+	// Ignore 是审查时忽略的路径 glob，支持 **
+	Ignore []string `yaml:"ignore"`
+
+	MaxRounds        int      `yaml:"max_rounds"`
+	ReadFileMaxBytes int      `yaml:"read_file_max_bytes"`
+	GitDiffMaxBytes  int      `yaml:"git_diff_max_bytes"`
+	CodeExtensions   []string `yaml:"code_extensions"`
+
+	// ContextWindow 是模型的上下文长度（token），历史消息接近该长度时自动压缩
+	ContextWindow int `yaml:"context_window"`
+	// TokenBudget 是单次审查累计发送和接收的 token 上限（估算值），0 表示不限制
+	TokenBudget int `yaml:"token_budget"`
+
+	// TrackedOnly 为 true 时目录类工具默认只遍历 git ls-files 列出的文件；
+	// 用指针区分"未设置"和显式 false，使后面的配置层级可以把它关掉
+	TrackedOnly *bool `yaml:"tracked_only"`
+
+	// BuildTags 是运行 Go linter、构建和测试时传入的构建标签
+	BuildTags []string `yaml:"build_tags"`
+
+	// BuildCommand / TestCommand 替换 run_build / run_tests 默认的 go build / go test，
+	// 按参数列表直接执行，不经过 shell；与 CommandEnv 一样只能在用户级配置中设置
+	BuildCommand []string `yaml:"build_command"`
+	TestCommand  []string `yaml:"test_command"`
+	// CommandTimeout 是构建和测试命令的超时时间（秒）
+	CommandTimeout int `yaml:"command_timeout"`
+	// CommandEnv 是额外传给构建和测试命令的环境变量名，其余环境变量（如 API Key）不会传递
+	CommandEnv []string `yaml:"command_env"`
+
+	// ToolTimeout 是单次工具调用的默认超时时间（秒），run_build / run_tests 默认按 command_timeout 计算
+	ToolTimeout int `yaml:"tool_timeout"`
+	// ToolTimeouts 按工具名覆盖超时时间（秒），如 {run_linter: 600}
+	ToolTimeouts map[string]int `yaml:"tool_timeouts"`
+
+	// Prices 是各模型每百万 token 的价格，用于计算审查费用；不在表中的模型只统计 token
+	Prices map[string]ModelPrice `yaml:"prices"`
+	// Currency 是价格的货币单位，只用于显示
+	Currency string `yaml:"currency"`
+
+	Severity VerdictPolicy `yaml:"severity"`
+	Port     int           `yaml:"port"`
+
+	// Sources 记录实际加载的配置文件，便于排查
+	Sources []string `yaml:"-"`
+	// Root 是项目配置所在目录，ignore 规则相对于它匹配
+	Root string `yaml:"-"`
+
+	ignore globSet
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		MaxRounds:        100,
+		ContextWindow:    64000,
+		TokenBudget:      2000000,
+		ReadFileMaxBytes: 10000,
+		GitDiffMaxBytes:  20000,
+		CodeExtensions: []string{
+			".go", ".js", ".ts", ".jsx", ".tsx", ".py", ".java", ".c",
+			".cpp", ".h", ".rs", ".php", ".rb", ".swift", ".kt",
+		},
+		Port:           8083,
+		CommandTimeout: 300,
+		ToolTimeout:    120,
+		Prices:         defaultPrices(),
+		Currency:       "USD",
+	}
+}
+
+// loadConfig 加载并合并配置。explicit 不为空时使用指定的项目配置，否则从 start 向上查找；
+// flags 是 CLI 参数，最后合并，可为 nil
+func loadConfig(start, explicit string, flags *Config) (*Config, error) {
+	cfg := defaultConfig()
+
+	if home, err := os.UserHomeDir(); err == nil {
+		if err := cfg.mergeFile(filepath.Join(home, projectConfigName), false); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	project := explicit
+	if project == "" {
+		project = findProjectConfig(start)
+	}
+	if project != "" && !containsString(cfg.Sources, project) {
+		if err := cfg.mergeFile(project, true); err != nil {
+			return nil, err
+		}
+		cfg.Root = filepath.Dir(project)
+	}
+	if flags != nil {
+		cfg.merge(flags)
+	}
+
+	if err := cfg.finish(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// findProjectConfig 从 start（文件或目录）开始逐级向上查找 .ai-cr.yaml
+func findProjectConfig(start string) string {
+	return findUp(start, projectConfigName)
+}
+
+// findUp 从 start（文件或目录）开始逐级向上查找名为 name 的文件，找不到时返回空
+func findUp(start, name string) string {
+	if start == "" {
+		start = "."
+	}
+	dir, err := filepath.Abs(start)
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	for {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// mergeFile 合并配置文件；project 为 true 时是被审查仓库中的配置，忽略其中只能由用户设置的字段
+func (c *Config) mergeFile(path string, project bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fc Config
+	if err := yaml.Unmarshal(data, &fc); err != nil {
+		return fmt.Errorf("解析配置文件 %s 失败: %w", path, err)
+	}
+	if project {
+		if ignored := fc.stripUserOnly(); len(ignored) > 0 {
+			log.Printf("⚠️  项目配置 %s 中的 %s 只能在用户级 ~/%s 中设置，已忽略", path, strings.Join(ignored, "、"), projectConfigName)
+		}
+	}
+	c.merge(&fc)
+	c.Sources = append(c.Sources, path)
+	return nil
+}
+
+// stripUserOnly 清除只能由用户设置的字段并返回它们的名称。被审查的仓库可以自带 .ai-cr.yaml，
+// 不能由它决定执行什么命令、把哪些环境变量（如 API Key）传给命令
+func (c *Config) stripUserOnly() []string {
+	var ignored []string
+	if len(c.BuildCommand) > 0 {
+		ignored = append(ignored, "build_command")
+		c.BuildCommand = nil
+	}
+	if len(c.TestCommand) > 0 {
+		ignored = append(ignored, "test_command")
+		c.TestCommand = nil
+	}
+	if len(c.CommandEnv) > 0 {
+		ignored = append(ignored, "command_env")
+		c.CommandEnv = nil
+	}
+	return ignored
+}
+
+// merge 用 o 中已设置的字段覆盖 c
+func (c *Config) merge(o *Config) {
+	if o.SystemPrompt != "" {
+		c.SystemPrompt = o.SystemPrompt
+	}
+	c.Focus = append(c.Focus, o.Focus...)
+	c.Ignore = append(c.Ignore, o.Ignore...)
+	if o.MaxRounds != 0 {
+		c.MaxRounds = o.MaxRounds
+	}
+	if o.ContextWindow != 0 {
+		c.ContextWindow = o.ContextWindow
+	}
+	if o.TokenBudget != 0 {
+		c.TokenBudget = o.TokenBudget
+	}
+	if o.ReadFileMaxBytes != 0 {
+		c.ReadFileMaxBytes = o.ReadFileMaxBytes
+	}
+	if o.GitDiffMaxBytes != 0 {
+		c.GitDiffMaxBytes = o.GitDiffMaxBytes
+	}
+	if len(o.CodeExtensions) > 0 {
+		c.CodeExtensions = o.CodeExtensions
+	}
+	if o.TrackedOnly != nil {
+		c.TrackedOnly = o.TrackedOnly
+	}
+	if len(o.BuildTags) > 0 {
+		c.BuildTags = o.BuildTags
+	}
+	if len(o.BuildCommand) > 0 {
+		c.BuildCommand = o.BuildCommand
+	}
+	if len(o.TestCommand) > 0 {
+		c.TestCommand = o.TestCommand
+	}
+	if o.CommandTimeout != 0 {
+		c.CommandTimeout = o.CommandTimeout
+	}
+	c.CommandEnv = append(c.CommandEnv, o.CommandEnv...)
+	if o.ToolTimeout != 0 {
+		c.ToolTimeout = o.ToolTimeout
+	}
+	for name, seconds := range o.ToolTimeouts {
+		if c.ToolTimeouts == nil {
+			c.ToolTimeouts = make(map[string]int)
+		}
+		c.ToolTimeouts[name] = seconds
+	}
+	for model, price := range o.Prices {
+		if c.Prices == nil {
+			c.Prices = make(map[string]ModelPrice)
+		}
+		c.Prices[model] = price
+	}
+	if o.Currency != "" {
+		c.Currency = o.Currency
+	}
+	c.Severity = c.Severity.override(o.Severity)
+	if o.Port != 0 {
+		c.Port = o.Port
+	}
+}
+
+// finish 校验配置并预编译 ignore 规则
+func (c *Config) finish() error {
+	if c.MaxRounds < 1 {
+		return fmt.Errorf("max_rounds 必须大于 0")
+	}
+	if c.ReadFileMaxBytes < 1 || c.GitDiffMaxBytes < 1 {
+		return fmt.Errorf("read_file_max_bytes / git_diff_max_bytes 必须大于 0")
+	}
+	if c.ContextWindow < minContextWindow {
+		return fmt.Errorf("context_window 不能小于 %d", minContextWindow)
+	}
+	if c.TokenBudget < 0 {
+		return fmt.Errorf("token_budget 不能小于 0")
+	}
+	if c.CommandTimeout < 1 || c.ToolTimeout < 1 {
+		return fmt.Errorf("command_timeout / tool_timeout 必须大于 0")
+	}
+	for name, seconds := range c.ToolTimeouts {
+		if !isToolName(name) {
+			return fmt.Errorf("tool_timeouts: 未知的工具 %q", name)
+		}
+		if seconds < 1 {
+			return fmt.Errorf("tool_timeouts.%s 必须大于 0", name)
+		}
+	}
+	for model, price := range c.Prices {
+		if price.Input < 0 || price.CachedInput < 0 || price.Output < 0 {
+			return fmt.Errorf("prices.%s: 价格不能小于 0", model)
+		}
+	}
+	if err := c.Severity.validate(); err != nil {
+		return fmt.Errorf("severity.%w", err)
+	}
+	c.ignore = newGlobSet(c.Ignore)
+	return nil
+}
+
+// toolTimeout 返回工具的超时时间：tool_timeouts 中的值优先，run_build / run_tests 在
+// command_timeout 的基础上留出终止命令和解析结果的时间，其余工具使用 tool_timeout
+func (c *Config) toolTimeout(name string) time.Duration {
+	if seconds, ok := c.ToolTimeouts[name]; ok {
+		return time.Duration(seconds) * time.Second
+	}
+	switch name {
+	case "run_build", "run_tests":
+		return time.Duration(c.CommandTimeout)*time.Second + commandKillDelay + 10*time.Second
+	}
+	return time.Duration(c.ToolTimeout) * time.Second
+}
+
+// isCodeFile 判断扩展名是否属于配置中的代码文件
+func (c *Config) isCodeFile(ext string) bool {
+	return containsString(c.CodeExtensions, ext)
+}
+
+// trackedOnly 返回目录类工具默认是否只遍历 git 已跟踪的文件
+func (c *Config) trackedOnly() bool {
+	return c.TrackedOnly != nil && *c.TrackedOnly
+}
+
+// ignored 判断路径是否命中 ignore 规则。规则相对项目根目录匹配，
+// 没有项目配置（Root 为空）时相对 workspace 匹配，否则 /vendor、dir/file 这类锚定规则永远匹配不上
+func (c *Config) ignored(workspace, path string) bool {
+	if c.ignore.empty() {
+		return false
+	}
+	base := c.Root
+	if base == "" {
+		base = workspace
+	}
+	if base != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			if rel, err := filepath.Rel(base, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				path = rel
+			}
+		}
+	}
+	return c.ignore.match(path)
+}
+
+// systemPrompt 返回最终的系统提示词
+func (c *Config) systemPrompt() string {
+	prompt := defaultSystemPrompt
+	if c.SystemPrompt != "" {
+		prompt = c.SystemPrompt
+	}
+	if len(c.Focus) > 0 {
+		prompt += "\n\n项目自定义审查重点：\n"
+		for i, f := range c.Focus {
+			prompt += fmt.Sprintf("%d. %s\n", i+1, f)
+		}
+	}
+	return prompt
+}
+
+// globSet 是一组路径 glob。不含 / 的规则匹配任意一级文件名或目录名，含 / 的规则（包括以 / 开头的）匹配完整的相对路径
+type globSet struct {
+	patterns []string
+	res      []*regexp.Regexp
+}
+
+func newGlobSet(patterns []string) globSet {
+	g := globSet{patterns: patterns}
+	for _, pattern := range patterns {
+		g.res = append(g.res, globRegexp(pattern))
+	}
+	return g
+}
+
+func (g globSet) empty() bool {
+	return len(g.res) == 0
+}
+
+func (g globSet) match(path string) bool {
+	path = filepath.ToSlash(filepath.Clean(path))
+	for i, re := range g.res {
+		if strings.Contains(strings.TrimSuffix(g.patterns[i], "/"), "/") {
+			if re.MatchString(path) {
+				return true
+			}
+			continue
+		}
+		for _, part := range strings.Split(path, "/") {
+			if re.MatchString(part) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globRegexp 把 glob 转成正则，目录规则同时匹配目录下的所有文件
+func globRegexp(pattern string) *regexp.Regexp {
+	pattern = strings.TrimPrefix(strings.TrimSuffix(filepath.ToSlash(pattern), "/"), "./")
+	pattern = strings.TrimPrefix(pattern, "/")
+	return regexp.MustCompile("^" + globExpr(pattern) + "(?:/.*)?$")
+}
+
+// globExpr 把 glob 转成正则表达式片段：** 匹配任意多级目录，* 和 ? 不跨越 /，支持 [abc]、[!abc] 字符类
+func globExpr(pattern string) string {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			if i+1 < len(pattern) && pattern[i+1] == '/' {
+				// **/ 匹配零或多级目录
+				i++
+				sb.WriteString("(?:.*/)?")
+			} else {
+				sb.WriteString(".*")
+			}
+		case ch == '*':
+			sb.WriteString("[^/]*")
+		case ch == '?':
+			sb.WriteString("[^/]")
+		case ch == '[':
+			class, end, ok := globClass(pattern, i)
+			if !ok {
+				sb.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			sb.WriteString(class)
+			i = end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return sb.String()
+}
+
+// globClass 转换从 pattern[start] 开始的字符类，如 [cod]、[!0-9]、[]a]。
+// 返回正则片段和 ] 的位置；没有闭合或范围无效时返回 false，[ 按字面量处理
+func globClass(pattern string, start int) (string, int, bool) {
+	i := start + 1
+	var sb strings.Builder
+	sb.WriteString("[")
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		// 取反的字符类也不能匹配 /
+		sb.WriteString("^/")
+		i++
+	}
+	for first := true; i < len(pattern); i, first = i+1, false {
+		ch := pattern[i]
+		if ch == ']' && !first {
+			sb.WriteString("]")
+			class := sb.String()
+			if _, err := regexp.Compile(class); err != nil {
+				return "", 0, false
+			}
+			return class, i, true
+		}
+		if ch == '\\' && i+1 < len(pattern) {
+			i++
+			ch = pattern[i]
+		}
+		if ch == '\\' || ch == '[' || ch == ']' || ch == '^' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(ch)
+	}
+	return "", 0, false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
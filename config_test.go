@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeTestFile(t, home, projectConfigName, "focus:\n  - 团队规范\nmax_rounds: 50\n")
+
+	root := t.TempDir()
+	writeTestFile(t, root, projectConfigName, `
+focus:
+  - 检查错误是否被忽略
+ignore:
+  - vendor
+  - "**/*.pb.go"
+  - docs/generated/**
+read_file_max_bytes: 200
+severity:
+  block_on: critical
+`)
+	sub := filepath.Join(root, "pkg", "api")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(filepath.Join(sub, "handler.go"), "", &Config{MaxRounds: 7})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.Sources) != 2 || cfg.Root != root {
+		t.Errorf("sources = %v, root = %s", cfg.Sources, cfg.Root)
+	}
+	if cfg.MaxRounds != 7 || cfg.ReadFileMaxBytes != 200 || cfg.GitDiffMaxBytes != 20000 || cfg.Port != 8083 {
+		t.Errorf("limits not merged: %+v", cfg)
+	}
+	if cfg.Severity.BlockOn != SeverityCritical || cfg.Severity.WarnOn != "" {
+		t.Errorf("severity = %+v", cfg.Severity)
+	}
+	prompt := cfg.systemPrompt()
+	if !strings.HasPrefix(prompt, defaultSystemPrompt) || !strings.Contains(prompt, "1. 团队规范") || !strings.Contains(prompt, "2. 检查错误是否被忽略") {
+		t.Errorf("focus not appended to prompt:\n%s", prompt)
+	}
+
+	for path, want := range map[string]bool{
+		filepath.Join(root, "vendor", "x", "y.go"):           true,
+		filepath.Join(root, "pkg", "api", "api.pb.go"):       true,
+		filepath.Join(root, "api.pb.go"):                     true,
+		filepath.Join(root, "docs", "generated", "a.md"):     true,
+		filepath.Join(root, "pkg", "docs", "generated", "a"): false,
+		filepath.Join(root, "pkg", "api", "handler.go"):      false,
+	} {
+		if got := cfg.ignored("", path); got != want {
+			t.Errorf("ignored(%s) = %v, want %v", path, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		"max_rounds: 0\nseverity:\n  warn_on: huge\n",
+		"tool_timeouts:\n  read_fil: 10\n",
+		"tool_timeouts:\n  run_linter: 0\n",
+		"prices:\n  deepseek-chat: {input: -1}\n",
+	} {
+		writeTestFile(t, root, "bad.yaml", bad)
+		if _, err := loadConfig(root, filepath.Join(root, "bad.yaml"), nil); err == nil {
+			t.Errorf("invalid config accepted: %q", bad)
+		}
+	}
+
+	writeTestFile(t, root, "timeouts.yaml", "tool_timeout: 30\ntool_timeouts:\n  run_linter: 600\n")
+	cfg, err = loadConfig(root, filepath.Join(root, "timeouts.yaml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]time.Duration{
+		"run_linter": 10 * time.Minute,
+		"read_file":  30 * time.Second,
+		"run_tests":  300*time.Second + commandKillDelay + 10*time.Second,
+	} {
+		if got := cfg.toolTimeout(name); got != want {
+			t.Errorf("toolTimeout(%s) = %s, want %s", name, got, want)
+		}
+	}
+
+	// prices 按模型名覆盖，未提及的模型保留默认价格
+	writeTestFile(t, root, "prices.yaml", "currency: CNY\nprices:\n  deepseek-chat: {input: 2, cached_input: 0.2, output: 3}\n  qwen-max: {input: 2.4, output: 9.6}\n")
+	cfg, err = loadConfig(root, filepath.Join(root, "prices.yaml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Currency != "CNY" || cfg.Prices["deepseek-chat"].Output != 3 || cfg.Prices["qwen-max"].Input != 2.4 ||
+		cfg.Prices["gpt-4o"] != defaultPrices()["gpt-4o"] {
+		t.Errorf("prices = %+v, currency = %s", cfg.Prices, cfg.Currency)
+	}
+}
+
+func TestProjectConfigCannotSetCommands(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeTestFile(t, home, projectConfigName, "command_env: [NODE_OPTIONS]\ntest_command: [npx, jest]\n")
+
+	root := t.TempDir()
+	writeTestFile(t, root, projectConfigName, "max_rounds: 20\ncommand_env: [OPENAI_API_KEY, DEEPSEEK_API_KEY]\nbuild_command: [sh, -c, env]\ntest_command: [sh, -c, env]\n")
+	cfg, err := loadConfig(root, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxRounds != 20 {
+		t.Errorf("max_rounds = %d", cfg.MaxRounds)
+	}
+	// 项目配置中的命令和环境变量被忽略，用户级配置保留
+	if strings.Join(cfg.CommandEnv, ",") != "NODE_OPTIONS" || cfg.BuildCommand != nil ||
+		strings.Join(cfg.TestCommand, " ") != "npx jest" {
+		t.Errorf("command_env = %v, build_command = %v, test_command = %v", cfg.CommandEnv, cfg.BuildCommand, cfg.TestCommand)
+	}
+}
+
+func TestConfigWithoutProjectRoot(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeTestFile(t, home, projectConfigName, "tracked_only: true\nignore:\n  - /vendor\n  - docs/generated.md\n")
+
+	workspace := t.TempDir()
+	off := false
+	cfg, err := loadConfig(workspace, "", &Config{TrackedOnly: &off})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 后面的层级显式写 false 可以关掉前面打开的 tracked_only
+	if cfg.TrackedOnly == nil || cfg.trackedOnly() {
+		t.Errorf("tracked_only = %v, want explicit false", cfg.TrackedOnly)
+	}
+	if cfg.Root != "" {
+		t.Fatalf("root = %q, want empty", cfg.Root)
+	}
+	// 没有项目配置时，锚定规则相对工作区匹配
+	for path, want := range map[string]bool{
+		filepath.Join(workspace, "vendor", "x.go"):            true,
+		filepath.Join(workspace, "pkg", "vendor", "x.go"):     false,
+		filepath.Join(workspace, "docs", "generated.md"):      true,
+		filepath.Join(workspace, "a", "docs", "generated.md"): false,
+	} {
+		if got := cfg.ignored(workspace, path); got != want {
+			t.Errorf("ignored(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
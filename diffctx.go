@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* ===================== diff 上下文扩展 ===================== */
+
+const (
+	// 所在代码块超过该行数时不展开，只给出行号范围
+	maxEnclosingLines = 300
+	// 启发式查找代码块起点时最多向上扫描的行数
+	maxEnclosingScan = 500
+)
+
+// diffFile 是 unified diff 中的一个文件
+type diffFile struct {
+	OldPath string
+	NewPath string
+	// Binary 为 true 时没有 hunk
+	Binary bool
+	Hunks  []diffHunk
+}
+
+// diffHunk 是一个 @@ 片段，行号从 1 开始
+type diffHunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	// Header 是 @@ 行本身（含 git 给出的函数名提示）
+	Header string
+	// Lines 是带 ' '、'+'、'-' 前缀的内容行
+	Lines []string
+}
+
+// changedLines 返回 hunk 在新版本中改动的行号；纯删除的 hunk 返回删除位置
+func (h diffHunk) changedLines() []int {
+	var lines []int
+	n := h.NewStart
+	for _, line := range h.Lines {
+		switch {
+		case strings.HasPrefix(line, "+"):
+			lines = append(lines, n)
+			n++
+		case strings.HasPrefix(line, "-"):
+			if n > 0 && (len(lines) == 0 || lines[len(lines)-1] != n) {
+				lines = append(lines, n)
+			}
+		case strings.HasPrefix(line, `\`):
+			// \ No newline at end of file
+		default:
+			n++
+		}
+	}
+	return lines
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parseUnifiedDiff 把 git diff 的输出解析为文件和 hunk
+func parseUnifiedDiff(text string) []diffFile {
+	var files []diffFile
+	var file *diffFile
+	var hunk *diffHunk
+	flush := func() {
+		if file == nil {
+			return
+		}
+		if hunk != nil {
+			file.Hunks = append(file.Hunks, *hunk)
+			hunk = nil
+		}
+		files = append(files, *file)
+		file = nil
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			flush()
+			file = &diffFile{}
+			if a, b, ok := splitDiffGitLine(strings.TrimPrefix(line, "diff --git ")); ok {
+				file.OldPath, file.NewPath = a, b
+			}
+		case file == nil:
+			continue
+		case strings.HasPrefix(line, "@@"):
+			if hunk != nil {
+				file.Hunks = append(file.Hunks, *hunk)
+			}
+			m := hunkHeaderRe.FindStringSubmatch(line)
+			if m == nil {
+				hunk = nil
+				continue
+			}
+			hunk = &diffHunk{
+				OldStart: atoiDefault(m[1], 0), OldLines: atoiDefault(m[2], 1),
+				NewStart: atoiDefault(m[3], 0), NewLines: atoiDefault(m[4], 1),
+				Header: line,
+			}
+		case hunk != nil:
+			hunk.Lines = append(hunk.Lines, line)
+		case strings.HasPrefix(line, "--- "):
+			file.OldPath = diffPath(strings.TrimPrefix(line, "--- "), "a/")
+		case strings.HasPrefix(line, "+++ "):
+			file.NewPath = diffPath(strings.TrimPrefix(line, "+++ "), "b/")
+		case strings.HasPrefix(line, "rename to "):
+			file.NewPath = strings.TrimPrefix(line, "rename to ")
+		case strings.HasPrefix(line, "new file mode"):
+			file.OldPath = ""
+		case strings.HasPrefix(line, "deleted file mode"):
+			file.NewPath = ""
+		case strings.HasPrefix(line, "Binary files "):
+			file.Binary = true
+		}
+	}
+	flush()
+	return files
+}
+
+// splitDiffGitLine 解析 "a/x b/x"，只处理两侧路径相同或不含空格的情况
+func splitDiffGitLine(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, "a/") {
+		return "", "", false
+	}
+	// 路径相同时（最常见）从中间切开，避免路径含空格时切错
+	if n := len(s); n%2 == 1 {
+		half := (n - 1) / 2
+		if s[half] == ' ' && s[2:half] == s[half+3:] && s[half+1:half+3] == "b/" {
+			return s[2:half], s[half+3:], true
+		}
+	}
+	i := strings.Index(s, " b/")
+	if i < 0 {
+		return "", "", false
+	}
+	return s[2:i], s[i+3:], true
+}
+
+// diffPath 去掉 a/ b/ 前缀，/dev/null 返回空
+func diffPath(s, prefix string) string {
+	s = strings.TrimSuffix(s, "\t")
+	if s == "/dev/null" {
+		return ""
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	return strings.TrimPrefix(s, prefix)
+}
+
+func atoiDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// codeBlock 是包含改动的函数、方法或类型声明，行号从 1 开始
+type codeBlock struct {
+	Start, End int
+	// Title 是声明的第一行，如 func (s *Server) Start() error {
+	Title string
+}
+
+// enclosingBlocks 返回覆盖 lines 中任意一行的代码块，按起始行排序且不重复。
+// Go 文件按 AST 查找顶层声明，其余代码文件按缩进和括号启发式查找
+func enclosingBlocks(path string, src []byte, lines []int) []codeBlock {
+	return newBlockFinder(path, src).find(lines)
+}
+
+// blockFinder 在同一文件中查找改动所在的代码块，文件只解析一次，供多个 hunk 复用
+type blockFinder struct {
+	ext string
+	// decls 是 Go 文件的顶层声明；goOK 为 false 时（非 Go 文件或语法错误）退回启发式
+	decls []codeBlock
+	goOK  bool
+	text  []string
+}
+
+func newBlockFinder(path string, src []byte) *blockFinder {
+	f := &blockFinder{ext: filepath.Ext(path)}
+	if f.ext == ".go" {
+		f.decls, f.goOK = goBlocks(path, src)
+	}
+	if !f.goOK {
+		f.text = strings.Split(strings.TrimSuffix(string(src), "\n"), "\n")
+	}
+	return f
+}
+
+// find 返回覆盖 lines 中任意一行的代码块，按起始行排序且不重复
+func (f *blockFinder) find(lines []int) []codeBlock {
+	var blocks []codeBlock
+	add := func(b codeBlock) {
+		for _, existing := range blocks {
+			if existing.Start == b.Start {
+				return
+			}
+		}
+		blocks = append(blocks, b)
+	}
+	for _, line := range lines {
+		if f.goOK {
+			for _, b := range f.decls {
+				if b.Start <= line && line <= b.End {
+					add(b)
+				}
+			}
+		} else if b, ok := heuristicBlock(f.text, line, f.ext); ok {
+			add(b)
+		}
+	}
+	sortBlocks(blocks)
+	return blocks
+}
+
+// sortBlocks 按起始行排序，起始行相同的保持原有顺序
+func sortBlocks(blocks []codeBlock) {
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].Start < blocks[j].Start })
+}
+
+// goBlocks 返回 Go 文件的顶层声明。分组声明（const (...)、type (...)）按单个 spec 返回，
+// 避免一个大的常量块淹没改动
+func goBlocks(path string, src []byte) ([]codeBlock, bool) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, false
+	}
+	text := strings.Split(string(src), "\n")
+	block := func(doc *ast.CommentGroup, node ast.Node) codeBlock {
+		start := fset.Position(node.Pos()).Line
+		b := codeBlock{Start: start, End: fset.Position(node.End()).Line, Title: strings.TrimSpace(text[start-1])}
+		if doc != nil {
+			b.Start = fset.Position(doc.Pos()).Line
+		}
+		return b
+	}
+
+	var blocks []codeBlock
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			blocks = append(blocks, block(d.Doc, d))
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				continue
+			}
+			if !d.Lparen.IsValid() {
+				blocks = append(blocks, block(d.Doc, d))
+				continue
+			}
+			for _, spec := range d.Specs {
+				var doc *ast.CommentGroup
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					doc = s.Doc
+				case *ast.ValueSpec:
+					doc = s.Doc
+				}
+				b := block(doc, spec)
+				b.Title = d.Tok.String() + " " + b.Title
+				blocks = append(blocks, b)
+			}
+		}
+	}
+	return blocks, true
+}
+
+// declStartRe 匹配常见语言的函数、方法、类型声明的第一行
+var declStartRe = regexp.MustCompile(`^\s*(?:@\w+\s+)*(?:export\s+)?(?:default\s+)?(?:pub(?:\([^)]*\))?\s+)?` +
+	`(?:(?:public|private|protected|internal|static|final|abstract|override|open|virtual|inline|unsafe|extern|async|suspend|data|sealed)\s+)*` +
+	`(?:func|fun|fn|def|function|class|struct|enum|interface|trait|impl|module|object|protocol|extension)\b`)
+
+// cStyleDeclRe 匹配 C/C++/Java/C# 风格的函数定义：返回类型 名字(参数) {
+var cStyleDeclRe = regexp.MustCompile(`^\s*[\w:<>\[\],*&\s]+?[\s*&]([\w:~]+)\s*\([^;]*\)\s*(?:const\s*)?(?:throws\s+[\w.,\s]+)?\{?\s*$`)
+
+// arrowDeclRe 匹配 JS/TS 中赋值给变量的函数
+var arrowDeclRe = regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+\w+\s*(?::[^=]+)?=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*(?::[^=]+)?=>|\w+\s*=>)`)
+
+var controlKeywords = map[string]bool{
+	"if": true, "for": true, "while": true, "switch": true, "catch": true,
+	"else": true, "return": true, "do": true, "try": true, "sizeof": true,
+}
+
+func isDeclStart(line string) bool {
+	if declStartRe.MatchString(line) || arrowDeclRe.MatchString(line) {
+		return true
+	}
+	m := cStyleDeclRe.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	first := strings.Fields(line)[0]
+	return !controlKeywords[first] && !controlKeywords[m[1]]
+}
+
+// heuristicBlock 从 line 向上找缩进更浅的声明起点，再按括号（Python 按缩进，Ruby 按 end）找终点
+func heuristicBlock(text []string, line int, ext string) (codeBlock, bool) {
+	if line < 1 || line > len(text) {
+		return codeBlock{}, false
+	}
+	limit := indentOf(text[line-1])
+	switch trimmed := strings.TrimSpace(text[line-1]); {
+	case trimmed == "":
+		limit = 1 << 30
+	case strings.HasPrefix(trimmed, "}") || strings.HasPrefix(trimmed, ")") || trimmed == "end":
+		// 块的结束行和块体同属一个代码块
+		limit++
+	}
+	for i := line; i >= 1 && line-i <= maxEnclosingScan; i-- {
+		s := text[i-1]
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		indent := indentOf(s)
+		if i != line && indent >= limit {
+			continue
+		}
+		if isDeclStart(s) {
+			if end := blockEnd(text, i, ext); end >= line {
+				return codeBlock{Start: i, End: end, Title: strings.TrimSpace(s)}, true
+			}
+			if indent == 0 {
+				return codeBlock{}, false
+			}
+		}
+		if i != line {
+			limit = indent
+		}
+		if indent == 0 && i != line {
+			// 已回到顶层且不是声明，改动不在任何代码块内
+			return codeBlock{}, false
+		}
+	}
+	return codeBlock{}, false
+}
+
+// blockEnd 返回从 start 行开始的代码块的最后一行
+func blockEnd(text []string, start int, ext string) int {
+	base := indentOf(text[start-1])
+	switch ext {
+	case ".py":
+		end := start
+		for i := start + 1; i <= len(text); i++ {
+			s := text[i-1]
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			if indentOf(s) <= base && !strings.HasPrefix(strings.TrimSpace(s), ")") {
+				break
+			}
+			end = i
+		}
+		return end
+	case ".rb":
+		for i := start + 1; i <= len(text); i++ {
+			if indentOf(text[i-1]) == base && strings.TrimSpace(text[i-1]) == "end" {
+				return i
+			}
+		}
+		return start
+	}
+
+	depth, opened := 0, false
+	for i := start; i <= len(text); i++ {
+		for _, c := range stripStrings(text[i-1]) {
+			switch c {
+			case '{':
+				depth++
+				opened = true
+			case '}':
+				depth--
+			}
+		}
+		if opened && depth <= 0 {
+			return i
+		}
+		// 声明之后若干行仍没有 {，视为单行声明（如 Kotlin 的表达式函数）
+		if !opened && i-start >= 10 {
+			return start
+		}
+	}
+	return start
+}
+
+var charLiteralRe = regexp.MustCompile(`^'(?:\\.|[^'\\])+'`)
+
+// stripStrings 去掉行内的字符串、字符字面量和 // 注释，避免其中的括号干扰计数
+func stripStrings(s string) string {
+	var sb strings.Builder
+	var quote rune
+	escaped := false
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' && !charLiteralRe.MatchString(s[i:]):
+			// Rust 生命周期等单独出现的 '
+			sb.WriteRune(c)
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '/' && strings.HasPrefix(s[i:], "//"):
+			return sb.String()
+		case c == '#' && strings.TrimSpace(s[:i]) == "":
+			// 预处理指令和 shell 风格注释
+			return sb.String()
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// indentOf 返回行首缩进宽度，tab 按 4 计
+func indentOf(s string) int {
+	n := 0
+	for _, c := range s {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 4
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+/* ===================== get_diff_context ===================== */
+
+// diffWithContext 获取 spec 描述的 diff，为每个 hunk 附上新版本中所在函数、方法或类型的完整源码。
+// 同一代码块只展开一次；输出超过 GitDiffMaxBytes 时截断。没有变更时返回空字符串
+func diffWithContext(ctx context.Context, env *ToolEnv, spec gitDiffSpec) (string, error) {
+	text, newRev, err := gitDiff(ctx, env, spec)
+	if err != nil {
+		return "", err
+	}
+	files := parseUnifiedDiff(text)
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	budget := env.Config.GitDiffMaxBytes
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("变更范围：%s，共 %d 个文件有变更：\n\n", spec, len(files)))
+	for _, f := range files {
+		sb.WriteString(renderDiffFile(ctx, env, f, newRev))
+		if sb.Len() > budget {
+			return truncateUTF8(sb.String(), budget) + "\n... (diff 过长，已截断；可用 get_git_diff 或 read_file 查看其余部分)\n", nil
+		}
+	}
+	return sb.String(), nil
+}
+
+// renderDiffFile 输出单个文件的 hunk，代码块从 newRev 中读取（见 gitDiffSpec.command）
+func renderDiffFile(ctx context.Context, env *ToolEnv, f diffFile, newRev string) string {
+	var sb strings.Builder
+	switch {
+	case f.OldPath == "":
+		sb.WriteString(fmt.Sprintf("📄 %s（新增）\n", f.NewPath))
+	case f.NewPath == "":
+		sb.WriteString(fmt.Sprintf("📄 %s（删除）\n", f.OldPath))
+	case f.OldPath != f.NewPath:
+		sb.WriteString(fmt.Sprintf("📄 %s（由 %s 重命名）\n", f.NewPath, f.OldPath))
+	default:
+		sb.WriteString(fmt.Sprintf("📄 %s\n", f.NewPath))
+	}
+	if f.Binary {
+		sb.WriteString("  (二进制文件)\n\n")
+		return sb.String()
+	}
+
+	// 只为新版本存在的代码文件展开上下文，新增文件的 hunk 本身就是全文
+	var blocks *blockFinder
+	var text []string
+	if f.NewPath != "" && f.OldPath != "" && env.Config.isCodeFile(filepath.Ext(f.NewPath)) {
+		if data, err := readRevision(ctx, env, newRev, f.NewPath); err == nil {
+			blocks = newBlockFinder(f.NewPath, data)
+			text = strings.Split(string(data), "\n")
+		}
+	}
+
+	shown := make(map[int]bool)
+	for _, h := range f.Hunks {
+		sb.WriteString(h.Header + "\n")
+		for _, line := range h.Lines {
+			sb.WriteString(line + "\n")
+		}
+		if blocks == nil {
+			continue
+		}
+		for _, b := range blocks.find(h.changedLines()) {
+			if shown[b.Start] {
+				sb.WriteString(fmt.Sprintf("🔍 所在代码块 %s 见上文\n", b.Title))
+				continue
+			}
+			shown[b.Start] = true
+			if b.End-b.Start+1 > maxEnclosingLines {
+				sb.WriteString(fmt.Sprintf("🔍 所在代码块 %s（第 %d-%d 行）过长未展开，可用 read_file 查看\n", b.Title, b.Start, b.End))
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("🔍 所在代码块（新版本第 %d-%d 行）：\n", b.Start, b.End))
+			for n := b.Start; n <= b.End && n <= len(text); n++ {
+				sb.WriteString(fmt.Sprintf("%6d\t%s\n", n, strings.TrimSuffix(text[n-1], "\r")))
+			}
+		}
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
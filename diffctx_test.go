@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const serverBefore = `package demo
+
+import "fmt"
+
+// Server 处理请求
+type Server struct {
+	name string
+}
+
+// Start 启动服务
+func (s *Server) Start() error {
+	fmt.Println("starting", s.name)
+	return nil
+}
+
+func unrelated() {}
+`
+
+func TestDiffWithContext(t *testing.T) {
+	root := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	writeTestFile(t, root, "server.go", serverBefore)
+	writeTestFile(t, root, "notes.txt", "a\nb\n")
+	git("add", ".")
+	git("-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "init")
+
+	writeTestFile(t, root, "server.go", strings.Replace(serverBefore, `fmt.Println("starting", s.name)`, "if s.name == \"\" {\n\t\treturn fmt.Errorf(\"no name\")\n\t}", 1))
+	writeTestFile(t, root, "notes.txt", "a\nc\n")
+
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := diffWithContext(context.Background(), env, gitDiffSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"共 2 个文件有变更",
+		"📄 server.go",
+		"+\t\treturn fmt.Errorf(\"no name\")",
+		"🔍 所在代码块（新版本第 10-16 行）",
+		"    10\t// Start 启动服务",
+		"    16\t}",
+		"📄 notes.txt",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	// 未改动的声明和非代码文件不展开
+	if strings.Contains(out, "\tname string") || strings.Count(out, "🔍") != 1 {
+		t.Errorf("unexpected context:\n%s", out)
+	}
+
+	git("checkout", "-q", ".")
+	if out, err := diffWithContext(context.Background(), env, gitDiffSpec{}); err != nil || out != "" {
+		t.Errorf("clean tree: %q, %v", out, err)
+	}
+}
+
+func TestHeuristicBlock(t *testing.T) {
+	tests := []struct {
+		name, ext, src string
+		line           int
+		start, end     int
+	}{
+		{"js method", ".js", `class A {
+  run(x) {
+    if (x) {
+      return "}";
+    }
+  }
+}
+`, 4, 2, 6},
+		{"java method", ".java", `public class A {
+    public int add(int a, int b) {
+        int c = a + b;
+        return c;
+    }
+
+    private void other() {}
+}
+`, 3, 2, 5},
+		{"python", ".py", `import os
+
+def outer(x):
+    y = x + 1
+
+    return y
+
+print(outer(1))
+`, 4, 3, 6},
+		{"ruby", ".rb", `class A
+  def run
+    puts "x"
+  end
+end
+`, 3, 2, 4},
+		{"closing brace", ".ts", `function f(): void {
+  g();
+}
+`, 3, 1, 3},
+		{"rust lifetime", ".rs", `fn first<'a>(s: &'a str) -> &'a str {
+    &s[..1]
+}
+`, 2, 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := strings.Split(strings.TrimSuffix(tt.src, "\n"), "\n")
+			b, ok := heuristicBlock(text, tt.line, tt.ext)
+			if !ok || b.Start != tt.start || b.End != tt.end {
+				t.Errorf("got %+v, %v; want %d-%d", b, ok, tt.start, tt.end)
+			}
+		})
+	}
+
+	// 顶层语句不属于任何代码块
+	text := strings.Split("def f():\n    pass\n\nprint(1)", "\n")
+	if b, ok := heuristicBlock(text, 4, ".py"); ok {
+		t.Errorf("top-level statement: got %+v", b)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/* ===================== 结构化审查结果 ===================== */
+
+// 严重程度，从高到低
+const (
+	SeverityCritical = "critical"
+	SeverityHigh     = "high"
+	SeverityMedium   = "medium"
+	SeverityLow      = "low"
+	SeverityInfo     = "info"
+)
+
+// 问题分类，对应系统提示词中的五个审查重点
+const (
+	CategoryQuality      = "quality"
+	CategoryBug          = "bug"
+	CategoryPerformance  = "performance"
+	CategorySecurity     = "security"
+	CategoryBestPractice = "best_practice"
+)
+
+var severityRank = map[string]int{
+	SeverityCritical: 4,
+	SeverityHigh:     3,
+	SeverityMedium:   2,
+	SeverityLow:      1,
+	SeverityInfo:     0,
+}
+
+var severityLabels = map[string]string{
+	SeverityCritical: "严重",
+	SeverityHigh:     "高",
+	SeverityMedium:   "中",
+	SeverityLow:      "低",
+	SeverityInfo:     "提示",
+}
+
+var categoryLabels = map[string]string{
+	CategoryQuality:      "代码质量",
+	CategoryBug:          "潜在 Bug",
+	CategoryPerformance:  "性能问题",
+	CategorySecurity:     "安全问题",
+	CategoryBestPractice: "最佳实践",
+}
+
+var (
+	severityOrder = []string{SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow, SeverityInfo}
+	categoryOrder = []string{CategoryQuality, CategoryBug, CategoryPerformance, CategorySecurity, CategoryBestPractice}
+)
+
+// Finding 是一条审查发现
+type Finding struct {
+	File       string `json:"file"`
+	StartLine  int    `json:"start_line,omitempty"`
+	EndLine    int    `json:"end_line,omitempty"`
+	Severity   string `json:"severity"`
+	Category   string `json:"category"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+	// Source 是发现的来源：ai 或 linter，由服务端填写
+	Source string `json:"source,omitempty"`
+}
+
+// 审查发现的来源
+const (
+	SourceAI     = "ai"
+	SourceLinter = "linter"
+)
+
+// ReviewReport 是模型通过 submit_review 提交的结果
+type ReviewReport struct {
+	Summary  string    `json:"summary"`
+	Findings []Finding `json:"findings"`
+}
+
+// ReviewResult 是一次审查的最终结果，API 和 CLI 共用
+type ReviewResult struct {
+	// Verdict 是 pass / warn / block，供 hook 和 CI 直接判断
+	Verdict  string         `json:"verdict"`
+	Counts   map[string]int `json:"counts"`
+	Summary  string         `json:"summary"`
+	Findings []Finding      `json:"findings"`
+	// Markdown 是渲染后的报告，字段名沿用原来的 review
+	Markdown string `json:"review"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Rounds   int    `json:"rounds"`
+	// Budget 是按字符估算的 token 用量
+	Budget *BudgetUsage `json:"budget,omitempty"`
+	// Usage 是接口返回的实际 token 用量和费用
+	Usage *ReviewUsage `json:"usage,omitempty"`
+}
+
+const submitReviewTool = "submit_review"
+
+// submitReviewReminder 在模型直接输出文本时提醒它提交结构化结果
+const submitReviewReminder = "请调用 submit_review 工具提交最终审查结果，不要直接输出文本。"
+
+// maxSubmitReminders 是模型不调用 submit_review 时最多提醒的次数
+const maxSubmitReminders = 2
+
+var submitReviewToolDef = Tool{
+	Type: "function",
+	Function: ToolFunction{
+		Name:        submitReviewTool,
+		Description: "提交最终的结构化审查结果。审查完成后必须调用此工具，调用后审查结束",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"summary": map[string]interface{}{
+					"type":        "string",
+					"description": "整体评价（Markdown），说明审查范围和总体结论",
+				},
+				"findings": map[string]interface{}{
+					"type":        "array",
+					"description": "发现的问题列表，没有问题时传空数组",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"file":       map[string]interface{}{"type": "string", "description": "文件路径"},
+							"start_line": map[string]interface{}{"type": "integer", "description": "起始行号（从 1 开始）"},
+							"end_line":   map[string]interface{}{"type": "integer", "description": "结束行号"},
+							"severity": map[string]interface{}{
+								"type": "string",
+								"enum": severityOrder,
+							},
+							"category": map[string]interface{}{
+								"type":        "string",
+								"enum":        categoryOrder,
+								"description": "quality=代码质量, bug=潜在 Bug, performance=性能问题, security=安全问题, best_practice=最佳实践",
+							},
+							"message":    map[string]interface{}{"type": "string", "description": "问题描述"},
+							"suggestion": map[string]interface{}{"type": "string", "description": "修复建议或示例代码"},
+						},
+						"required": []string{"file", "severity", "category", "message"},
+					},
+				},
+			},
+			"required": []string{"summary", "findings"},
+		},
+	},
+}
+
+// parseReviewReport 解析并校验 submit_review 的参数，错误信息会原样返回给模型重试
+func parseReviewReport(arguments string) (*ReviewReport, error) {
+	var report ReviewReport
+	if err := json.Unmarshal([]byte(arguments), &report); err != nil {
+		return nil, fmt.Errorf("参数不是合法的 JSON 或类型不匹配: %v", err)
+	}
+
+	var errs []string
+	if strings.TrimSpace(report.Summary) == "" {
+		errs = append(errs, "summary: 不能为空")
+	}
+	for i, f := range report.Findings {
+		prefix := fmt.Sprintf("findings[%d]", i)
+		if strings.TrimSpace(f.File) == "" {
+			errs = append(errs, prefix+".file: 不能为空")
+		}
+		if _, ok := severityRank[f.Severity]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.severity: 无效值 %q，可选: %s", prefix, f.Severity, strings.Join(severityOrder, ", ")))
+		}
+		if _, ok := categoryLabels[f.Category]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.category: 无效值 %q，可选: %s", prefix, f.Category, strings.Join(categoryOrder, ", ")))
+		}
+		if strings.TrimSpace(f.Message) == "" {
+			errs = append(errs, prefix+".message: 不能为空")
+		}
+		if f.StartLine < 0 || f.EndLine < 0 {
+			errs = append(errs, prefix+": 行号不能为负数")
+		}
+		if f.EndLine > 0 && f.EndLine < f.StartLine {
+			errs = append(errs, fmt.Sprintf("%s: end_line (%d) 小于 start_line (%d)", prefix, f.EndLine, f.StartLine))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return &report, nil
+}
+
+// newReviewResult 按严重程度排序问题并渲染 Markdown
+func newReviewResult(summary string, findings []Finding) *ReviewResult {
+	if findings == nil {
+		findings = []Finding{}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank[findings[i].Severity] > severityRank[findings[j].Severity]
+	})
+	return &ReviewResult{
+		Summary:  summary,
+		Findings: findings,
+		Markdown: renderMarkdown(summary, findings),
+	}
+}
+
+func renderMarkdown(summary string, findings []Finding) string {
+	var sb strings.Builder
+	sb.WriteString("## 代码审查报告\n\n")
+	sb.WriteString(strings.TrimSpace(summary))
+	sb.WriteString("\n\n")
+
+	if len(findings) == 0 {
+		sb.WriteString("✅ 未发现问题\n")
+		return sb.String()
+	}
+
+	sb.WriteString(fmt.Sprintf("### 发现的问题（%d）\n\n", len(findings)))
+	for i, f := range findings {
+		sb.WriteString(fmt.Sprintf("%d. **[%s] %s** `%s`", i+1,
+			severityLabels[f.Severity], categoryLabels[f.Category], f.location()))
+		if f.Source == SourceLinter {
+			sb.WriteString(" _(source: linter)_")
+		}
+		sb.WriteString("\n")
+		sb.WriteString(fmt.Sprintf("   - %s\n", f.Message))
+		if f.Suggestion != "" {
+			sb.WriteString(fmt.Sprintf("   - 建议：%s\n", strings.ReplaceAll(strings.TrimSpace(f.Suggestion), "\n", "\n     ")))
+		}
+	}
+	return sb.String()
+}
+
+// location 返回 file:start-end 形式的位置
+func (f Finding) location() string {
+	switch {
+	case f.StartLine == 0:
+		return f.File
+	case f.EndLine > f.StartLine:
+		return fmt.Sprintf("%s:%d-%d", f.File, f.StartLine, f.EndLine)
+	default:
+		return fmt.Sprintf("%s:%d", f.File, f.StartLine)
+	}
+}
+
+/* ===================== 审查结论 ===================== */
+
+const (
+	VerdictPass  = "pass"
+	VerdictWarn  = "warn"
+	VerdictBlock = "block"
+)
+
+// severityNone 表示阈值关闭，任何问题都不触发
+const severityNone = "none"
+
+// VerdictPolicy 决定达到哪个严重程度时给出 warn / block
+type VerdictPolicy struct {
+	BlockOn string `json:"block_on,omitempty" yaml:"block_on"`
+	WarnOn  string `json:"warn_on,omitempty" yaml:"warn_on"`
+}
+
+var defaultVerdictPolicy = VerdictPolicy{BlockOn: SeverityHigh, WarnOn: SeverityMedium}
+
+func (p VerdictPolicy) withDefaults() VerdictPolicy {
+	if p.BlockOn == "" {
+		p.BlockOn = defaultVerdictPolicy.BlockOn
+	}
+	if p.WarnOn == "" {
+		p.WarnOn = defaultVerdictPolicy.WarnOn
+	}
+	return p
+}
+
+// override 用非空字段覆盖当前策略
+func (p VerdictPolicy) override(o VerdictPolicy) VerdictPolicy {
+	if o.BlockOn != "" {
+		p.BlockOn = o.BlockOn
+	}
+	if o.WarnOn != "" {
+		p.WarnOn = o.WarnOn
+	}
+	return p
+}
+
+func (p VerdictPolicy) validate() error {
+	for name, v := range map[string]string{"block_on": p.BlockOn, "warn_on": p.WarnOn} {
+		if _, ok := severityRank[v]; !ok && v != "" && v != severityNone {
+			return fmt.Errorf("%s: 无效的严重程度 %q，可选: %s, %s", name, v, strings.Join(severityOrder, ", "), severityNone)
+		}
+	}
+	return nil
+}
+
+// verdict 根据最高严重程度给出结论
+func (p VerdictPolicy) verdict(findings []Finding) string {
+	p = p.withDefaults()
+	reaches := func(severity, threshold string) bool {
+		if threshold == severityNone {
+			return false
+		}
+		return severityRank[severity] >= severityRank[threshold]
+	}
+
+	result := VerdictPass
+	for _, f := range findings {
+		if reaches(f.Severity, p.BlockOn) {
+			return VerdictBlock
+		}
+		if reaches(f.Severity, p.WarnOn) {
+			result = VerdictWarn
+		}
+	}
+	return result
+}
+
+// countSeverities 统计各严重程度的问题数量
+func countSeverities(findings []Finding) map[string]int {
+	counts := make(map[string]int, len(severityOrder))
+	for _, s := range severityOrder {
+		counts[s] = 0
+	}
+	for _, f := range findings {
+		counts[f.Severity]++
+	}
+	return counts
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestVerdictPolicy(t *testing.T) {
+	f := func(severity string) Finding { return Finding{Severity: severity} }
+
+	tests := []struct {
+		name     string
+		policy   VerdictPolicy
+		findings []Finding
+		want     string
+	}{
+		{"no findings", VerdictPolicy{}, nil, VerdictPass},
+		{"below warn", VerdictPolicy{}, []Finding{f(SeverityLow), f(SeverityInfo)}, VerdictPass},
+		{"default warn", VerdictPolicy{}, []Finding{f(SeverityMedium)}, VerdictWarn},
+		{"default block", VerdictPolicy{}, []Finding{f(SeverityLow), f(SeverityHigh)}, VerdictBlock},
+		{"strict block", VerdictPolicy{BlockOn: SeverityLow}, []Finding{f(SeverityLow)}, VerdictBlock},
+		{"block disabled", VerdictPolicy{BlockOn: severityNone}, []Finding{f(SeverityCritical)}, VerdictWarn},
+		{"all disabled", VerdictPolicy{BlockOn: severityNone, WarnOn: severityNone}, []Finding{f(SeverityCritical)}, VerdictPass},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.verdict(tt.findings); got != tt.want {
+			t.Errorf("%s: verdict = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if err := (VerdictPolicy{BlockOn: "severe"}).validate(); err == nil {
+		t.Error("invalid threshold accepted")
+	}
+}
+
+func TestParseReviewReport(t *testing.T) {
+	valid := `{"summary": "s", "findings": [{"file": "a.go", "start_line": 3, "end_line": 5, "severity": "high", "category": "security", "message": "m"}]}`
+	if _, err := parseReviewReport(valid); err != nil {
+		t.Errorf("valid report rejected: %v", err)
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"summary": "", "findings": []}`,
+		`{"summary": "s", "findings": [{"file": "", "severity": "high", "category": "bug", "message": "m"}]}`,
+		`{"summary": "s", "findings": [{"file": "a.go", "severity": "high", "category": "style", "message": "m"}]}`,
+		`{"summary": "s", "findings": [{"file": "a.go", "start_line": 5, "end_line": 3, "severity": "high", "category": "bug", "message": "m"}]}`,
+		`{"summary": "s", "findings": [{"file": "a.go", "start_line": "3", "severity": "high", "category": "bug", "message": "m"}]}`,
+	} {
+		if _, err := parseReviewReport(bad); err == nil {
+			t.Errorf("invalid report accepted: %s", bad)
+		}
+	}
+}
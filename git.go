@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===================== git 操作 ===================== */
+
+// git diff 的取值范围
+const (
+	// diffWorking 对比 Target（默认 HEAD）与工作区
+	diffWorking = "working"
+	// diffStaged 对比 Target（默认 HEAD）与暂存区，即将提交的内容
+	diffStaged = "staged"
+	// diffRange 对比两个提交：A..B 或 A...B（从合并基点开始）
+	diffRange = "range"
+	// diffCommit 查看单个提交引入的变更
+	diffCommit = "commit"
+)
+
+// gitDiffSpec 描述 get_git_diff / get_diff_context 要获取的变更。
+// Target 和 Paths 来自模型，执行前必须经过 command 校验
+type gitDiffSpec struct {
+	// Mode 为空时按 Target 推断：含 .. 为 range，否则为 working
+	Mode   string
+	Target string
+	// Paths 非空时只对比这些路径（相对工作区）
+	Paths []string
+}
+
+func gitDiffSpecFromArgs(args map[string]interface{}) gitDiffSpec {
+	return gitDiffSpec{
+		Mode:   getStringArg(args, "mode", ""),
+		Target: getStringArg(args, "target", ""),
+		Paths:  getStringSliceArg(args, "paths"),
+	}
+}
+
+// String 用于输出标题，如 "HEAD 与工作区"
+func (s gitDiffSpec) String() string {
+	target := s.Target
+	if target == "" {
+		target = "HEAD"
+	}
+	switch s.mode() {
+	case diffStaged:
+		return target + " 与暂存区"
+	case diffRange:
+		return target
+	case diffCommit:
+		return "提交 " + target
+	default:
+		return target + " 与工作区"
+	}
+}
+
+func (s gitDiffSpec) mode() string {
+	if s.Mode != "" {
+		return s.Mode
+	}
+	if strings.Contains(s.Target, "..") {
+		return diffRange
+	}
+	return diffWorking
+}
+
+// diffOptions 是所有 diff 类命令共用的选项：关闭颜色、外部 diff 和 textconv，
+// --relative 使路径相对工作区并排除工作区外的改动
+var diffOptions = []string{"--no-color", "--no-ext-diff", "--no-textconv", "--relative"}
+
+// command 校验参数并生成 git 命令行。所有 ref 先经 rev-parse 解析为提交 hash，
+// 路径放在 -- 之后且必须位于工作区内，模型传入的字符串不会被 git 当作选项。
+// newRev 是新版本文件所在的 revision：空字符串表示工作区，":" 表示暂存区
+func (s gitDiffSpec) command(ctx context.Context, env *ToolEnv) (args []string, newRev string, err error) {
+	paths, err := s.pathspecs(env)
+	if err != nil {
+		return nil, "", err
+	}
+	target := s.Target
+	if target == "" {
+		target = "HEAD"
+	}
+
+	switch s.mode() {
+	case diffWorking, diffStaged:
+		base, err := resolveRev(ctx, env, target)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append([]string{"diff"}, diffOptions...)
+		if s.mode() == diffStaged {
+			args = append(args, "--cached")
+			newRev = ":"
+		}
+		args = append(args, base)
+
+	case diffRange:
+		sep := "..."
+		if !strings.Contains(target, sep) {
+			sep = ".."
+		}
+		from, to, ok := strings.Cut(target, sep)
+		if !ok {
+			return nil, "", fmt.Errorf("无效的范围 %q：应为 A..B 或 A...B", target)
+		}
+		// 和 git 一致，省略的一端为 HEAD
+		if from == "" {
+			from = "HEAD"
+		}
+		if to == "" {
+			to = "HEAD"
+		}
+		if from, err = resolveRev(ctx, env, from); err != nil {
+			return nil, "", err
+		}
+		if to, err = resolveRev(ctx, env, to); err != nil {
+			return nil, "", err
+		}
+		args = append(append([]string{"diff"}, diffOptions...), from+sep+to)
+		newRev = to
+
+	case diffCommit:
+		commit, err := resolveRev(ctx, env, target)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(append([]string{"show"}, diffOptions...), "--format=commit %H%nAuthor: %an <%ae>%nDate:   %ad%n%n%w(0,4,4)%B", commit)
+		newRev = commit
+
+	default:
+		return nil, "", fmt.Errorf("不支持的 mode %q（可选: %s, %s, %s, %s）", s.Mode, diffWorking, diffStaged, diffRange, diffCommit)
+	}
+
+	args = append(args, "--")
+	return append(args, paths...), newRev, nil
+}
+
+// pathspecs 把 Paths 转为相对工作区的路径，拒绝工作区外的路径
+func (s gitDiffSpec) pathspecs(env *ToolEnv) ([]string, error) {
+	var paths []string
+	for _, p := range s.Paths {
+		rel, err := env.gitPath(p)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, rel)
+	}
+	return paths, nil
+}
+
+// gitPath 把模型传入的路径转为相对工作区的 git 路径，拒绝工作区外的路径
+func (env *ToolEnv) gitPath(path string) (string, error) {
+	real, err := env.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(env.Root, real)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// resolveRev 校验 ref 并用 rev-parse 解析为提交 hash。
+// 以 - 开头的 ref 会被 git 当作选项（如 --output=...），直接拒绝
+func resolveRev(ctx context.Context, env *ToolEnv, ref string) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\r\n\x00") {
+		return "", fmt.Errorf("无效的 git 引用 %q", ref)
+	}
+	out, err := runGit(ctx, env, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("找不到提交 %q", ref)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// runGit 在工作区目录执行 git，失败时错误信息包含 stderr。
+// --literal-pathspecs 使路径中的 * 等字符按字面量处理
+func runGit(ctx context.Context, env *ToolEnv, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--literal-pathspecs"}, args...)...)
+	cmd.Dir = env.Root
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s 失败: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s 失败: %w", args[0], err)
+	}
+	return string(out), nil
+}
+
+// gitDiff 执行 spec 描述的 diff，返回原始输出和新版本所在的 revision
+func gitDiff(ctx context.Context, env *ToolEnv, spec gitDiffSpec) (string, string, error) {
+	args, newRev, err := spec.command(ctx, env)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := runGit(ctx, env, args...)
+	if err != nil {
+		return "", "", fmt.Errorf("获取 git diff 失败: %w", err)
+	}
+	return out, newRev, nil
+}
+
+// readRevision 读取文件 path（相对工作区）在 rev 中的内容，rev 为空时读取工作区文件
+func readRevision(ctx context.Context, env *ToolEnv, rev, path string) ([]byte, error) {
+	if rev == "" {
+		real, err := env.resolve(path)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(real)
+	}
+	// rev:./path 相对当前目录（工作区）解析；暂存区为 :./path
+	object := rev + ":./" + path
+	if rev == ":" {
+		object = ":./" + path
+	}
+	out, err := runGit(ctx, env, "show", object)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+func getGitDiff(ctx context.Context, env *ToolEnv, spec gitDiffSpec) (string, error) {
+	diff, _, err := gitDiff(ctx, env, spec)
+	if err != nil {
+		return "", err
+	}
+	if diff == "" {
+		return "没有代码变更", nil
+	}
+
+	// 限制输出长度
+	if max := env.Config.GitDiffMaxBytes; len(diff) > max {
+		diff = truncateUTF8(diff, max) + "\n... (diff 过长，已截断)"
+	}
+
+	return diff, nil
+}
+
+/* ===================== git 历史 ===================== */
+
+const (
+	// git_blame 单次最多输出的行数
+	maxBlameLines   = 200
+	defaultLogCount = 10
+	maxLogCount     = 50
+	// git_log 中每个提交说明最多显示的行数
+	maxLogBodyLines = 20
+)
+
+// blameHeaderRe 匹配 --line-porcelain 中每行的头部："<hash> <原行号> <当前行号> [<行数>]"
+var blameHeaderRe = regexp.MustCompile(`^([0-9a-f]{40,64}) \d+ (\d+)`)
+
+// gitBlame 输出 path 第 r.Start-r.End 行的最后修改提交、作者、日期和提交标题。
+// rev 为空时 blame 工作区文件（未提交的行标记为"未提交"）
+func gitBlame(ctx context.Context, env *ToolEnv, path, rev string, r lineRange) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("file_path is required")
+	}
+	rel, err := env.gitPath(path)
+	if err != nil {
+		return "", err
+	}
+	if rev != "" {
+		if rev, err = resolveRev(ctx, env, rev); err != nil {
+			return "", err
+		}
+	}
+	// git blame 的 -L 超出文件行数时报错，先取总行数
+	data, err := readRevision(ctx, env, rev, rel)
+	if err != nil {
+		return "", fmt.Errorf("读取 %s 失败: %w", path, err)
+	}
+	total := strings.Count(string(data), "\n")
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		total++
+	}
+	if total == 0 {
+		return fmt.Sprintf("=== %s (空文件) ===", path), nil
+	}
+
+	start, end := max(r.Start, 1), r.End
+	if start > total {
+		return "", fmt.Errorf("start_line %d 超出文件总行数 %d", start, total)
+	}
+	if end == 0 || end > total {
+		end = total
+	}
+	if end < start {
+		return "", fmt.Errorf("end_line (%d) 小于 start_line (%d)", end, start)
+	}
+	limited := false
+	if end-start+1 > maxBlameLines {
+		end = start + maxBlameLines - 1
+		limited = true
+	}
+
+	args := []string{"blame", "--line-porcelain", "-L", fmt.Sprintf("%d,%d", start, end)}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	out, err := runGit(ctx, env, append(args, "--", rel)...)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("=== git blame %s (第 %d-%d 行，共 %d 行) ===\n", path, start, end, total))
+	budget := env.Config.ReadFileMaxBytes
+	var commit, author, date, summary string
+	var n int
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			meta := fmt.Sprintf("%s %s %s「%s」", commit[:8], date, author, summary)
+			if strings.Trim(commit, "0") == "" {
+				meta = "-------- 未提交"
+			}
+			entry := fmt.Sprintf("%6d\t%s\t%s\n", n, meta, truncateLine(line[1:]))
+			if sb.Len()+len(entry) > budget {
+				sb.WriteString(fmt.Sprintf("... (输出已达 %d 字节上限，继续请使用 start_line=%d)\n", budget, n))
+				return sb.String(), nil
+			}
+			sb.WriteString(entry)
+		case strings.HasPrefix(line, "author "):
+			author = strings.TrimPrefix(line, "author ")
+		case strings.HasPrefix(line, "author-time "):
+			if sec, err := strconv.ParseInt(strings.TrimPrefix(line, "author-time "), 10, 64); err == nil {
+				date = time.Unix(sec, 0).UTC().Format("2006-01-02")
+			}
+		case strings.HasPrefix(line, "summary "):
+			summary = strings.TrimPrefix(line, "summary ")
+		default:
+			if m := blameHeaderRe.FindStringSubmatch(line); m != nil {
+				commit = m[1]
+				n, _ = strconv.Atoi(m[2])
+			}
+		}
+	}
+	if limited {
+		sb.WriteString(fmt.Sprintf("... (单次最多 %d 行，继续请使用 start_line=%d)\n", maxBlameLines, end+1))
+	}
+	return sb.String(), nil
+}
+
+// gitLog 输出修改过 path 的最近 count 个提交，包括作者、日期和完整提交说明。
+// path 为空时列出整个工作区的提交；path 是文件时跟踪重命名
+func gitLog(ctx context.Context, env *ToolEnv, path, rev string, count int) (string, error) {
+	if count <= 0 {
+		count = defaultLogCount
+	}
+	count = clamp(count, 1, maxLogCount)
+	if rev == "" {
+		rev = "HEAD"
+	}
+	rev, err := resolveRev(ctx, env, rev)
+	if err != nil {
+		return "", err
+	}
+	rel := "."
+	if path != "" {
+		if rel, err = env.gitPath(path); err != nil {
+			return "", err
+		}
+	}
+
+	// 字段用 \x1f 分隔，提交之间用 \x1e 分隔
+	args := []string{"log", "--no-color", "--date=short", "--format=%x1e%h%x1f%ad%x1f%an <%ae>%x1f%B", "-n", strconv.Itoa(count)}
+	if full := filepath.Join(env.Root, rel); rel != "." && !isDir(full) {
+		args = append(args, "--follow")
+	}
+	out, err := runGit(ctx, env, append(args, rev, "--", rel)...)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	commits := 0
+	for _, record := range strings.Split(out, "\x1e") {
+		fields := strings.SplitN(strings.TrimSpace(record), "\x1f", 4)
+		if len(fields) < 4 {
+			continue
+		}
+		commits++
+		sb.WriteString(fmt.Sprintf("%s %s %s\n", fields[0], fields[1], fields[2]))
+		body := strings.Split(strings.TrimSpace(fields[3]), "\n")
+		for i, line := range body {
+			if i == maxLogBodyLines {
+				sb.WriteString(fmt.Sprintf("    ... (还有 %d 行)\n", len(body)-i))
+				break
+			}
+			sb.WriteString("    " + strings.TrimRight(line, "\r") + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	if commits == 0 {
+		return fmt.Sprintf("%s 没有提交记录", rel), nil
+	}
+
+	result := fmt.Sprintf("=== git log %s（最近 %d 个提交）===\n", rel, commits) + sb.String()
+	if max := env.Config.GitDiffMaxBytes; len(result) > max {
+		result = truncateUTF8(result, max) + "\n... (输出过长，已截断；可减小 max_count)"
+	}
+	return result, nil
+}
+
+// gitShowFileAt 输出文件在 rev 中的内容，格式和分段方式同 read_file
+func gitShowFileAt(ctx context.Context, env *ToolEnv, path, rev string, r lineRange) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("file_path is required")
+	}
+	if rev == "" {
+		return "", fmt.Errorf("revision is required")
+	}
+	rel, err := env.gitPath(path)
+	if err != nil {
+		return "", err
+	}
+	hash, err := resolveRev(ctx, env, rev)
+	if err != nil {
+		return "", err
+	}
+	data, err := readRevision(ctx, env, hash, rel)
+	if err != nil {
+		return "", fmt.Errorf("%s 在 %s 中不存在: %w", path, rev, err)
+	}
+	return renderLines(env, path+"@"+rev, data, r)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newGitRepo 创建临时 git 仓库，返回根目录和在其中执行 git 的函数；没有 git 时跳过测试
+func newGitRepo(t *testing.T) (string, func(args ...string)) {
+	t.Helper()
+	root := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+		cmd.Dir = root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	return root, git
+}
+
+func TestGitDiffModes(t *testing.T) {
+	root, git := newGitRepo(t)
+	writeTestFile(t, root, "a.go", "package demo\n\nfunc A() int {\n\treturn 1\n}\n")
+	writeTestFile(t, root, "b.txt", "one\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+	writeTestFile(t, root, "a.go", "package demo\n\nfunc A() int {\n\treturn 2\n}\n")
+	git("commit", "-q", "-am", "second commit")
+
+	// 暂存区和工作区各有不同的改动
+	writeTestFile(t, root, "a.go", "package demo\n\nfunc A() int {\n\treturn 3\n}\n")
+	git("add", "a.go")
+	writeTestFile(t, root, "b.txt", "two\n")
+
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		spec    gitDiffSpec
+		want    []string
+		notWant []string
+	}{
+		{"working", gitDiffSpec{}, []string{"+\treturn 3", "+two"}, nil},
+		{"staged", gitDiffSpec{Mode: diffStaged}, []string{"+\treturn 3"}, []string{"b.txt"}},
+		{"range", gitDiffSpec{Target: "HEAD~1..HEAD"}, []string{"-\treturn 1", "+\treturn 2"}, []string{"b.txt"}},
+		{"symmetric range", gitDiffSpec{Target: "HEAD~1...HEAD"}, []string{"+\treturn 2"}, nil},
+		{"commit", gitDiffSpec{Mode: diffCommit, Target: "HEAD"}, []string{"second commit", "+\treturn 2"}, nil},
+		{"paths", gitDiffSpec{Paths: []string{"b.txt"}}, []string{"+two"}, []string{"a.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := getGitDiff(context.Background(), env, tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("missing %q in:\n%s", want, out)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(out, notWant) {
+					t.Errorf("unexpected %q in:\n%s", notWant, out)
+				}
+			}
+		})
+	}
+
+	// 暂存区模式的上下文来自暂存区而不是工作区
+	writeTestFile(t, root, "a.go", "package demo\n\nfunc A() int {\n\treturn 4\n}\n")
+	out, err := diffWithContext(context.Background(), env, gitDiffSpec{Mode: diffStaged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "     4\t\treturn 3") || strings.Contains(out, "return 4") {
+		t.Errorf("staged context:\n%s", out)
+	}
+
+	outside := filepath.Join(t.TempDir(), "pwned")
+	for _, spec := range []gitDiffSpec{
+		{Target: "--output=" + outside},
+		{Target: "HEAD..--output=" + outside},
+		{Mode: diffCommit, Target: "-p"},
+		{Target: "HEAD --cached"},
+		{Target: "no-such-branch"},
+		{Mode: "bogus"},
+	} {
+		if _, err := getGitDiff(context.Background(), env, spec); err == nil {
+			t.Errorf("%+v: expected error", spec)
+		}
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Fatal("git wrote --output file")
+	}
+	if _, err := getGitDiff(context.Background(), env, gitDiffSpec{Paths: []string{"../etc"}}); !errors.Is(err, errOutsideWorkspace) {
+		t.Errorf("path outside workspace: %v", err)
+	}
+}
+
+func TestGitHistoryTools(t *testing.T) {
+	root, git := newGitRepo(t)
+	writeTestFile(t, root, "a.go", "package demo\n\nfunc A() int {\n\treturn 1\n}\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+	writeTestFile(t, root, "a.go", "package demo\n\nfunc A() int {\n\treturn 2\n}\n")
+	git("commit", "-q", "-am", "fix: return 2 instead of 1\n\nThe caller expects 2, see #42.")
+	writeTestFile(t, root, "a.go", "package demo\n\nfunc A() int {\n\treturn 1\n}\n")
+
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blame, err := gitBlame(context.Background(), env, "a.go", "", lineRange{Start: 3, End: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(blame, "第 3-4 行，共 5 行") || !strings.Contains(blame, "「init」\tfunc A() int {") ||
+		!strings.Contains(blame, "     4\t-------- 未提交") {
+		t.Errorf("blame:\n%s", blame)
+	}
+	blame, err = gitBlame(context.Background(), env, "a.go", "HEAD", lineRange{Start: 4, End: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(blame, "「fix: return 2 instead of 1」\t\treturn 2") {
+		t.Errorf("blame at HEAD:\n%s", blame)
+	}
+
+	log, err := gitLog(context.Background(), env, "a.go", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log, "最近 2 个提交") || !strings.Contains(log, "    The caller expects 2, see #42.") ||
+		strings.Index(log, "fix: return 2") > strings.Index(log, "    init") {
+		t.Errorf("log:\n%s", log)
+	}
+	if log, err := gitLog(context.Background(), env, "", "", 1); err != nil || !strings.Contains(log, "最近 1 个提交") {
+		t.Errorf("log -n 1: %v\n%s", err, log)
+	}
+
+	old, err := gitShowFileAt(context.Background(), env, "a.go", "HEAD~1", lineRange{Start: 4, End: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(old, "=== a.go@HEAD~1 (第 4-4 行，共 5 行) ===") || !strings.Contains(old, "     4\t\treturn 1") {
+		t.Errorf("show file at:\n%s", old)
+	}
+
+	for name, call := range map[string]func() (string, error){
+		"option revision": func() (string, error) {
+			return gitShowFileAt(context.Background(), env, "a.go", "--output=/tmp/x", lineRange{})
+		},
+		"missing file":  func() (string, error) { return gitShowFileAt(context.Background(), env, "b.go", "HEAD", lineRange{}) },
+		"outside":       func() (string, error) { return gitLog(context.Background(), env, "../", "", 0) },
+		"blame outside": func() (string, error) { return gitBlame(context.Background(), env, "../x.go", "", lineRange{}) },
+		"log option":    func() (string, error) { return gitLog(context.Background(), env, "", "--all", 0) },
+	} {
+		if _, err := call(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -42,6 +42,6 @@ echo "  - commit-msg:  在提交信息中添加审查摘要"
 echo "  - pre-push:    推送前审查所有变更"
 echo ""
 echo "⚠️  使用前请确保 AI CR 服务已启动:"
-echo "  cd ai-cr && go run main.go server"
+echo "  cd ai-cr && go run . server"
 echo ""
 echo "如需卸载，运行: ./hooks/uninstall.sh"
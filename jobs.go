@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* ===================== 异步审查任务 ===================== */
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// 已结束的任务保留多久后清理
+const jobRetention = time.Hour
+
+// ReviewJob 是一次异步审查任务的状态快照
+type ReviewJob struct {
+	ID        string        `json:"id"`
+	Status    string        `json:"status"`
+	Request   string        `json:"request"`
+	Provider  string        `json:"provider"`
+	Model     string        `json:"model"`
+	Rounds    int           `json:"rounds"`
+	ToolCalls int           `json:"tool_calls"`
+	Result    *ReviewResult `json:"result,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	// ErrorType 是 LLM 接口错误的分类（如 rate_limit、context_length），其他错误为空
+	ErrorType  APIErrorKind `json:"error_type,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+}
+
+func (j *ReviewJob) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCanceled
+}
+
+type jobEntry struct {
+	job    ReviewJob
+	cancel context.CancelFunc
+	// canceled 表示已请求取消；状态在任务退出时与 FinishedAt 一起设为 canceled
+	canceled bool
+}
+
+// JobManager 管理异步任务，并限制同时运行的 codeReview 数量
+type JobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*jobEntry
+	// queued 是等待名额的审查数，包括异步任务和同步 / SSE 请求，不超过 maxQueue
+	queued   int
+	maxQueue int
+	// slots 是所有审查共用的并发名额，同步接口也从这里获取
+	slots chan struct{}
+}
+
+func newJobManager(workers, maxQueue int) *JobManager {
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobManager{
+		jobs:     make(map[string]*jobEntry),
+		maxQueue: maxQueue,
+		slots:    make(chan struct{}, workers),
+	}
+}
+
+// jobs 是服务端的任务管理器，server 启动时按参数重建
+var jobs = newJobManager(4, 100)
+
+// errQueueFull 表示排队等待的审查已达 maxQueue 上限
+var errQueueFull = errors.New("排队任务已达上限")
+
+// wait 为同步接口和 SSE 接口获取并发名额：有空闲名额时直接占用，
+// 否则与异步任务一起计入排队数，超过 maxQueue 时立即返回 errQueueFull
+func (m *JobManager) wait(ctx context.Context) error {
+	select {
+	case m.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	m.mu.Lock()
+	if m.queued >= m.maxQueue {
+		m.mu.Unlock()
+		return fmt.Errorf("%w (%d)，请稍后再试", errQueueFull, m.maxQueue)
+	}
+	m.queued++
+	m.mu.Unlock()
+
+	err := m.acquire(ctx)
+	m.mu.Lock()
+	m.queued--
+	m.mu.Unlock()
+	return err
+}
+
+// acquire 等待一个并发名额，ctx 取消时放弃
+func (m *JobManager) acquire(ctx context.Context) error {
+	select {
+	case m.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *JobManager) release() {
+	<-m.slots
+}
+
+// Submit 创建任务并排队执行
+func (m *JobManager) Submit(opts ReviewOptions, request string) (ReviewJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prune()
+	if m.queued >= m.maxQueue {
+		return ReviewJob{}, fmt.Errorf("%w (%d)，请稍后再试", errQueueFull, m.maxQueue)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &jobEntry{
+		job: ReviewJob{
+			ID:        newJobID(),
+			Status:    JobQueued,
+			Request:   request,
+			Provider:  opts.Provider.Name(),
+			Model:     opts.Provider.Model(),
+			CreatedAt: time.Now(),
+		},
+		cancel: cancel,
+	}
+	m.jobs[entry.job.ID] = entry
+	m.queued++
+
+	go m.run(ctx, entry, opts)
+	return entry.job, nil
+}
+
+func (m *JobManager) run(ctx context.Context, entry *jobEntry, opts ReviewOptions) {
+	defer entry.cancel()
+
+	err := m.acquire(ctx)
+
+	m.mu.Lock()
+	m.queued--
+	if err != nil || entry.canceled {
+		m.finish(entry, nil, err)
+		m.mu.Unlock()
+		if err == nil {
+			m.release()
+		}
+		return
+	}
+	now := time.Now()
+	entry.job.Status = JobRunning
+	entry.job.StartedAt = &now
+	request := entry.job.Request
+	m.mu.Unlock()
+	defer m.release()
+
+	log.Printf("[任务 %s] 开始审查", entry.job.ID)
+	opts.OnEvent = func(ev ReviewEvent) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		switch ev.Type {
+		case EventRoundStart:
+			entry.job.Rounds = ev.Round - 1
+		case EventToolEnd:
+			if ev.Tool != submitReviewTool {
+				entry.job.ToolCalls++
+			}
+		case EventFinal:
+			entry.job.Rounds = ev.Round
+		}
+	}
+	result, err := codeReview(ctx, opts, request)
+
+	m.mu.Lock()
+	m.finish(entry, result, err)
+	m.mu.Unlock()
+	log.Printf("[任务 %s] 结束: %s", entry.job.ID, entry.job.Status)
+}
+
+// finish 记录任务结果，调用方需持有锁
+func (m *JobManager) finish(entry *jobEntry, result *ReviewResult, err error) {
+	now := time.Now()
+	entry.job.FinishedAt = &now
+	switch {
+	case entry.canceled || errors.Is(err, context.Canceled):
+		entry.job.Status = JobCanceled
+	case err != nil:
+		entry.job.Status = JobFailed
+		entry.job.Error = err.Error()
+		entry.job.ErrorType = apiErrorKind(err)
+	default:
+		entry.job.Status = JobSucceeded
+		entry.job.Result = result
+	}
+}
+
+// Get 返回任务快照
+func (m *JobManager) Get(id string) (ReviewJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.jobs[id]
+	if !ok {
+		return ReviewJob{}, false
+	}
+	return entry.job, true
+}
+
+// Cancel 取消排队中或运行中的任务，任务退出后状态变为 canceled
+func (m *JobManager) Cancel(id string) (ReviewJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.jobs[id]
+	if !ok {
+		return ReviewJob{}, errJobNotFound
+	}
+	if entry.job.finished() {
+		return entry.job, errJobFinished
+	}
+	entry.canceled = true
+	entry.cancel()
+	return entry.job, nil
+}
+
+// prune 清理过期的已结束任务，调用方需持有锁
+func (m *JobManager) prune() {
+	for id, entry := range m.jobs {
+		if entry.job.finished() && time.Since(*entry.job.FinishedAt) > jobRetention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+var (
+	errJobNotFound = errors.New("任务不存在")
+	errJobFinished = errors.New("任务已结束")
+)
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/* ===================== 任务接口 ===================== */
+
+func createJobHandler(c *gin.Context) {
+	var payload reviewPayload
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	opts, err := payload.options()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	job, err := jobs.Submit(opts, payload.Request)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	log.Printf("创建审查任务 %s [%s/%s]: %s", job.ID, job.Provider, job.Model, job.Request)
+	c.JSON(http.StatusAccepted, job)
+}
+
+func getJobHandler(c *gin.Context) {
+	if !checkFormat(c) {
+		return
+	}
+
+	job, ok := jobs.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": errJobNotFound.Error(),
+		})
+		return
+	}
+
+	// ?format=sarif 时只返回已完成任务的 SARIF 报告
+	if c.Query("format") == "sarif" {
+		if job.Result == nil {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":  "任务尚未成功完成",
+				"status": job.Status,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, toSARIF(job.Result))
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func cancelJobHandler(c *gin.Context) {
+	job, err := jobs.Cancel(c.Param("id"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, job)
+	case errJobNotFound:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+			"job":   job,
+		})
+	}
+}
@@ -0,0 +1,849 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* ===================== run_linter ===================== */
+
+// Diagnostic 是 linter 报告的一条问题，路径相对工作区
+type Diagnostic struct {
+	File    string
+	Line    int
+	Column  int
+	EndLine int
+	// Severity / Category 已映射为审查结果的取值
+	Severity string
+	Category string
+	Linter   string
+	Rule     string
+	Message  string
+}
+
+func (d Diagnostic) location() string {
+	if d.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d", d.File, d.Line, d.Column)
+	}
+	return fmt.Sprintf("%s:%d", d.File, d.Line)
+}
+
+// finding 把诊断转为审查发现，标记来源为 linter
+func (d Diagnostic) finding() Finding {
+	f := Finding{
+		File:      d.File,
+		StartLine: d.Line,
+		Severity:  d.Severity,
+		Category:  d.Category,
+		Message:   fmt.Sprintf("[%s %s] %s", d.Linter, d.Rule, d.Message),
+		Source:    SourceLinter,
+	}
+	if d.Rule == "" {
+		f.Message = fmt.Sprintf("[%s] %s", d.Linter, d.Message)
+	}
+	if d.EndLine > d.Line {
+		f.EndLine = d.EndLine
+	}
+	return f
+}
+
+// diagnosticSet 收集一次审查中 run_linter 得到的诊断，审查结束时并入结果
+type diagnosticSet struct {
+	mu    sync.Mutex
+	items []Diagnostic
+	seen  map[string]bool
+}
+
+func (s *diagnosticSet) add(diags []Diagnostic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	for _, d := range diags {
+		// 同一文件多次检查时不重复记录
+		key := fmt.Sprintf("%s:%d:%d:%s:%s", d.File, d.Line, d.Column, d.Rule, d.Message)
+		if s.seen[key] {
+			continue
+		}
+		s.seen[key] = true
+		s.items = append(s.items, d)
+	}
+}
+
+func (s *diagnosticSet) list() []Diagnostic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Diagnostic(nil), s.items...)
+}
+
+// mergeDiagnostics 把本次审查的 linter 诊断并入模型提交的发现。
+// 模型已经报告过的位置（同一文件且行号落在发现的行范围内）不再重复
+func (env *ToolEnv) mergeDiagnostics(findings []Finding) []Finding {
+	merged := make([]Finding, 0, len(findings))
+	for _, f := range findings {
+		f.Source = SourceAI
+		merged = append(merged, f)
+	}
+	for _, d := range env.diagnostics.list() {
+		if !env.coveredBy(d, findings) {
+			merged = append(merged, d.finding())
+		}
+	}
+	return merged
+}
+
+func (env *ToolEnv) coveredBy(d Diagnostic, findings []Finding) bool {
+	for _, f := range findings {
+		if f.StartLine == 0 || env.normalizePath(f.File) != d.File {
+			continue
+		}
+		end := max(f.EndLine, f.StartLine)
+		if f.StartLine <= d.Line && d.Line <= end {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePath 把模型或 linter 给出的路径统一为相对工作区的 / 分隔路径，相对路径以工作区为基准
+func (env *ToolEnv) normalizePath(path string) string {
+	return env.normalizePathFrom(env.Root, path)
+}
+
+// normalizePathFrom 同 normalizePath，相对路径以 linter 的运行目录 dir 为基准
+func (env *ToolEnv) normalizePathFrom(dir, path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return filepath.ToSlash(env.display(filepath.Clean(path)))
+}
+
+// run_linter 的检查范围
+const (
+	// lintScopeFile 只保留指定文件中的问题（默认）
+	lintScopeFile = "file"
+	// lintScopePackage 保留指定文件所在包的全部问题
+	lintScopePackage = "package"
+)
+
+// lintRequest 是 run_linter 的参数
+type lintRequest struct {
+	Files     []string
+	Scope     string
+	BuildTags []string
+}
+
+func lintRequestFromArgs(args map[string]interface{}, cfg *Config) lintRequest {
+	req := lintRequest{
+		Files:     getStringSliceArg(args, "file_paths"),
+		Scope:     getStringArg(args, "scope", lintScopeFile),
+		BuildTags: buildTagsArg(args, cfg),
+	}
+	if file := getStringArg(args, "file_path", ""); file != "" {
+		req.Files = append([]string{file}, req.Files...)
+	}
+	return req
+}
+
+// buildTagsArg 解析逗号分隔的 build_tags 参数，未指定时使用配置中的 build_tags
+func buildTagsArg(args map[string]interface{}, cfg *Config) []string {
+	tags := getStringArg(args, "build_tags", "")
+	if tags == "" {
+		return cfg.BuildTags
+	}
+	var out []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// linter 描述一个单文件 linter 的调用方式和 JSON 输出的解析方式
+type linter struct {
+	name string
+	// hint 是所有候选都未安装时的安装提示
+	hint string
+	args func(path string) []string
+	// parse 解析输出，dir 是 linter 的运行目录，输出中的相对路径以它为基准
+	parse func(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error)
+}
+
+// lintersByExt 按扩展名列出候选 linter，使用第一个已安装的。
+// 位于 Go 模块内的 .go 文件按包检查，见 goLinters
+var lintersByExt = map[string][]linter{
+	".go": {
+		{name: "golangci-lint", args: func(p string) []string { return []string{"run", "--out-format", "json", p} }, parse: parseGolangciLint},
+		{name: "go", hint: "⚠️ 未安装 Go 相关的 linter 工具\n建议安装: brew install golangci-lint",
+			args: func(p string) []string { return []string{"vet", "-json", p} }, parse: parseGoVet},
+	},
+	".js":  eslintLinters,
+	".ts":  eslintLinters,
+	".jsx": eslintLinters,
+	".tsx": eslintLinters,
+	".py": {
+		{name: "pylint", args: func(p string) []string { return []string{"--output-format=json", p} }, parse: parsePylint},
+		{name: "flake8", hint: "⚠️ 未安装 Python linter\n建议安装: pip install pylint",
+			args: func(p string) []string { return []string{"--format=" + flake8Format, p} }, parse: parseFlake8},
+	},
+}
+
+var eslintLinters = []linter{
+	{name: "eslint", hint: "⚠️ 未安装 eslint\n建议安装: npm install -g eslint",
+		args: func(p string) []string { return []string{"-f", "json", p} }, parse: parseESLint},
+}
+
+// displayName 是输出中的名字，go 命令显示为 go vet
+func (l linter) displayName() string {
+	if l.name == "go" {
+		return "go vet"
+	}
+	return l.name
+}
+
+// goLinter 是按包运行的 Go linter，args 接收包路径（如 ./internal/db）和构建标签
+type goLinter struct {
+	linter
+	pkgArgs func(pkgs, tags []string) []string
+}
+
+// goLinters 返回已安装的 Go linter：golangci-lint（已包含 staticcheck）或 go vet + staticcheck，
+// 以及 govulncheck
+func goLinters() []goLinter {
+	withTags := func(flag string, tags []string, args []string) []string {
+		if len(tags) > 0 {
+			args = append(args, flag, strings.Join(tags, ","))
+		}
+		return args
+	}
+	var linters []goLinter
+	if _, err := exec.LookPath("golangci-lint"); err == nil {
+		linters = append(linters, goLinter{
+			linter: linter{name: "golangci-lint", parse: parseGolangciLint},
+			pkgArgs: func(pkgs, tags []string) []string {
+				return append(withTags("--build-tags", tags, []string{"run", "--out-format", "json"}), pkgs...)
+			},
+		})
+	} else {
+		if _, err := exec.LookPath("go"); err == nil {
+			linters = append(linters, goLinter{
+				linter: linter{name: "go", parse: parseGoVet},
+				pkgArgs: func(pkgs, tags []string) []string {
+					return append(withTags("-tags", tags, []string{"vet", "-json"}), pkgs...)
+				},
+			})
+		}
+		if _, err := exec.LookPath("staticcheck"); err == nil {
+			linters = append(linters, goLinter{
+				linter: linter{name: "staticcheck", parse: parseStaticcheck},
+				pkgArgs: func(pkgs, tags []string) []string {
+					return append(withTags("-tags", tags, []string{"-f", "json"}), pkgs...)
+				},
+			})
+		}
+	}
+	if _, err := exec.LookPath("govulncheck"); err == nil {
+		linters = append(linters, goLinter{
+			linter: linter{name: "govulncheck", parse: parseGovulncheck},
+			pkgArgs: func(pkgs, tags []string) []string {
+				return append(withTags("-tags", tags, []string{"-json"}), pkgs...)
+			},
+		})
+	}
+	return linters
+}
+
+// goModuleTarget 是同一 Go 模块内要检查的包和文件
+type goModuleTarget struct {
+	root string
+	// pkgs 是相对模块根目录的包路径，如 . 或 ./internal/db
+	pkgs []string
+	// files 是要保留问题的文件（相对工作区）
+	files map[string]bool
+}
+
+// goPackageOf 返回文件或目录 path 所在 Go 模块的根目录，以及相对模块根目录的包路径（如 . 或 ./internal/db）。
+// go.mod 只在工作区内查找，工作区外的模块不算
+func (env *ToolEnv) goPackageOf(path string) (root, pkg string, ok bool) {
+	dir := path
+	if !isDir(path) {
+		dir = filepath.Dir(path)
+	}
+	gomod := env.findUp(dir, "go.mod")
+	if gomod == "" {
+		return "", "", false
+	}
+	root = filepath.Dir(gomod)
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", "", false
+	}
+	if rel == "." {
+		return root, ".", true
+	}
+	return root, "./" + filepath.ToSlash(rel), true
+}
+
+// moduleTarget 返回 modules 中根目录为 root 的模块，不存在时追加
+func moduleTarget(modules *[]*goModuleTarget, root string) *goModuleTarget {
+	for _, m := range *modules {
+		if m.root == root {
+			return m
+		}
+	}
+	m := &goModuleTarget{root: root, files: make(map[string]bool)}
+	*modules = append(*modules, m)
+	return m
+}
+
+func (m *goModuleTarget) addPackage(pkg string) {
+	if !containsString(m.pkgs, pkg) {
+		m.pkgs = append(m.pkgs, pkg)
+	}
+}
+
+// runLinter 检查 req.Files。Go 模块内的文件按包运行 linter（同包的其他文件参与类型检查），
+// 再把问题过滤回指定文件；其余文件逐个运行
+func runLinter(ctx context.Context, env *ToolEnv, req lintRequest) (string, error) {
+	if len(req.Files) == 0 {
+		return "", fmt.Errorf("file_path is required")
+	}
+	if req.Scope != lintScopeFile && req.Scope != lintScopePackage {
+		return "", fmt.Errorf("不支持的 scope %q（可选: %s, %s）", req.Scope, lintScopeFile, lintScopePackage)
+	}
+
+	var modules []*goModuleTarget
+	var sections []string
+	for _, filePath := range req.Files {
+		path, err := env.resolve(filePath)
+		if err != nil {
+			return "", err
+		}
+		root, pkg, ok := "", "", false
+		if filepath.Ext(path) == ".go" {
+			root, pkg, ok = env.goPackageOf(path)
+		}
+		if !ok {
+			section, err := lintFile(ctx, env, path, filePath)
+			if err != nil {
+				return "", err
+			}
+			sections = append(sections, section)
+			continue
+		}
+		target := moduleTarget(&modules, root)
+		target.addPackage(pkg)
+		target.files[env.normalizePath(path)] = true
+	}
+
+	for _, m := range modules {
+		section, err := lintGoModule(ctx, env, m, req)
+		if err != nil {
+			return "", err
+		}
+		sections = append(sections, section)
+	}
+	return strings.Join(sections, "\n"), nil
+}
+
+// lintGoModule 在模块根目录对 m.pkgs 运行所有已安装的 Go linter，单个 linter 失败时记录说明并继续
+func lintGoModule(ctx context.Context, env *ToolEnv, m *goModuleTarget, req lintRequest) (string, error) {
+	linters := goLinters()
+	if len(linters) == 0 {
+		return lintersByExt[".go"][1].hint, nil
+	}
+
+	var sb strings.Builder
+	for _, l := range linters {
+		diags, raw, err := runLintCommand(ctx, env, m.root, l.linter, l.pkgArgs(m.pkgs, req.BuildTags))
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil {
+			// 可选的 linter 失败（如 govulncheck 无法联网）不影响其他 linter 的结果
+			sb.WriteString(fmt.Sprintf("⚠️ %s 运行失败，已跳过: %v\n", l.displayName(), err))
+			continue
+		}
+		if raw != "" {
+			sb.WriteString(raw + "\n")
+			continue
+		}
+		// 只保留工作区内的问题；file 范围再过滤到指定文件
+		var kept []Diagnostic
+		for _, d := range diags {
+			if filepath.IsAbs(filepath.FromSlash(d.File)) {
+				continue
+			}
+			if req.Scope == lintScopeFile && !m.files[d.File] {
+				continue
+			}
+			kept = append(kept, d)
+		}
+		env.diagnostics.add(kept)
+		sb.WriteString(renderDiagnostics(fmt.Sprintf("%s（%s）", l.displayName(), strings.Join(m.pkgs, " ")), kept))
+	}
+	return strings.TrimSuffix(sb.String(), "\n"), nil
+}
+
+// lintFile 用第一个已安装的候选 linter 检查单个文件
+func lintFile(ctx context.Context, env *ToolEnv, path, filePath string) (string, error) {
+	ext := filepath.Ext(filePath)
+	candidates, ok := lintersByExt[ext]
+	if !ok {
+		return fmt.Sprintf("⚠️ 不支持的文件类型: %s\n支持的类型: .go, .js, .ts, .py", ext), nil
+	}
+	var l linter
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c.name); err == nil {
+			l = c
+			break
+		}
+	}
+	if l.name == "" {
+		return candidates[len(candidates)-1].hint, nil
+	}
+
+	diags, raw, err := runLintCommand(ctx, env, env.Root, l, l.args(path))
+	if err != nil || raw != "" {
+		return raw, err
+	}
+	env.diagnostics.add(diags)
+	return renderDiagnostics(l.displayName(), diags), nil
+}
+
+// runLintCommand 在 dir 中运行 linter 并解析输出。无法解析时返回原始输出 raw
+func runLintCommand(ctx context.Context, env *ToolEnv, dir string, l linter, args []string) (diags []Diagnostic, raw string, err error) {
+	cmd := exec.CommandContext(ctx, l.name, args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, runErr := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, "", ctx.Err()
+	}
+	// go vet 把类型检查错误写到 stderr，一并解析
+	if l.name == "go" {
+		output = append(output, stderr.Bytes()...)
+		stderr.Reset()
+	}
+
+	diags, err = l.parse(env, dir, output)
+	if err != nil {
+		// 无法解析时退回原始输出，linter 发现问题时会返回非 0 退出码
+		if text := strings.TrimSpace(string(output) + stderr.String()); text != "" {
+			return nil, fmt.Sprintf("🔍 使用 %s 检查结果:\n%s", l.displayName(), text), nil
+		}
+		if runErr != nil {
+			return nil, "", fmt.Errorf("运行 %s 失败: %w", l.displayName(), runErr)
+		}
+	}
+	if len(diags) == 0 && runErr != nil && len(output) == 0 {
+		return nil, "", fmt.Errorf("运行 %s 失败: %w\n%s", l.displayName(), runErr, strings.TrimSpace(stderr.String()))
+	}
+	return diags, "", nil
+}
+
+func renderDiagnostics(name string, diags []Diagnostic) string {
+	if len(diags) == 0 {
+		return fmt.Sprintf("✅ %s 检查通过，未发现代码问题", name)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🔍 使用 %s 检查结果（共 %d 条，审查结束时会自动并入报告，无需在 submit_review 中重复）:\n", name, len(diags)))
+	for _, d := range diags {
+		rule := d.Rule
+		if rule != "" {
+			rule += ": "
+		}
+		sb.WriteString(fmt.Sprintf("  %s [%s] %s%s\n", d.location(), severityLabels[d.Severity], rule, d.Message))
+	}
+	return sb.String()
+}
+
+/* ===================== linter 输出解析 ===================== */
+
+// parseGolangciLint 解析 golangci-lint run --out-format json
+func parseGolangciLint(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error) {
+	var report struct {
+		Issues []struct {
+			FromLinter string
+			Text       string
+			Severity   string
+			Pos        struct {
+				Filename string
+				Line     int
+				Column   int
+			}
+			LineRange *struct{ From, To int }
+		}
+	}
+	if err := json.Unmarshal(firstJSON(out), &report); err != nil {
+		return nil, err
+	}
+	var diags []Diagnostic
+	for _, issue := range report.Issues {
+		d := Diagnostic{
+			File:     env.normalizePathFrom(dir, issue.Pos.Filename),
+			Line:     issue.Pos.Line,
+			Column:   issue.Pos.Column,
+			Severity: SeverityLow,
+			Category: CategoryQuality,
+			Linter:   "golangci-lint",
+			Rule:     issue.FromLinter,
+			Message:  issue.Text,
+		}
+		if issue.LineRange != nil {
+			d.EndLine = issue.LineRange.To
+		}
+		switch issue.FromLinter {
+		case "gosec":
+			d.Severity, d.Category = SeverityMedium, CategorySecurity
+		case "govet", "staticcheck", "errcheck", "typecheck", "ineffassign":
+			d.Severity, d.Category = SeverityMedium, CategoryBug
+		}
+		if issue.Severity == "error" {
+			d.Severity = SeverityHigh
+		}
+		diags = append(diags, d)
+	}
+	return diags, nil
+}
+
+// goVetErrorRe 匹配 go vet 在 stderr 输出的类型检查错误，如 vet: ./a.go:2:15: declared and not used: x
+var goVetErrorRe = regexp.MustCompile(`^(?:vet: )?([^\s"{}][^"]*?\.go):(\d+):(\d+): (.+)$`)
+
+// parseGoVet 解析 go vet -json。输出由多个 JSON 对象和 # 包名注释行组成：
+// {"包路径": {"analyzer": [{"posn": "file:line:col", "message": "..."}]}}
+func parseGoVet(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error) {
+	var diags []Diagnostic
+	var jsonText bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := goVetErrorRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			col, _ := strconv.Atoi(m[3])
+			diags = append(diags, Diagnostic{
+				File: env.normalizePathFrom(dir, m[1]), Line: n, Column: col,
+				Severity: SeverityHigh, Category: CategoryBug,
+				Linter: "go vet", Rule: "typecheck", Message: m[4],
+			})
+			continue
+		}
+		jsonText.WriteString(line + "\n")
+	}
+
+	dec := json.NewDecoder(&jsonText)
+	for dec.More() {
+		var pkgs map[string]map[string]json.RawMessage
+		if err := dec.Decode(&pkgs); err != nil {
+			return nil, err
+		}
+		for _, analyzers := range pkgs {
+			for analyzer, raw := range analyzers {
+				// 分析失败时值是 {"error": "..."}，不是问题列表
+				var issues []struct {
+					Posn    string `json:"posn"`
+					End     string `json:"end"`
+					Message string `json:"message"`
+				}
+				if json.Unmarshal(raw, &issues) != nil {
+					continue
+				}
+				for _, issue := range issues {
+					d := Diagnostic{
+						Severity: SeverityMedium, Category: CategoryBug,
+						Linter: "go vet", Rule: analyzer, Message: issue.Message,
+					}
+					d.File, d.Line, d.Column = splitPosition(issue.Posn)
+					d.File = env.normalizePathFrom(dir, d.File)
+					if _, end, _ := splitPosition(issue.End); end > d.Line {
+						d.EndLine = end
+					}
+					diags = append(diags, d)
+				}
+			}
+		}
+	}
+	return diags, nil
+}
+
+// splitPosition 解析 file:line:col 形式的位置
+func splitPosition(posn string) (string, int, int) {
+	parts := strings.Split(posn, ":")
+	if len(parts) < 3 {
+		return posn, 0, 0
+	}
+	line, _ := strconv.Atoi(parts[len(parts)-2])
+	col, _ := strconv.Atoi(parts[len(parts)-1])
+	return strings.Join(parts[:len(parts)-2], ":"), line, col
+}
+
+// parseStaticcheck 解析 staticcheck -f json，每行一个 JSON 对象。
+// SA 开头的检查是潜在 Bug，compile 是编译错误，其余（S、ST、QF）是代码风格
+func parseStaticcheck(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error) {
+	type position struct {
+		File   string `json:"file"`
+		Line   int    `json:"line"`
+		Column int    `json:"column"`
+	}
+	var diags []Diagnostic
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var issue struct {
+			Code     string   `json:"code"`
+			Severity string   `json:"severity"`
+			Location position `json:"location"`
+			End      position `json:"end"`
+			Message  string   `json:"message"`
+		}
+		if err := dec.Decode(&issue); err != nil {
+			return nil, err
+		}
+		if issue.Severity == "ignored" {
+			continue
+		}
+		d := Diagnostic{
+			File: env.normalizePathFrom(dir, issue.Location.File), Line: issue.Location.Line, Column: issue.Location.Column,
+			Severity: SeverityLow, Category: CategoryQuality,
+			Linter: "staticcheck", Rule: issue.Code, Message: issue.Message,
+		}
+		if issue.End.Line > d.Line {
+			d.EndLine = issue.End.Line
+		}
+		switch {
+		case issue.Code == "compile":
+			d.Severity, d.Category = SeverityHigh, CategoryBug
+		case strings.HasPrefix(issue.Code, "SA"):
+			d.Severity, d.Category = SeverityMedium, CategoryBug
+		}
+		diags = append(diags, d)
+	}
+	return diags, nil
+}
+
+// parseGovulncheck 解析 govulncheck -json 的消息流。只报告代码中实际调用到的漏洞：
+// finding 的 trace 从漏洞函数开始，最后一个带位置的帧是本项目中的调用点
+func parseGovulncheck(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error) {
+	type frame struct {
+		Module   string `json:"module"`
+		Version  string `json:"version"`
+		Package  string `json:"package"`
+		Function string `json:"function"`
+		Receiver string `json:"receiver"`
+		Position *struct {
+			Filename string `json:"filename"`
+			Line     int    `json:"line"`
+			Column   int    `json:"column"`
+		} `json:"position"`
+	}
+	summaries := make(map[string]string)
+	var diags []Diagnostic
+	seen := make(map[string]bool)
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var msg struct {
+			OSV *struct {
+				ID      string `json:"id"`
+				Summary string `json:"summary"`
+			} `json:"osv"`
+			Finding *struct {
+				OSV          string  `json:"osv"`
+				FixedVersion string  `json:"fixed_version"`
+				Trace        []frame `json:"trace"`
+			} `json:"finding"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+		if msg.OSV != nil {
+			summaries[msg.OSV.ID] = msg.OSV.Summary
+		}
+		if msg.Finding == nil || len(msg.Finding.Trace) == 0 {
+			continue
+		}
+		trace := msg.Finding.Trace
+		var site *frame
+		for i := len(trace) - 1; i >= 0; i-- {
+			if trace[i].Position != nil && trace[i].Position.Filename != "" {
+				site = &trace[i]
+				break
+			}
+		}
+		if site == nil || trace[0].Function == "" {
+			// 只导入了有漏洞的模块或包，没有调用到漏洞函数
+			continue
+		}
+		d := Diagnostic{
+			File: env.normalizePathFrom(dir, site.Position.Filename), Line: site.Position.Line, Column: site.Position.Column,
+			Severity: SeverityHigh, Category: CategorySecurity,
+			Linter: "govulncheck", Rule: msg.Finding.OSV,
+		}
+		key := fmt.Sprintf("%s:%s:%d", d.Rule, d.File, d.Line)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		vulnerable := trace[0]
+		symbol := vulnerable.Package + "." + vulnerable.Function
+		if vulnerable.Receiver != "" {
+			symbol = vulnerable.Package + "." + strings.TrimPrefix(vulnerable.Receiver, "*") + "." + vulnerable.Function
+		}
+		d.Message = fmt.Sprintf("调用了存在已知漏洞的 %s（%s@%s）", symbol, vulnerable.Module, vulnerable.Version)
+		if fixed := msg.Finding.FixedVersion; fixed != "" {
+			d.Message += "，修复版本 " + fixed
+		}
+		diags = append(diags, d)
+	}
+	// osv 消息可能出现在 finding 之后，最后补上漏洞摘要
+	for i := range diags {
+		if summary := summaries[diags[i].Rule]; summary != "" {
+			diags[i].Message = summary + "：" + diags[i].Message
+		}
+	}
+	return diags, nil
+}
+
+// parseESLint 解析 eslint -f json，severity 2 为 error，1 为 warning
+func parseESLint(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error) {
+	var files []struct {
+		FilePath string `json:"filePath"`
+		Messages []struct {
+			RuleID   string `json:"ruleId"`
+			Severity int    `json:"severity"`
+			Message  string `json:"message"`
+			Line     int    `json:"line"`
+			Column   int    `json:"column"`
+			EndLine  int    `json:"endLine"`
+			Fatal    bool   `json:"fatal"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(firstJSON(out), &files); err != nil {
+		return nil, err
+	}
+	var diags []Diagnostic
+	for _, f := range files {
+		for _, m := range f.Messages {
+			d := Diagnostic{
+				File: env.normalizePathFrom(dir, f.FilePath), Line: m.Line, Column: m.Column, EndLine: m.EndLine,
+				Severity: SeverityLow, Category: CategoryQuality,
+				Linter: "eslint", Rule: m.RuleID, Message: m.Message,
+			}
+			switch {
+			case m.Fatal:
+				d.Severity, d.Category = SeverityHigh, CategoryBug
+			case m.Severity == 2:
+				d.Severity = SeverityMedium
+			}
+			diags = append(diags, d)
+		}
+	}
+	return diags, nil
+}
+
+// pylintSeverities 把 pylint 的消息类型映射为严重程度
+var pylintSeverities = map[string]string{
+	"fatal":      SeverityHigh,
+	"error":      SeverityHigh,
+	"warning":    SeverityMedium,
+	"refactor":   SeverityLow,
+	"convention": SeverityLow,
+	"info":       SeverityInfo,
+}
+
+// parsePylint 解析 pylint --output-format=json
+func parsePylint(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error) {
+	var messages []struct {
+		Type    string `json:"type"`
+		Path    string `json:"path"`
+		Line    int    `json:"line"`
+		Column  int    `json:"column"`
+		EndLine *int   `json:"endLine"`
+		Symbol  string `json:"symbol"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(firstJSON(out), &messages); err != nil {
+		return nil, err
+	}
+	var diags []Diagnostic
+	for _, m := range messages {
+		d := Diagnostic{
+			File: env.normalizePathFrom(dir, m.Path), Line: m.Line, Column: m.Column + 1,
+			Severity: pylintSeverities[m.Type], Category: CategoryQuality,
+			Linter: "pylint", Rule: m.Symbol, Message: m.Message,
+		}
+		if d.Severity == "" {
+			d.Severity = SeverityLow
+		}
+		if m.Type == "error" || m.Type == "fatal" {
+			d.Category = CategoryBug
+		}
+		if m.EndLine != nil {
+			d.EndLine = *m.EndLine
+		}
+		diags = append(diags, d)
+	}
+	return diags, nil
+}
+
+// flake8 没有内置 JSON 输出，用 \x1f 分隔字段的自定义格式代替
+const flake8Format = "%(path)s\x1f%(row)d\x1f%(col)d\x1f%(code)s\x1f%(text)s"
+
+// parseFlake8 解析 flake8 --format=flake8Format。E9 为语法错误，F 为 pyflakes 检测到的错误
+func parseFlake8(env *ToolEnv, dir string, out []byte) ([]Diagnostic, error) {
+	var diags []Diagnostic
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("无法解析 flake8 输出: %s", line)
+		}
+		row, _ := strconv.Atoi(fields[1])
+		col, _ := strconv.Atoi(fields[2])
+		d := Diagnostic{
+			File: env.normalizePathFrom(dir, fields[0]), Line: row, Column: col,
+			Severity: SeverityLow, Category: CategoryQuality,
+			Linter: "flake8", Rule: fields[3], Message: fields[4],
+		}
+		switch {
+		case strings.HasPrefix(d.Rule, "E9"):
+			d.Severity, d.Category = SeverityHigh, CategoryBug
+		case strings.HasPrefix(d.Rule, "F"):
+			d.Severity, d.Category = SeverityMedium, CategoryBug
+		}
+		diags = append(diags, d)
+	}
+	return diags, nil
+}
+
+// firstJSON 跳过 JSON 之前的日志行（如 golangci-lint 的 level=warning msg="[runner] ..."）
+func firstJSON(out []byte) []byte {
+	for rest := out; len(rest) > 0; {
+		trimmed := bytes.TrimLeft(rest, " \t\r\n")
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return trimmed
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		rest = rest[i+1:]
+	}
+	return out
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLinterOutput(t *testing.T) {
+	env, err := newToolEnv(defaultConfig(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(env.Root, "app.js")
+
+	tests := []struct {
+		name  string
+		parse func(*ToolEnv, string, []byte) ([]Diagnostic, error)
+		out   string
+		want  []Diagnostic
+	}{
+		{"golangci-lint", parseGolangciLint,
+			`level=warning msg="[runner] deprecated"
+{"Issues":[{"FromLinter":"errcheck","Text":"Error return value is not checked","Severity":"","Pos":{"Filename":"main.go","Line":12,"Column":5}},
+{"FromLinter":"gosec","Text":"G101: hardcoded credentials","Pos":{"Filename":"pkg/db.go","Line":3,"Column":1},"LineRange":{"From":3,"To":4}}]}`,
+			[]Diagnostic{
+				{File: "main.go", Line: 12, Column: 5, Severity: SeverityMedium, Category: CategoryBug, Linter: "golangci-lint", Rule: "errcheck", Message: "Error return value is not checked"},
+				{File: "pkg/db.go", Line: 3, Column: 1, EndLine: 4, Severity: SeverityMedium, Category: CategorySecurity, Linter: "golangci-lint", Rule: "gosec", Message: "G101: hardcoded credentials"},
+			}},
+		{"go vet", parseGoVet,
+			"# example.com/demo\n{\n\t\"example.com/demo\": {\n\t\t\"printf\": [\n\t\t\t{\"posn\": \"" + filepath.Join(env.Root, "a.go") + ":6:14\", \"end\": \"" + filepath.Join(env.Root, "a.go") + ":6:16\", \"message\": \"wrong type\"}\n\t\t]\n\t}\n}\nvet: ./b.go:2:15: declared and not used: x\n",
+			[]Diagnostic{
+				{File: "b.go", Line: 2, Column: 15, Severity: SeverityHigh, Category: CategoryBug, Linter: "go vet", Rule: "typecheck", Message: "declared and not used: x"},
+				{File: "a.go", Line: 6, Column: 14, Severity: SeverityMedium, Category: CategoryBug, Linter: "go vet", Rule: "printf", Message: "wrong type"},
+			}},
+		{"staticcheck", parseStaticcheck,
+			`{"code":"SA4006","severity":"error","location":{"file":"` + filepath.Join(env.Root, "a.go") + `","line":5,"column":2},"end":{"file":"","line":5,"column":9},"message":"this value of err is never used"}
+{"code":"ST1003","severity":"warning","location":{"file":"` + filepath.Join(env.Root, "a.go") + `","line":9,"column":6},"end":{"line":9},"message":"should not use underscores"}
+{"code":"U1000","severity":"ignored","location":{"file":"a.go","line":1,"column":1},"message":"ignored"}`,
+			[]Diagnostic{
+				{File: "a.go", Line: 5, Column: 2, Severity: SeverityMedium, Category: CategoryBug, Linter: "staticcheck", Rule: "SA4006", Message: "this value of err is never used"},
+				{File: "a.go", Line: 9, Column: 6, Severity: SeverityLow, Category: CategoryQuality, Linter: "staticcheck", Rule: "ST1003", Message: "should not use underscores"},
+			}},
+		{"govulncheck", parseGovulncheck,
+			`{"config":{"protocol_version":"v1.0.0"}}
+{"finding":{"osv":"GO-2023-0001","fixed_version":"v1.2.0","trace":[{"module":"example.com/lib","version":"v1.1.0","package":"example.com/lib/yaml","function":"Unmarshal","position":{"filename":"/mod/cache/yaml.go","line":10}},{"module":"example.com/demo","package":"example.com/demo","function":"load","position":{"filename":"a.go","line":7,"column":3}}]}}
+{"finding":{"osv":"GO-2023-0002","trace":[{"module":"example.com/other","version":"v0.1.0"}]}}
+{"osv":{"id":"GO-2023-0001","summary":"Denial of service in yaml parsing"}}`,
+			[]Diagnostic{
+				{File: "a.go", Line: 7, Column: 3, Severity: SeverityHigh, Category: CategorySecurity, Linter: "govulncheck", Rule: "GO-2023-0001",
+					Message: "Denial of service in yaml parsing：调用了存在已知漏洞的 example.com/lib/yaml.Unmarshal（example.com/lib@v1.1.0），修复版本 v1.2.0"},
+			}},
+		{"eslint", parseESLint,
+			`[{"filePath":"` + abs + `","messages":[{"ruleId":"no-unused-vars","severity":2,"message":"'x' is unused","line":1,"column":7,"endLine":1},{"ruleId":"semi","severity":1,"message":"Missing semicolon","line":2,"column":3}]}]`,
+			[]Diagnostic{
+				{File: "app.js", Line: 1, Column: 7, EndLine: 1, Severity: SeverityMedium, Category: CategoryQuality, Linter: "eslint", Rule: "no-unused-vars", Message: "'x' is unused"},
+				{File: "app.js", Line: 2, Column: 3, Severity: SeverityLow, Category: CategoryQuality, Linter: "eslint", Rule: "semi", Message: "Missing semicolon"},
+			}},
+		{"pylint", parsePylint,
+			`[{"type":"error","path":"app.py","line":4,"column":0,"endLine":4,"symbol":"undefined-variable","message":"Undefined variable 'y'"}]`,
+			[]Diagnostic{
+				{File: "app.py", Line: 4, Column: 1, EndLine: 4, Severity: SeverityHigh, Category: CategoryBug, Linter: "pylint", Rule: "undefined-variable", Message: "Undefined variable 'y'"},
+			}},
+		{"flake8", parseFlake8,
+			"./app.py\x1f1\x1f1\x1fF401\x1f'os' imported but unused\napp.py\x1f9\x1f80\x1fE501\x1fline too long\n",
+			[]Diagnostic{
+				{File: "app.py", Line: 1, Column: 1, Severity: SeverityMedium, Category: CategoryBug, Linter: "flake8", Rule: "F401", Message: "'os' imported but unused"},
+				{File: "app.py", Line: 9, Column: 80, Severity: SeverityLow, Category: CategoryQuality, Linter: "flake8", Rule: "E501", Message: "line too long"},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse(env, env.Root, []byte(tt.out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d diagnostics, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("[%d] got %+v\nwant %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := parseESLint(env, env.Root, []byte("Oops! Something went wrong")); err == nil {
+		t.Error("expected error for non-JSON output")
+	}
+}
+
+func TestMergeDiagnostics(t *testing.T) {
+	env, err := newToolEnv(defaultConfig(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vet := Diagnostic{File: "a.go", Line: 6, Severity: SeverityMedium, Category: CategoryBug, Linter: "go vet", Rule: "printf", Message: "wrong type"}
+	env.diagnostics.add([]Diagnostic{
+		vet,
+		vet, // 重复运行 linter
+		{File: "a.go", Line: 20, Severity: SeverityLow, Category: CategoryQuality, Linter: "go vet", Rule: "unusedresult", Message: "unused result"},
+	})
+
+	findings := env.mergeDiagnostics([]Finding{
+		{File: "./a.go", StartLine: 5, EndLine: 7, Severity: SeverityHigh, Category: CategoryBug, Message: "格式化参数类型错误"},
+		{File: "b.go", StartLine: 20, Severity: SeverityLow, Category: CategoryQuality, Message: "命名"},
+	})
+	if len(findings) != 3 {
+		t.Fatalf("got %d findings: %+v", len(findings), findings)
+	}
+	if findings[0].Source != SourceAI || findings[1].Source != SourceAI {
+		t.Errorf("AI findings should be marked: %+v", findings)
+	}
+	linted := findings[2]
+	if linted.Source != SourceLinter || linted.StartLine != 20 || linted.Message != "[go vet unusedresult] unused result" {
+		t.Errorf("linter finding: %+v", linted)
+	}
+
+	md := newReviewResult("ok", findings).Markdown
+	if !strings.Contains(md, "`a.go:20` _(source: linter)_") || strings.Count(md, "source: linter") != 1 {
+		t.Errorf("markdown:\n%s", md)
+	}
+}
+
+func TestRunLinterRecordsDiagnostics(t *testing.T) {
+	if _, err := exec.LookPath("golangci-lint"); err == nil {
+		t.Skip("golangci-lint 已安装，结果取决于其配置")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Printf(\"%d\\n\", \"x\")\n}\n")
+	env, err := newToolEnv(defaultConfig(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runLinter(context.Background(), env, lintRequest{Files: []string{"a.go"}, Scope: lintScopeFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "a.go:6:") || !strings.Contains(out, "printf: ") {
+		t.Errorf("output:\n%s", out)
+	}
+	if diags := env.diagnostics.list(); len(diags) != 1 || diags[0].File != "a.go" || diags[0].Line != 6 {
+		t.Errorf("recorded: %+v", diags)
+	}
+}
+
+func TestPlainTextFallbackKeepsDiagnostics(t *testing.T) {
+	if _, err := exec.LookPath("golangci-lint"); err == nil {
+		t.Skip("golangci-lint 已安装，结果取决于其配置")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Printf(\"%d\\n\", \"x\")\n}\n")
+	mock := NewMockProvider(
+		Message{ToolCalls: []ToolCall{mockToolCall("c1", "run_linter", `{"file_path": "a.go"}`)}},
+		Message{Content: "看起来没问题"},
+		Message{Content: "看起来没问题"},
+		Message{Content: "看起来没问题"},
+	)
+
+	result, err := codeReview(context.Background(), ReviewOptions{Provider: mock, Workspace: dir}, "review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Findings) != 1 || result.Findings[0].Source != SourceLinter || result.Findings[0].File != "a.go" {
+		t.Fatalf("findings = %+v", result.Findings)
+	}
+	if !strings.Contains(result.Markdown, "看起来没问题") || !strings.Contains(result.Markdown, "a.go:6") ||
+		result.Counts[result.Findings[0].Severity] != 1 || result.Verdict == VerdictPass {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestRunLinterByPackage(t *testing.T) {
+	for _, name := range []string{"golangci-lint", "staticcheck", "govulncheck"} {
+		if _, err := exec.LookPath(name); err == nil {
+			t.Skipf("%s 已安装，结果取决于其配置", name)
+		}
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	root := t.TempDir()
+	writeTestFile(t, root, "go.mod", "module example.com/demo\n\ngo 1.21\n")
+	if err := os.Mkdir(filepath.Join(root, "pkg"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// a.go 依赖同包的 b.go，单独 vet a.go 会报 undefined
+	writeTestFile(t, filepath.Join(root, "pkg"), "a.go", "package pkg\n\nfunc A() string { return helper() }\n")
+	writeTestFile(t, filepath.Join(root, "pkg"), "b.go", "package pkg\n\nimport \"fmt\"\n\nfunc helper() string { return fmt.Sprintf(\"%d\", \"x\") }\n")
+	writeTestFile(t, filepath.Join(root, "pkg"), "tagged.go", "//go:build integration\n\npackage pkg\n\nimport \"fmt\"\n\nfunc tagged() { fmt.Printf(\"%s\\n\", 1) }\n")
+
+	run := func(req lintRequest) (string, []Diagnostic) {
+		t.Helper()
+		env, err := newToolEnv(defaultConfig(), root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := runLinter(context.Background(), env, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out, env.diagnostics.list()
+	}
+
+	out, diags := run(lintRequest{Files: []string{"pkg/a.go"}, Scope: lintScopeFile})
+	if len(diags) != 0 || !strings.Contains(out, "go vet（./pkg） 检查通过") {
+		t.Errorf("file scope should filter out b.go: %+v\n%s", diags, out)
+	}
+
+	_, diags = run(lintRequest{Files: []string{"pkg/a.go"}, Scope: lintScopePackage})
+	if len(diags) != 1 || diags[0].File != "pkg/b.go" || diags[0].Rule != "printf" {
+		t.Errorf("package scope: %+v", diags)
+	}
+
+	_, diags = run(lintRequest{Files: []string{"pkg/tagged.go"}, Scope: lintScopeFile, BuildTags: []string{"integration"}})
+	if len(diags) != 1 || diags[0].File != "pkg/tagged.go" {
+		t.Errorf("build tags: %+v", diags)
+	}
+
+	if _, err := runLinter(context.Background(), &ToolEnv{Config: defaultConfig(), Root: root}, lintRequest{Files: []string{"pkg/a.go"}, Scope: "module"}); err == nil {
+		t.Error("expected error for unknown scope")
+	}
+}
+
+func TestRunLinterKeepsResultsWhenLinterFails(t *testing.T) {
+	for _, name := range []string{"golangci-lint", "govulncheck"} {
+		if _, err := exec.LookPath(name); err == nil {
+			t.Skipf("%s 已安装，结果取决于其配置", name)
+		}
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	// staticcheck 失败且没有输出时，go vet 的结果仍然保留
+	bin := t.TempDir()
+	writeTestFile(t, bin, "staticcheck", "#!/bin/sh\necho 'network unavailable' >&2\nexit 2\n")
+	if err := os.Chmod(filepath.Join(bin, "staticcheck"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	root := t.TempDir()
+	writeTestFile(t, root, "go.mod", "module example.com/demo\n\ngo 1.21\n")
+	writeTestFile(t, root, "a.go", "package demo\n\nimport \"fmt\"\n\nfunc A() { fmt.Printf(\"%d\\n\", \"x\") }\n")
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runLinter(context.Background(), env, lintRequest{Files: []string{"a.go"}, Scope: lintScopeFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "staticcheck 运行失败，已跳过") || !strings.Contains(out, "network unavailable") {
+		t.Errorf("output:\n%s", out)
+	}
+	if diags := env.diagnostics.list(); len(diags) != 1 || diags[0].Rule != "printf" {
+		t.Errorf("go vet diagnostics lost: %+v", diags)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ===================== LLM HTTP 客户端 ===================== */
+
+// llmTransport 被所有 Provider 共用，服务端每个请求都会新建 Provider，共用连接池避免重复握手
+var llmTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   16,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+const (
+	// 单次调用最多请求的次数（含第一次）
+	llmMaxAttempts = 4
+	// 指数退避的初始和最大间隔
+	llmRetryBaseDelay = 1 * time.Second
+	llmRetryMaxDelay  = 30 * time.Second
+	// Retry-After 超过该值时不再等待，直接返回错误
+	llmMaxRetryAfter = 2 * time.Minute
+	// 错误响应最多读取的字节数
+	maxErrorBodyBytes = 64 << 10
+)
+
+// APIErrorKind 是 LLM 接口错误的分类
+type APIErrorKind string
+
+const (
+	// ErrKindAuth 是 API Key 无效或无权限（401 / 403）
+	ErrKindAuth APIErrorKind = "auth"
+	// ErrKindQuota 是余额或配额不足（402，或 429 且错误码为 insufficient_quota）
+	ErrKindQuota APIErrorKind = "quota"
+	// ErrKindRateLimit 是请求过于频繁（429），可以重试
+	ErrKindRateLimit APIErrorKind = "rate_limit"
+	// ErrKindContextLength 是请求超出模型的上下文长度
+	ErrKindContextLength APIErrorKind = "context_length"
+	// ErrKindInvalidTools 是工具定义（JSON Schema）不被接受，或模型不支持 tools
+	ErrKindInvalidTools APIErrorKind = "invalid_tool_schema"
+	// ErrKindInvalidRequest 是其他 4xx 错误
+	ErrKindInvalidRequest APIErrorKind = "invalid_request"
+	// ErrKindServer 是 5xx、超时和网络错误，可以重试
+	ErrKindServer APIErrorKind = "server"
+	// ErrKindUnavailable 表示熔断器打开，上游连续失败，暂不发送请求
+	ErrKindUnavailable APIErrorKind = "unavailable"
+)
+
+// APIError 是 LLM 接口返回的错误，由错误响应的 JSON 解码而来
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Kind       APIErrorKind
+	// Type / Code / Param 是服务端返回的原始错误类型、错误码和出错的参数
+	Type    string
+	Code    string
+	Param   string
+	Message string
+	// RetryAfter 是服务端通过 Retry-After 要求的等待时间，0 表示未指定
+	RetryAfter time.Duration
+	// Err 是网络错误等底层错误，收到 HTTP 响应时为 nil
+	Err error
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("请求 %s 失败（%s）: %s", e.Provider, e.Kind, e.Message)
+	}
+	return fmt.Sprintf("%s 返回错误 (HTTP %d, %s): %s", e.Provider, e.StatusCode, e.Kind, e.Message)
+}
+
+func (e *APIError) Unwrap() error { return e.Err }
+
+// retryable 判断该错误是否值得重试
+func (e *APIError) retryable() bool {
+	return e.Kind == ErrKindRateLimit || e.Kind == ErrKindServer
+}
+
+// apiErrorKind 返回 err 链中 APIError 的分类，不是 APIError 时返回空
+func apiErrorKind(err error) APIErrorKind {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Kind
+	}
+	return ""
+}
+
+// decodeAPIError 把非 2xx 响应解码为 APIError，兼容 OpenAI 的 {"error": {...}} 和 Ollama 的 {"error": "..."}
+func decodeAPIError(provider string, resp *http.Response) *APIError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	e := &APIError{Provider: provider, StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+
+	var payload struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		var detail struct {
+			Message string      `json:"message"`
+			Type    string      `json:"type"`
+			Code    interface{} `json:"code"`
+			Param   string      `json:"param"`
+		}
+		var text string
+		switch {
+		case json.Unmarshal(payload.Error, &detail) == nil && detail.Message != "":
+			e.Message, e.Type, e.Param = detail.Message, detail.Type, detail.Param
+			if detail.Code != nil {
+				e.Code = fmt.Sprint(detail.Code)
+			}
+		case json.Unmarshal(payload.Error, &text) == nil && text != "":
+			e.Message = text
+		case payload.Message != "":
+			e.Message = payload.Message
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+		if e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	e.Kind = classifyAPIError(e)
+	return e
+}
+
+// classifyAPIError 按状态码和错误内容分类
+func classifyAPIError(e *APIError) APIErrorKind {
+	text := strings.ToLower(e.Type + " " + e.Code + " " + e.Message)
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrKindAuth
+	case e.StatusCode == http.StatusPaymentRequired ||
+		strings.Contains(text, "insufficient_quota") || strings.Contains(text, "insufficient balance"):
+		return ErrKindQuota
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrKindRateLimit
+	case e.StatusCode == http.StatusRequestTimeout || e.StatusCode >= 500:
+		return ErrKindServer
+	case strings.Contains(text, "context_length") || strings.Contains(text, "context length") ||
+		strings.Contains(text, "maximum context") || strings.Contains(text, "too many tokens") ||
+		strings.Contains(text, "prompt is too long"):
+		return ErrKindContextLength
+	case e.Code == "invalid_function_parameters" || e.Param == "tools" || strings.HasPrefix(e.Param, "tools["):
+		// OpenAI 兼容接口：工具定义不合法
+		return ErrKindInvalidTools
+	case strings.Contains(text, "does not support tools") || strings.Contains(text, "tools param requires"):
+		// Ollama 和 llama.cpp：模型或模板不支持 tools
+		return ErrKindInvalidTools
+	}
+	return ErrKindInvalidRequest
+}
+
+// parseRetryAfter 解析 Retry-After 头，支持秒数和 HTTP 日期
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// llmClient 发送 LLM 请求：共用连接池，对 429 / 5xx / 超时按指数退避重试，并经过熔断器
+type llmClient struct {
+	provider string
+	http     *http.Client
+	breaker  *circuitBreaker
+	// sleep 等待重试间隔，测试中替换
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// newLLMClient 创建访问 baseURL 的客户端，同一地址的客户端共用一个熔断器
+func newLLMClient(provider, baseURL string, timeout time.Duration) *llmClient {
+	return &llmClient{
+		provider: provider,
+		http:     &http.Client{Transport: llmTransport, Timeout: timeout},
+		breaker:  breakerFor(baseURL),
+		sleep:    sleepContext,
+	}
+}
+
+// do 发送 newReq 构造的请求，返回 2xx 响应；其余状态码解码为 *APIError。
+// 每次重试都重新构造请求，请求体可以重复读取
+func (c *llmClient) do(ctx context.Context, newReq func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	var last *APIError
+	for attempt := 1; ; attempt++ {
+		if wait, ok := c.breaker.allow(); !ok {
+			if last != nil {
+				// 重试过程中熔断，返回上游的原始错误
+				return nil, last
+			}
+			return nil, &APIError{
+				Provider: c.provider, Kind: ErrKindUnavailable, RetryAfter: wait,
+				Message: fmt.Sprintf("上游连续 %d 次失败，熔断中（%s 后重试）", breakerFailureThreshold, wait.Round(time.Second)),
+			}
+		}
+		req, err := newReq(ctx)
+		if err != nil {
+			// 没有发出请求，归还半开状态下的试探名额
+			c.breaker.release()
+			return nil, err
+		}
+
+		resp, err := c.http.Do(req)
+		var apiErr *APIError
+		switch {
+		case err != nil && ctx.Err() != nil:
+			// 调用方取消，不计入熔断
+			c.breaker.release()
+			return nil, ctx.Err()
+		case err != nil:
+			apiErr = &APIError{Provider: c.provider, Kind: ErrKindServer, Message: err.Error(), Err: err}
+		case resp.StatusCode >= 300:
+			apiErr = decodeAPIError(c.provider, resp)
+			resp.Body.Close()
+		default:
+			c.breaker.record(true)
+			return resp, nil
+		}
+
+		// 只有上游故障计入熔断，4xx 说明上游正常
+		c.breaker.record(!apiErr.retryable())
+		if !apiErr.retryable() || attempt >= llmMaxAttempts || apiErr.RetryAfter > llmMaxRetryAfter {
+			return nil, apiErr
+		}
+		last = apiErr
+		delay := retryDelay(attempt, apiErr.RetryAfter)
+		log.Printf("%s 请求失败（第 %d 次），%s 后重试: %v", c.provider, attempt, delay.Round(time.Millisecond), apiErr)
+		if err := c.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryDelay 计算第 attempt 次失败后的等待时间：指定了 Retry-After 时照办，
+// 否则按指数退避取 [d/2, d) 之间的随机值，避免多个请求同时重试
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := llmRetryBaseDelay << (attempt - 1)
+	if d <= 0 || d > llmRetryMaxDelay {
+		d = llmRetryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// errorStatus 返回审查失败时 API 应答的状态码：上游限流为 429、熔断为 503，其他 LLM 接口错误为 502，
+// 其余为 500；retryAfter 不为 0 时应设置 Retry-After 头
+func errorStatus(err error) (status int, retryAfter time.Duration) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return http.StatusInternalServerError, 0
+	}
+	switch apiErr.Kind {
+	case ErrKindRateLimit:
+		return http.StatusTooManyRequests, apiErr.RetryAfter
+	case ErrKindUnavailable:
+		return http.StatusServiceUnavailable, apiErr.RetryAfter
+	}
+	return http.StatusBadGateway, 0
+}
+
+// setRetryAfter 设置 Retry-After 头，按秒向上取整
+func setRetryAfter(h http.Header, d time.Duration) {
+	if d > 0 {
+		h.Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* ===================== 熔断器 ===================== */
+
+const (
+	// 连续失败该次数后打开熔断器
+	breakerFailureThreshold = 5
+	// 熔断器打开后多久允许一次试探请求
+	breakerCooldown = 30 * time.Second
+)
+
+// circuitBreaker 在上游连续失败后快速失败，冷却后放行一个试探请求：成功则恢复，失败则继续熔断
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// probing 表示冷却后的试探请求正在进行
+	probing bool
+	now     func() time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker)
+)
+
+// breakerFor 返回 baseURL 对应的熔断器，服务端所有请求共用
+func breakerFor(baseURL string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[baseURL]
+	if !ok {
+		b = &circuitBreaker{now: time.Now}
+		breakers[baseURL] = b
+	}
+	return b
+}
+
+// allow 判断是否可以发送请求，熔断期间返回 false 和距离下次试探的时间
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerFailureThreshold {
+		return 0, true
+	}
+	wait := breakerCooldown - b.now().Sub(b.openedAt)
+	if wait > 0 || b.probing {
+		if wait < time.Second {
+			// 试探请求进行中，稍后再来
+			wait = time.Second
+		}
+		return wait, false
+	}
+	b.probing = true
+	return 0, true
+}
+
+// record 记录一次请求结果，ok 为 false 表示上游故障
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= breakerFailureThreshold {
+		b.openedAt = b.now()
+	}
+}
+
+// release 在请求被调用方取消时释放试探名额，不改变计数
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
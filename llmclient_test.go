@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestLLMClient 创建访问 url 的客户端，使用独立的熔断器并记录重试间隔而不真正等待
+func newTestLLMClient(url string) (*llmClient, *[]time.Duration) {
+	var delays []time.Duration
+	c := newLLMClient("test", url, 10*time.Second)
+	c.breaker = &circuitBreaker{now: time.Now}
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return ctx.Err()
+	}
+	return c, &delays
+}
+
+func postTo(url string) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(`{"model":"m"}`))
+	}
+}
+
+func TestLLMClientRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"model":"m"}` {
+			t.Errorf("body = %s", body)
+		}
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`))
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte(`{"choices":[]}`))
+		}
+	}))
+	defer srv.Close()
+
+	c, delays := newTestLLMClient(srv.URL)
+	resp, err := c.do(context.Background(), postTo(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls != 3 || len(*delays) != 2 {
+		t.Fatalf("calls = %d, delays = %v", calls, *delays)
+	}
+	if (*delays)[0] != 7*time.Second {
+		t.Errorf("Retry-After not honoured: %v", (*delays)[0])
+	}
+	if d := (*delays)[1]; d < llmRetryBaseDelay || d >= 2*llmRetryBaseDelay {
+		t.Errorf("backoff = %v", d)
+	}
+
+	// 4xx 不重试
+	atomic.StoreInt32(&calls, 0)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"This model's maximum context length is 65536 tokens","type":"invalid_request_error"}}`))
+	})
+	_, err = c.do(context.Background(), postTo(srv.URL))
+	if calls != 1 || apiErrorKind(err) != ErrKindContextLength {
+		t.Errorf("calls = %d, err = %v", calls, err)
+	}
+
+	// 持续 5xx 时重试 llmMaxAttempts 次后返回
+	atomic.StoreInt32(&calls, 0)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	_, err = c.do(context.Background(), postTo(srv.URL))
+	if calls != llmMaxAttempts || apiErrorKind(err) != ErrKindServer {
+		t.Errorf("calls = %d, err = %v", calls, err)
+	}
+}
+
+func TestDecodeAPIError(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		body   string
+		kind   APIErrorKind
+		msg    string
+	}{
+		{401, `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`, ErrKindAuth, "Incorrect API key provided"},
+		{402, `{"error":{"message":"Insufficient Balance","type":"unknown_error"}}`, ErrKindQuota, "Insufficient Balance"},
+		{429, `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota","code":"insufficient_quota"}}`, ErrKindQuota, "You exceeded your current quota"},
+		{429, `{"error":{"message":"Rate limit reached"}}`, ErrKindRateLimit, "Rate limit reached"},
+		{400, `{"error":{"message":"This model's maximum context length is 8192 tokens","code":"context_length_exceeded"}}`, ErrKindContextLength, "This model's maximum context length is 8192 tokens"},
+		{400, `{"error":{"message":"Invalid schema for function 'read_file': 'object' is not valid","param":"tools[0].function.parameters"}}`, ErrKindInvalidTools, "Invalid schema for function 'read_file': 'object' is not valid"},
+		{400, `{"error":"registry.ollama.ai/library/gemma does not support tools"}`, ErrKindInvalidTools, "registry.ollama.ai/library/gemma does not support tools"},
+		{400, `{"error":{"message":"tools param requires --jinja flag","type":"not_supported_error"}}`, ErrKindInvalidTools, "tools param requires --jinja flag"},
+		{400, `{"error":{"message":"Invalid parameter: messages with role 'tool' must be a response to a preceeding message with 'tool_calls'.","type":"invalid_request_error","param":"messages.[3].role"}}`, ErrKindInvalidRequest, "Invalid parameter: messages with role 'tool' must be a response to a preceeding message with 'tool_calls'."},
+		{404, `{"error":"model 'qwen' not found"}`, ErrKindInvalidRequest, "model 'qwen' not found"},
+		{500, `upstream crashed`, ErrKindServer, "upstream crashed"},
+		{503, ``, ErrKindServer, "Service Unavailable"},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tc.body))}
+		e := decodeAPIError("test", resp)
+		if e.Kind != tc.kind || e.Message != tc.msg {
+			t.Errorf("%d %s: kind = %s, message = %q", tc.status, tc.body, e.Kind, e.Message)
+		}
+	}
+
+	if d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d <= 50*time.Second || d > time.Minute {
+		t.Errorf("Retry-After date = %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("Retry-After invalid = %v", d)
+	}
+
+	wrapped := fmt.Errorf("调用 LLM 失败: %w", &APIError{Kind: ErrKindRateLimit, RetryAfter: 1500 * time.Millisecond})
+	status, retryAfter := errorStatus(wrapped)
+	h := http.Header{}
+	setRetryAfter(h, retryAfter)
+	if status != http.StatusTooManyRequests || h.Get("Retry-After") != "2" {
+		t.Errorf("status = %d, Retry-After = %q", status, h.Get("Retry-After"))
+	}
+	if status, _ := errorStatus(&APIError{Kind: ErrKindAuth}); status != http.StatusBadGateway {
+		t.Errorf("auth status = %d", status)
+	}
+	if status, _ := errorStatus(errors.New("x")); status != http.StatusInternalServerError {
+		t.Errorf("other status = %d", status)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusInternalServerError)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	c, _ := newTestLLMClient(srv.URL)
+	c.breaker.now = func() time.Time { return now }
+
+	// 第一次调用重试 4 次，第二次调用第 1 次失败后熔断器打开
+	for i := 0; i < 2; i++ {
+		if _, err := c.do(context.Background(), postTo(srv.URL)); apiErrorKind(err) != ErrKindServer {
+			t.Fatalf("call %d: err = %v", i, err)
+		}
+	}
+	if calls != breakerFailureThreshold {
+		t.Fatalf("calls = %d", calls)
+	}
+
+	// 熔断期间不发送请求
+	_, err := c.do(context.Background(), postTo(srv.URL))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != ErrKindUnavailable || apiErr.RetryAfter != breakerCooldown {
+		t.Fatalf("err = %v", err)
+	}
+	if calls != breakerFailureThreshold {
+		t.Errorf("request sent while open: calls = %d", calls)
+	}
+
+	// 冷却后放行一个试探请求；构造请求失败时归还名额，成功则恢复
+	now = now.Add(breakerCooldown)
+	if _, err := c.do(context.Background(), func(context.Context) (*http.Request, error) {
+		return nil, errors.New("bad request body")
+	}); err == nil || apiErrorKind(err) != "" {
+		t.Fatalf("err = %v", err)
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	resp, err := c.do(context.Background(), postTo(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if wait, ok := c.breaker.allow(); !ok || wait != 0 || c.breaker.failures != 0 {
+		t.Errorf("breaker not closed: failures = %d", c.breaker.failures)
+	}
+
+	// 4xx 不计入熔断
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	for i := 0; i < breakerFailureThreshold+1; i++ {
+		c.do(context.Background(), postTo(srv.URL))
+	}
+	if _, ok := c.breaker.allow(); !ok {
+		t.Error("breaker opened on 4xx")
+	}
+}
+
+func TestOpenAIProviderErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"Authentication Fails (no such user)","type":"authentication_error"}}`))
+	}))
+	defer srv.Close()
+
+	p, err := newOpenAIProvider(ProviderConfig{BaseURL: srv.URL, Model: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.(StreamingProvider).ChatStream(context.Background(), ChatRequest{}, func(string) {})
+	if apiErrorKind(err) != ErrKindAuth || !strings.Contains(err.Error(), "HTTP 401") ||
+		!strings.Contains(err.Error(), "Authentication Fails") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestLocalProviderToolsFallback(t *testing.T) {
+	var calls int32
+	errBody := `{"error":"registry.ollama.ai/library/gemma does not support tools"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"tools"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(errBody))
+			return
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"ok"},"done":true}`))
+	}))
+	defer srv.Close()
+
+	req := ChatRequest{Messages: []Message{{Role: "system", Content: "s"}, {Role: "user", Content: "u"}}, Tools: tools[:1]}
+	p, err := newOllamaProvider(ProviderConfig{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.Chat(context.Background(), req)
+	if err != nil || resp.Choices[0].Message.Content != "ok" || calls != 2 {
+		t.Fatalf("calls = %d, err = %v", calls, err)
+	}
+
+	// 其他提到 tool 的 4xx 不是“不支持 tools”，不切换到提示词模式
+	atomic.StoreInt32(&calls, 0)
+	errBody = `{"error":"invalid message format: tool call arguments must be an object"}`
+	p, _ = newOllamaProvider(ProviderConfig{BaseURL: srv.URL})
+	if _, err := p.Chat(context.Background(), req); apiErrorKind(err) != ErrKindInvalidRequest || calls != 1 {
+		t.Errorf("calls = %d, err = %v", calls, err)
+	}
+}
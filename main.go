@@ -3,35 +3,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 )
 
-/* ===================== 配置 ===================== */
-
-const (
-	deepseekURL   = "https://api.deepseek.com/v1/chat/completions"
-	deepseekModel = "deepseek-chat"
-)
-
-// 从环境变量读取 API Key
-func getAPIKey() string {
-	apiKey := os.Getenv("DEEPSEEK_API_KEY")
-	if apiKey == "" {
-		log.Fatal("❌ 错误: 未设置 DEEPSEEK_API_KEY 环境变量\n" +
-			"请设置: export DEEPSEEK_API_KEY=your-api-key")
-	}
-	return apiKey
-}
-
 /* ===================== 基础类型 ===================== */
 
 type Message struct {
@@ -67,23 +54,52 @@ type ChatRequest struct {
 	Model    string    `json:"model"`
 	Messages []Message `json:"messages"`
 	Tools    []Tool    `json:"tools,omitempty"`
+	Stream   bool      `json:"stream,omitempty"`
+	// StreamOptions 在流式请求中要求最后一个分片附带 usage
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type ChatResponse struct {
-	Choices []struct {
-		Message      Message `json:"message"`
-		FinishReason string  `json:"finish_reason"`
-	} `json:"choices"`
+	Choices []Choice `json:"choices"`
+	// Usage 是本轮实际消耗的 token，部分本地后端不返回
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+type Choice struct {
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
 }
 
 /* ===================== 工具定义 ===================== */
 
+// gitDiffProperties 是 get_git_diff 和 get_diff_context 共用的参数
+var gitDiffProperties = map[string]interface{}{
+	"mode": map[string]interface{}{
+		"type":        "string",
+		"enum":        []string{diffWorking, diffStaged, diffRange, diffCommit},
+		"description": "working: target 与工作区对比（默认）；staged: target 与暂存区对比；range: target 为 A..B 或 A...B；commit: 查看 target 这个提交的变更。省略时 target 含 .. 按 range 处理",
+	},
+	"target": map[string]interface{}{
+		"type":        "string",
+		"description": "提交、分支或范围，如 HEAD、main、commit hash、main...HEAD，默认 HEAD",
+	},
+	"paths": map[string]interface{}{
+		"type":        "array",
+		"items":       map[string]interface{}{"type": "string"},
+		"description": "只看这些文件或目录的变更（相对工作区）",
+	},
+}
+
 var tools = []Tool{
 	{
 		Type: "function",
 		Function: ToolFunction{
 			Name:        "get_working_directory",
-			Description: "获取当前工作目录，用于确定文件路径",
+			Description: "获取工作区根目录，所有文件路径都相对于它，不能访问工作区之外的文件",
 			Parameters: map[string]interface{}{
 				"type":       "object",
 				"properties": map[string]interface{}{},
@@ -94,13 +110,29 @@ var tools = []Tool{
 		Type: "function",
 		Function: ToolFunction{
 			Name:        "read_file",
-			Description: "读取指定文件的内容，支持相对路径和绝对路径",
+			Description: "读取工作区内指定文件的内容，输出带行号并注明总行数；大文件可以按行分段读取",
 			Parameters: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
 					"file_path": map[string]interface{}{
 						"type":        "string",
-						"description": "文件路径（相对或绝对）",
+						"description": "文件路径（相对工作区根目录，或工作区内的绝对路径）",
+					},
+					"start_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "起始行号（从 1 开始，包含），默认 1",
+					},
+					"end_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "结束行号（包含），默认读到文件末尾或输出上限",
+					},
+					"offset": map[string]interface{}{
+						"type":        "integer",
+						"description": "跳过的行数，未指定 start_line 时等价于 start_line=offset+1",
+					},
+					"limit": map[string]interface{}{
+						"type":        "integer",
+						"description": "最多读取的行数，未指定 end_line 时生效",
 					},
 				},
 				"required": []string{"file_path"},
@@ -139,12 +171,16 @@ var tools = []Tool{
 					},
 					"pattern": map[string]interface{}{
 						"type":        "string",
-						"description": "文件匹配模式，如 *.go",
+						"description": "文件匹配模式，如 *.go；包含 / 时匹配相对 directory 的路径，如 cmd/*.go",
 					},
 					"recursive": map[string]interface{}{
 						"type":        "boolean",
 						"description": "是否递归查找子目录",
 					},
+					"tracked_only": map[string]interface{}{
+						"type":        "boolean",
+						"description": "只包含 git 已跟踪的文件（git ls-files）",
+					},
 				},
 			},
 		},
@@ -153,7 +189,7 @@ var tools = []Tool{
 		Type: "function",
 		Function: ToolFunction{
 			Name:        "search_in_files",
-			Description: "在文件中搜索关键字或正则表达式",
+			Description: "在文件中搜索正则表达式（RE2 语法）或关键字，自动跳过 .gitignore / .ai-crignore 忽略的文件、node_modules 和二进制文件",
 			Parameters: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
@@ -163,11 +199,54 @@ var tools = []Tool{
 					},
 					"pattern": map[string]interface{}{
 						"type":        "string",
-						"description": "搜索模式（关键字或正则）",
+						"description": "搜索模式，默认按 RE2 正则匹配",
+					},
+					"fixed_strings": map[string]interface{}{
+						"type":        "boolean",
+						"description": "按字面量匹配 pattern，不解析正则",
+					},
+					"ignore_case": map[string]interface{}{
+						"type":        "boolean",
+						"description": "忽略大小写",
+					},
+					"context": map[string]interface{}{
+						"type":        "integer",
+						"description": "匹配行前后各显示的行数（最多 10）",
+					},
+					"before_context": map[string]interface{}{
+						"type":        "integer",
+						"description": "匹配行之前显示的行数，覆盖 context",
+					},
+					"after_context": map[string]interface{}{
+						"type":        "integer",
+						"description": "匹配行之后显示的行数，覆盖 context",
 					},
 					"file_extension": map[string]interface{}{
 						"type":        "string",
-						"description": "文件扩展名，如 .go",
+						"description": "文件扩展名，如 .go；多个用逗号分隔，如 .go,.ts",
+					},
+					"file_extensions": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "文件扩展名列表，如 [\".go\", \".ts\"]",
+					},
+					"include": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "只搜索匹配这些 glob 的路径，如 [\"internal/**\", \"*_test.go\"]",
+					},
+					"exclude": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "跳过匹配这些 glob 的路径",
+					},
+					"max_results": map[string]interface{}{
+						"type":        "integer",
+						"description": "最多返回的匹配行数（默认 100，最多 1000）",
+					},
+					"tracked_only": map[string]interface{}{
+						"type":        "boolean",
+						"description": "只包含 git 已跟踪的文件（git ls-files）",
 					},
 				},
 				"required": []string{"directory", "pattern"},
@@ -178,15 +257,103 @@ var tools = []Tool{
 		Type: "function",
 		Function: ToolFunction{
 			Name:        "get_git_diff",
-			Description: "获取 Git 仓库的代码变更",
+			Description: "获取 Git 仓库的代码变更：工作区或暂存区相对某个提交的变更、两个提交之间的变更或单个提交",
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": gitDiffProperties,
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "get_diff_context",
+			Description: "获取 Git 代码变更，并为每个 hunk 附上新版本中所在函数、方法或类型声明的完整源码。审查变更时优先使用",
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": gitDiffProperties,
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "git_blame",
+			Description: "查看文件指定行的最后修改提交、作者、日期和提交标题，用于了解一行代码为什么存在（单次最多 200 行）",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"file_path": map[string]interface{}{
+						"type":        "string",
+						"description": "文件路径",
+					},
+					"start_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "起始行号（从 1 开始）",
+					},
+					"end_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "结束行号（包含）",
+					},
+					"revision": map[string]interface{}{
+						"type":        "string",
+						"description": "在该提交的版本上 blame，默认为工作区文件",
+					},
+				},
+				"required": []string{"file_path"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "git_log",
+			Description: "查看修改过某个文件或目录的最近提交，包含作者、日期和完整提交说明。可结合 get_git_diff（mode=commit）查看某个提交的改动，判断本次变更是否回退了最近的修复",
 			Parameters: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
-					"target": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "文件或目录路径，默认整个工作区",
+					},
+					"revision": map[string]interface{}{
+						"type":        "string",
+						"description": "从该提交开始向前查看，默认 HEAD",
+					},
+					"max_count": map[string]interface{}{
+						"type":        "integer",
+						"description": "最多返回的提交数，默认 10，最大 50",
+					},
+				},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "git_show_file_at",
+			Description: "读取文件在某个提交中的内容（带行号），用法同 read_file",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"file_path": map[string]interface{}{
+						"type":        "string",
+						"description": "文件路径",
+					},
+					"revision": map[string]interface{}{
 						"type":        "string",
-						"description": "对比目标，如 HEAD、main、commit hash",
+						"description": "提交、分支或标签，如 HEAD~1、main",
+					},
+					"start_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "起始行号（从 1 开始）",
+					},
+					"end_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "结束行号（包含）",
 					},
 				},
+				"required": []string{"file_path", "revision"},
 			},
 		},
 	},
@@ -194,7 +361,7 @@ var tools = []Tool{
 		Type: "function",
 		Function: ToolFunction{
 			Name:        "run_linter",
-			Description: "运行代码检查工具（如 golangci-lint、eslint）",
+			Description: "运行代码检查工具（golangci-lint / go vet / staticcheck / govulncheck、eslint、pylint / flake8），返回结构化的问题列表；这些问题会在审查结束时自动并入报告。Go 模块内的文件按所在包检查",
 			Parameters: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
@@ -202,6 +369,66 @@ var tools = []Tool{
 						"type":        "string",
 						"description": "要检查的文件路径",
 					},
+					"file_paths": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "一次检查多个文件，同一个包的文件只运行一次",
+					},
+					"scope": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{lintScopeFile, lintScopePackage},
+						"description": "file: 只返回指定文件中的问题（默认）；package: 返回所在包的全部问题",
+					},
+					"build_tags": map[string]interface{}{
+						"type":        "string",
+						"description": "Go 构建标签，逗号分隔，默认使用配置中的 build_tags",
+					},
+				},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "run_build",
+			Description: "在工作区中编译代码（Go 为 go build，其他语言使用配置中的 build_command），返回带 file:line 的编译错误。有超时、CPU 和输出大小限制",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"packages": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "要编译的文件、目录或 dir/... 形式的包，默认整个工作区",
+					},
+					"build_tags": map[string]interface{}{
+						"type":        "string",
+						"description": "Go 构建标签，逗号分隔，默认使用配置中的 build_tags",
+					},
+				},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "run_tests",
+			Description: "运行受变更影响的包的测试（Go 为 go test，其他语言使用配置中的 test_command），返回失败的测试名、file:line 和输出。有超时、CPU 和输出大小限制",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"packages": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "要测试的文件、目录或 dir/... 形式的包，默认整个工作区",
+					},
+					"run": map[string]interface{}{
+						"type":        "string",
+						"description": "只运行名称匹配该正则的测试（go test -run）",
+					},
+					"build_tags": map[string]interface{}{
+						"type":        "string",
+						"description": "Go 构建标签，逗号分隔，默认使用配置中的 build_tags",
+					},
 				},
 			},
 		},
@@ -218,44 +445,110 @@ var tools = []Tool{
 						"type":        "string",
 						"description": "要分析的目录路径",
 					},
+					"tracked_only": map[string]interface{}{
+						"type":        "boolean",
+						"description": "只包含 git 已跟踪的文件（git ls-files）",
+					},
 				},
 				"required": []string{"directory"},
 			},
 		},
 	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "list_package_symbols",
+			Description: "列出目录中 Go 包的类型、函数、方法、常量和变量，附带位置和签名",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"directory": map[string]interface{}{
+						"type":        "string",
+						"description": "Go 包所在目录",
+					},
+					"exported_only": map[string]interface{}{
+						"type":        "boolean",
+						"description": "只列出导出的符号",
+					},
+				},
+				"required": []string{"directory"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "find_definition",
+			Description: "基于类型信息查找 Go 符号的定义：类型、接口、常量、变量返回完整声明，函数返回签名和位置",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"symbol": map[string]interface{}{
+						"type":        "string",
+						"description": "符号名，支持 Name、Type.Method、Type.Field、pkg.Name",
+					},
+					"directory": map[string]interface{}{
+						"type":        "string",
+						"description": "查找范围（递归），默认工作区根目录",
+					},
+				},
+				"required": []string{"symbol"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "find_references",
+			Description: "基于类型信息查找 Go 符号的所有引用位置（不是文本匹配，不会误匹配同名符号）",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"symbol": map[string]interface{}{
+						"type":        "string",
+						"description": "符号名，支持 Name、Type.Method、Type.Field、pkg.Name",
+					},
+					"directory": map[string]interface{}{
+						"type":        "string",
+						"description": "查找范围（递归），默认工作区根目录",
+					},
+				},
+				"required": []string{"symbol"},
+			},
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "get_function_source",
+			Description: "获取 Go 函数或方法的完整源码（带行号和注释），无需读取整个文件",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"symbol": map[string]interface{}{
+						"type":        "string",
+						"description": "函数名或 Type.Method、pkg.Func",
+					},
+					"directory": map[string]interface{}{
+						"type":        "string",
+						"description": "查找范围（递归），默认工作区根目录",
+					},
+				},
+				"required": []string{"symbol"},
+			},
+		},
+	},
+	submitReviewToolDef,
 }
 
-/* ===================== DeepSeek API ===================== */
-
-func callDeepSeek(ctx context.Context, messages []Message, useTools bool) (*ChatResponse, error) {
-	req := ChatRequest{
-		Model:    deepseekModel,
-		Messages: messages,
-	}
-	if useTools {
-		req.Tools = tools
-	}
-
-	body, _ := json.Marshal(req)
-
-	httpReq, _ := http.NewRequestWithContext(
-		ctx, http.MethodPost, deepseekURL, strings.NewReader(string(body)),
-	)
-	httpReq.Header.Set("Authorization", "Bearer "+getAPIKey())
-	httpReq.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 300 * time.Second}
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	var cr ChatResponse
-	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
-		return nil, err
+// isToolName 判断 name 是否是已定义的工具
+func isToolName(name string) bool {
+	for _, t := range tools {
+		if t.Function.Name == name {
+			return true
+		}
 	}
-	return &cr, nil
+	return false
 }
 
 /* ===================== 工具执行 ===================== */
@@ -275,52 +568,119 @@ func getStringArg(args map[string]interface{}, key string, defaultVal string) st
 	return str
 }
 
-func executeTool(name string, args map[string]interface{}) (string, error) {
+func getIntArg(args map[string]interface{}, key string, defaultVal int) int {
+	// JSON 数字解码为 float64
+	if val, ok := args[key].(float64); ok {
+		return int(val)
+	}
+	return defaultVal
+}
+
+func getBoolArg(args map[string]interface{}, key string, defaultVal bool) bool {
+	if val, ok := args[key].(bool); ok {
+		return val
+	}
+	return defaultVal
+}
+
+// getStringSliceArg 读取字符串数组参数，也接受单个字符串
+func getStringSliceArg(args map[string]interface{}, key string) []string {
+	switch val := args[key].(type) {
+	case string:
+		if val != "" {
+			return []string{val}
+		}
+	case []interface{}:
+		var out []string
+		for _, v := range val {
+			if str, ok := v.(string); ok && str != "" {
+				out = append(out, str)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func executeTool(ctx context.Context, env *ToolEnv, name string, args map[string]interface{}) (string, error) {
 	switch name {
 	case "get_working_directory":
-		wd := getWorkingDirectory()
-		return fmt.Sprintf("当前工作目录: %s", wd), nil
+		return fmt.Sprintf("当前工作目录: %s\n文件工具只能访问该目录内的路径，相对路径以它为基准", env.Root), nil
 
 	case "read_file":
 		filePath := getStringArg(args, "file_path", "")
 		if filePath == "" {
 			return "", fmt.Errorf("file_path is required")
 		}
-		return readFile(filePath)
+		return readFile(env, filePath, lineRangeFromArgs(args))
 
 	case "read_multiple_files":
 		filePaths, ok := args["file_paths"].([]interface{})
 		if !ok {
 			return "", fmt.Errorf("file_paths must be an array")
 		}
-		return readMultipleFiles(filePaths)
+		return readMultipleFiles(ctx, env, filePaths)
 
 	case "list_files":
 		directory := getStringArg(args, "directory", ".")
 		pattern := getStringArg(args, "pattern", "*")
-		recursive := false
-		if r, ok := args["recursive"].(bool); ok {
-			recursive = r
-		}
-		return listFiles(directory, pattern, recursive)
+		return listFiles(ctx, env, directory, pattern, walkOptions{
+			Recursive:   getBoolArg(args, "recursive", false),
+			TrackedOnly: getBoolArg(args, "tracked_only", env.Config.trackedOnly()),
+		})
 
 	case "search_in_files":
-		directory := getStringArg(args, "directory", ".")
-		pattern := getStringArg(args, "pattern", "")
-		fileExt := getStringArg(args, "file_extension", "")
-		return searchInFiles(directory, pattern, fileExt)
+		opts := searchOptionsFromArgs(args)
+		opts.TrackedOnly = getBoolArg(args, "tracked_only", env.Config.trackedOnly())
+		return searchInFiles(ctx, env, opts)
 
 	case "get_git_diff":
-		target := getStringArg(args, "target", "HEAD")
-		return getGitDiff(target)
+		return getGitDiff(ctx, env, gitDiffSpecFromArgs(args))
+
+	case "get_diff_context":
+		diff, err := diffWithContext(ctx, env, gitDiffSpecFromArgs(args))
+		if err != nil || diff != "" {
+			return diff, err
+		}
+		return "没有代码变更", nil
+
+	case "git_blame":
+		return gitBlame(ctx, env, getStringArg(args, "file_path", ""), getStringArg(args, "revision", ""), lineRangeFromArgs(args))
+
+	case "git_log":
+		return gitLog(ctx, env, getStringArg(args, "path", ""), getStringArg(args, "revision", ""), getIntArg(args, "max_count", defaultLogCount))
+
+	case "git_show_file_at":
+		return gitShowFileAt(ctx, env, getStringArg(args, "file_path", ""), getStringArg(args, "revision", ""), lineRangeFromArgs(args))
 
 	case "run_linter":
-		filePath := getStringArg(args, "file_path", "")
-		return runLinter(filePath)
+		return runLinter(ctx, env, lintRequestFromArgs(args, env.Config))
+
+	case "run_build":
+		return runBuild(ctx, env, commandRequestFromArgs(args, env.Config))
+
+	case "run_tests":
+		return runTests(ctx, env, commandRequestFromArgs(args, env.Config))
 
 	case "analyze_directory":
 		directory := getStringArg(args, "directory", ".")
-		return analyzeDirectory(directory)
+		return analyzeDirectory(ctx, env, directory, walkOptions{
+			Recursive:   true,
+			TrackedOnly: getBoolArg(args, "tracked_only", env.Config.trackedOnly()),
+		})
+
+	case "list_package_symbols":
+		directory := getStringArg(args, "directory", ".")
+		return listPackageSymbols(ctx, env, directory, getBoolArg(args, "exported_only", false))
+
+	case "find_definition":
+		return findDefinition(ctx, env, getStringArg(args, "symbol", ""), getStringArg(args, "directory", "."))
+
+	case "find_references":
+		return findReferences(ctx, env, getStringArg(args, "symbol", ""), getStringArg(args, "directory", "."))
+
+	case "get_function_source":
+		return getFunctionSource(ctx, env, getStringArg(args, "symbol", ""), getStringArg(args, "directory", "."))
 
 	default:
 		return "", fmt.Errorf("unknown tool: %s", name)
@@ -329,90 +689,171 @@ func executeTool(name string, args map[string]interface{}) (string, error) {
 
 /* ===================== 工具实现 ===================== */
 
-func getWorkingDirectory() string {
-	wd, _ := os.Getwd()
-	return wd
+// lineRange 是 read_file 读取的行范围，行号从 1 开始，零值表示不限
+type lineRange struct {
+	Start int
+	End   int
 }
 
-func readFile(filePath string) (string, error) {
-	// 尝试多个可能的路径
-	possiblePaths := []string{
-		filePath,
-		filepath.Join("..", filePath),    // 上一级目录
-		filepath.Join("../..", filePath), // 上两级目录
+func lineRangeFromArgs(args map[string]interface{}) lineRange {
+	r := lineRange{
+		Start: getIntArg(args, "start_line", 0),
+		End:   getIntArg(args, "end_line", 0),
 	}
+	if offset := getIntArg(args, "offset", 0); r.Start == 0 && offset > 0 {
+		r.Start = offset + 1
+	}
+	if limit := getIntArg(args, "limit", 0); r.End == 0 && limit > 0 {
+		r.End = max(r.Start, 1) + limit - 1
+	}
+	return r
+}
 
-	var lastErr error
-	for _, path := range possiblePaths {
-		data, err := os.ReadFile(path)
-		if err == nil {
-			// 成功读取
-			content := string(data)
-			if len(content) > 10000 {
-				content = content[:10000] + "\n... (文件过长，已截断)"
+// readFile 按行读取文件，每行带行号
+func readFile(env *ToolEnv, filePath string, r lineRange) (string, error) {
+	path, err := env.resolve(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("读取文件失败: %s (工作区: %s): %w", filePath, env.Root, err)
+	}
+	return renderLines(env, filePath, data, r)
+}
+
+// renderLines 输出 data 中 r 范围内的行，每行带行号。输出超过 read_file_max_bytes 时在行边界截断，
+// 并提示下一段的 start_line
+func renderLines(env *ToolEnv, filePath string, data []byte, r lineRange) (string, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	total := len(lines)
+	if total == 0 {
+		return fmt.Sprintf("=== %s (空文件) ===", filePath), nil
+	}
+
+	start, end := max(r.Start, 1), r.End
+	if start > total {
+		return "", fmt.Errorf("start_line %d 超出文件总行数 %d", start, total)
+	}
+	if end == 0 || end > total {
+		end = total
+	}
+	if end < start {
+		return "", fmt.Errorf("end_line (%d) 小于 start_line (%d)", end, start)
+	}
+
+	var body strings.Builder
+	budget := env.Config.ReadFileMaxBytes
+	n := start
+	for ; n <= end; n++ {
+		entry := fmt.Sprintf("%6d\t%s\n", n, strings.TrimRight(lines[n-1], "\r\n"))
+		if body.Len()+len(entry) > budget {
+			if n > start {
+				break
 			}
-			return fmt.Sprintf("=== %s ===\n%s", filePath, content), nil
+			// 单行超过上限时按 UTF-8 字符边界截断
+			entry = truncateUTF8(entry, budget) + " ...(该行过长，已截断)\n"
 		}
-		lastErr = err
+		body.WriteString(entry)
 	}
+	last := n - 1
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("=== %s (第 %d-%d 行，共 %d 行) ===\n", filePath, start, last, total))
+	sb.WriteString(body.String())
+	switch {
+	case last < end:
+		sb.WriteString(fmt.Sprintf("... (输出已达 %d 字节上限，第 %d-%d 行未显示，继续读取请使用 start_line=%d)\n", budget, last+1, end, last+1))
+	case last < total:
+		sb.WriteString(fmt.Sprintf("... (之后还有 %d 行，继续读取请使用 start_line=%d)\n", total-last, last+1))
+	}
+	return sb.String(), nil
+}
 
-	// 所有路径都失败，返回详细错误
-	absPath, _ := filepath.Abs(filePath)
-	return "", fmt.Errorf("读取文件失败: %s\n尝试的路径: %v\n绝对路径: %s\n错误: %v",
-		filePath, possiblePaths, absPath, lastErr)
+// truncateUTF8 把 s 截断到不超过 n 字节，不切断多字节字符
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
 }
 
-func readMultipleFiles(filePaths []interface{}) (string, error) {
+const (
+	// maxReadFiles 是 read_multiple_files 单次最多读取的文件数
+	maxReadFiles = 10
+	// maxParallelReads 是 read_multiple_files 同时读取的文件数
+	maxParallelReads = 4
+)
+
+func readMultipleFiles(ctx context.Context, env *ToolEnv, filePaths []interface{}) (string, error) {
 	var result strings.Builder
 	result.WriteString(fmt.Sprintf("读取 %d 个文件：\n\n", len(filePaths)))
 
-	for i, fp := range filePaths {
-		if i >= 10 {
-			result.WriteString("\n... (超过10个文件，已截断)")
-			break
-		}
+	truncated := len(filePaths) > maxReadFiles
+	if truncated {
+		filePaths = filePaths[:maxReadFiles]
+	}
 
-		filePath, ok := fp.(string)
-		if !ok {
-			continue
+	// 并发读取，按传入顺序输出
+	contents := make([]string, len(filePaths))
+	forEachParallel(len(filePaths), maxParallelReads, func(i int) {
+		filePath, ok := filePaths[i].(string)
+		if !ok || ctx.Err() != nil {
+			return
 		}
-
-		content, err := readFile(filePath)
+		content, err := readFile(env, filePath, lineRange{})
 		if err != nil {
-			result.WriteString(fmt.Sprintf("\n❌ %s: %v\n", filePath, err))
-			continue
+			contents[i] = fmt.Sprintf("\n❌ %s: %v\n", filePath, err)
+			return
 		}
+		contents[i] = content + "\n\n"
+	})
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 
+	for _, content := range contents {
 		result.WriteString(content)
-		result.WriteString("\n\n")
 	}
-
+	if truncated {
+		result.WriteString("\n... (超过10个文件，已截断)")
+	}
 	return result.String(), nil
 }
 
-func listFiles(directory, pattern string, recursive bool) (string, error) {
-	var matches []string
-	var err error
-
-	if recursive {
-		// 递归查找
-		err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				matched, _ := filepath.Match(pattern, filepath.Base(path))
-				if matched {
-					matches = append(matches, path)
-				}
-			}
-			return nil
-		})
-	} else {
-		// 非递归
-		matches, err = filepath.Glob(filepath.Join(directory, pattern))
+func listFiles(ctx context.Context, env *ToolEnv, directory, pattern string, opts walkOptions) (string, error) {
+	root, err := env.resolve(directory)
+	if err != nil {
+		return "", err
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return "", fmt.Errorf("无效的匹配模式 %q: %w", pattern, err)
 	}
 
+	// 带路径分隔符的模式（如 cmd/*.go）匹配相对 directory 的路径，需要进入子目录；否则只匹配文件名
+	pattern = filepath.FromSlash(pattern)
+	byPath := strings.ContainsRune(pattern, filepath.Separator)
+	if byPath {
+		opts.Recursive = true
+	}
+	var matches []string
+	err = env.walk(ctx, root, opts, func(path string, info os.FileInfo) error {
+		name := filepath.Base(path)
+		if byPath {
+			name, _ = filepath.Rel(root, path)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			matches = append(matches, path)
+		}
+		return nil
+	})
 	if err != nil {
 		return "", fmt.Errorf("列出文件失败: %w", err)
 	}
@@ -429,67 +870,19 @@ func listFiles(directory, pattern string, recursive bool) (string, error) {
 			continue
 		}
 		if !info.IsDir() {
-			result.WriteString(fmt.Sprintf("- %s (%d bytes)\n", match, info.Size()))
+			result.WriteString(fmt.Sprintf("- %s (%d bytes)\n", env.display(match), info.Size()))
 		}
 	}
 
 	return result.String(), nil
 }
 
-func searchInFiles(directory, pattern, fileExt string) (string, error) {
-	var result strings.Builder
-	result.WriteString(fmt.Sprintf("在 %s 中搜索 '%s'：\n\n", directory, pattern))
-
-	matchCount := 0
-	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// 跳过目录和不匹配的文件
-		if info.IsDir() {
-			return nil
-		}
-		if fileExt != "" && filepath.Ext(path) != fileExt {
-			return nil
-		}
-
-		// 读取文件内容
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-
-		content := string(data)
-		if strings.Contains(content, pattern) {
-			matchCount++
-			result.WriteString(fmt.Sprintf("📄 %s\n", path))
-
-			// 显示匹配的行
-			lines := strings.Split(content, "\n")
-			for i, line := range lines {
-				if strings.Contains(line, pattern) {
-					result.WriteString(fmt.Sprintf("  L%d: %s\n", i+1, line))
-				}
-			}
-			result.WriteString("\n")
-		}
-
-		return nil
-	})
-
+func analyzeDirectory(ctx context.Context, env *ToolEnv, directory string, opts walkOptions) (string, error) {
+	root, err := env.resolve(directory)
 	if err != nil {
-		return "", fmt.Errorf("搜索失败: %w", err)
+		return "", err
 	}
 
-	if matchCount == 0 {
-		return "未找到匹配的内容", nil
-	}
-
-	return result.String(), nil
-}
-
-func analyzeDirectory(directory string) (string, error) {
 	var result strings.Builder
 	result.WriteString(fmt.Sprintf("📁 分析目录: %s\n\n", directory))
 
@@ -499,24 +892,17 @@ func analyzeDirectory(directory string) (string, error) {
 	filesByExt := make(map[string]int)
 	var codeFiles []string
 
-	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if !info.IsDir() {
-			fileCount++
-			totalSize += info.Size()
+	err = env.walk(ctx, root, opts, func(path string, info os.FileInfo) error {
+		fileCount++
+		totalSize += info.Size()
 
-			ext := filepath.Ext(path)
-			filesByExt[ext]++
+		ext := filepath.Ext(path)
+		filesByExt[ext]++
 
-			// 收集代码文件
-			if isCodeFile(ext) {
-				codeFiles = append(codeFiles, path)
-			}
+		// 收集代码文件
+		if env.Config.isCodeFile(ext) {
+			codeFiles = append(codeFiles, env.display(path))
 		}
-
 		return nil
 	})
 
@@ -549,112 +935,62 @@ func analyzeDirectory(directory string) (string, error) {
 	return result.String(), nil
 }
 
-func isCodeFile(ext string) bool {
-	codeExts := map[string]bool{
-		".go":    true,
-		".js":    true,
-		".ts":    true,
-		".jsx":   true,
-		".tsx":   true,
-		".py":    true,
-		".java":  true,
-		".c":     true,
-		".cpp":   true,
-		".h":     true,
-		".rs":    true,
-		".php":   true,
-		".rb":    true,
-		".swift": true,
-		".kt":    true,
-	}
-	return codeExts[ext]
-}
-
-func getGitDiff(target string) (string, error) {
-	cmd := exec.Command("git", "diff", target)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("获取 git diff 失败: %w", err)
-	}
-
-	diff := string(output)
-	if diff == "" {
-		return "没有代码变更", nil
+// skip 判断遍历时是否跳过 path：命中 ignore 的目录整体跳过，指向工作区外的符号链接也跳过
+func (env *ToolEnv) skip(root, path string, info os.FileInfo) (bool, error) {
+	if path == root || (!env.Config.ignored(env.Root, path) && !env.escapes(path, info)) {
+		return false, nil
 	}
-
-	// 限制输出长度
-	if len(diff) > 20000 {
-		diff = diff[:20000] + "\n... (diff 过长，已截断)"
+	if info.IsDir() {
+		return true, filepath.SkipDir
 	}
-
-	return diff, nil
+	return true, nil
 }
 
-func runLinter(filePath string) (string, error) {
-	if filePath == "" {
-		return "", fmt.Errorf("file_path is required")
-	}
-
-	// 根据文件扩展名选择 linter
-	ext := filepath.Ext(filePath)
-	var cmd *exec.Cmd
-	var linterName string
-
-	switch ext {
-	case ".go":
-		// 尝试 golangci-lint，如果没有则用 go vet
-		if _, err := exec.LookPath("golangci-lint"); err == nil {
-			cmd = exec.Command("golangci-lint", "run", filePath)
-			linterName = "golangci-lint"
-		} else if _, err := exec.LookPath("go"); err == nil {
-			cmd = exec.Command("go", "vet", filePath)
-			linterName = "go vet"
-		} else {
-			return "⚠️ 未安装 Go 相关的 linter 工具\n建议安装: brew install golangci-lint", nil
-		}
-	case ".js", ".ts", ".jsx", ".tsx":
-		if _, err := exec.LookPath("eslint"); err == nil {
-			cmd = exec.Command("eslint", filePath)
-			linterName = "eslint"
-		} else {
-			return "⚠️ 未安装 eslint\n建议安装: npm install -g eslint", nil
-		}
-	case ".py":
-		if _, err := exec.LookPath("pylint"); err == nil {
-			cmd = exec.Command("pylint", filePath)
-			linterName = "pylint"
-		} else if _, err := exec.LookPath("flake8"); err == nil {
-			cmd = exec.Command("flake8", filePath)
-			linterName = "flake8"
-		} else {
-			return "⚠️ 未安装 Python linter\n建议安装: pip install pylint", nil
-		}
-	default:
-		return fmt.Sprintf("⚠️ 不支持的文件类型: %s\n支持的类型: .go, .js, .ts, .py", ext), nil
-	}
+/* ===================== Code Review ===================== */
 
-	output, err := cmd.CombinedOutput()
-	result := string(output)
+// ReviewOptions 是单次审查的参数
+type ReviewOptions struct {
+	Provider Provider
+	// Policy 决定 verdict 的阈值，零值使用默认阈值
+	Policy VerdictPolicy
+	// Config 是合并后的 .ai-cr.yaml 配置，nil 时使用默认配置
+	Config *Config
+	// Workspace 是文件工具可以访问的根目录，为空时使用当前目录
+	Workspace string
+	// OnEvent 订阅审查过程中的事件，可为 nil；同一轮的工具并发执行，可能被多个 goroutine 同时调用
+	OnEvent func(ReviewEvent)
+	// OnUsage 在审查结束时（包括失败）回调本次的 token 用量和结果错误，可为 nil
+	OnUsage func(ReviewUsage, error)
+}
 
-	if err != nil {
-		// linter 发现问题时会返回非 0 退出码
-		if result != "" {
-			return fmt.Sprintf("🔍 使用 %s 检查结果:\n%s", linterName, result), nil
-		}
-		return "", fmt.Errorf("运行 %s 失败: %w", linterName, err)
+func (o ReviewOptions) emit(ev ReviewEvent) {
+	if o.OnEvent != nil {
+		o.OnEvent(ev)
 	}
+}
 
-	if result == "" {
-		return fmt.Sprintf("✅ %s 检查通过，未发现代码问题", linterName), nil
+func (o ReviewOptions) config() *Config {
+	if o.Config == nil {
+		return defaultConfig()
 	}
-
-	return fmt.Sprintf("🔍 使用 %s 检查结果:\n%s", linterName, result), nil
+	return o.Config
 }
 
-/* ===================== Code Review ===================== */
+// finalize 补全结果中的统计、结论、模型信息和 token 用量
+func (o ReviewOptions) finalize(round int, budget *tokenBudget, meter *usageMeter, result *ReviewResult) {
+	result.Provider = o.Provider.Name()
+	result.Model = o.Provider.Model()
+	result.Rounds = round
+	estimated := budget.usage
+	result.Budget = &estimated
+	usage := meter.usage
+	result.Usage = &usage
+	result.Counts = countSeverities(result.Findings)
+	result.Verdict = o.Policy.verdict(result.Findings)
+}
 
-func codeReview(ctx context.Context, request string) (string, error) {
-	systemPrompt := `你是一个专业的代码审查专家，擅长发现代码中的问题并提供改进建议。
+// defaultSystemPrompt 是默认的系统提示词，可以被 .ai-cr.yaml 的 system_prompt 替换
+const defaultSystemPrompt = `你是一个专业的代码审查专家，擅长发现代码中的问题并提供改进建议。
 
 审查重点：
 1. 代码质量：可读性、可维护性、复杂度
@@ -664,89 +1000,302 @@ func codeReview(ctx context.Context, request string) (string, error) {
 5. 最佳实践：命名规范、错误处理、代码结构
 
 可用工具：
-- read_file: 读取单个文件内容
+- read_file: 读取单个文件内容（带行号，大文件用 start_line / end_line 分段读取）
 - read_multiple_files: 批量读取多个文件
 - list_files: 列出目录文件（支持递归）
-- search_in_files: 在文件中搜索关键字
+- search_in_files: 按正则或关键字搜索代码，支持上下文行、扩展名和路径过滤
 - analyze_directory: 分析目录结构和代码文件
-- get_git_diff: 获取代码变更
-- run_linter: 运行代码检查工具
+- get_git_diff: 获取代码变更，mode 可选 working（工作区）、staged（暂存区）、range（A..B / A...B）、commit（单个提交），paths 限定文件
+- get_diff_context: 获取代码变更，并附上每处改动所在函数或类型的完整源码
+- git_blame / git_log / git_show_file_at: 查看代码行的修改来源、文件的提交历史和历史版本，判断变更是否回退了最近的修复或与提交说明矛盾
+- run_linter: 运行代码检查工具，发现的问题会自动并入报告，submit_review 中只需补充 linter 无法发现的问题
+- run_build / run_tests: 编译代码、运行受影响包的测试，引用失败时给出返回的测试名和 file:line
+- list_package_symbols / find_definition / find_references / get_function_source: Go 代码的符号级工具，按需获取被调用的函数或接口，避免读取整个文件
+- submit_review: 提交最终的结构化审查结果
 
 工作流程：
 1. 使用 analyze_directory 或 list_files 了解目录结构
 2. 使用 read_file 或 read_multiple_files 读取具体代码
 3. 使用 search_in_files 查找特定模式（如 TODO、FIXME、安全问题）
 4. 仔细分析代码，找出问题
-5. 给出具体的改进建议和示例代码
+5. 调用 submit_review 提交结果：每个问题给出文件、行号、严重程度、分类、描述和修复建议
 
 注意：
 - 对于目录审查，先用 analyze_directory 了解结构，再批量读取关键文件
 - 单次最多读取10个文件，避免 token 超限
 - 获取代码后，你需要自己分析并给出审查意见`
 
+func codeReview(ctx context.Context, opts ReviewOptions, request string) (result *ReviewResult, err error) {
+	cfg := opts.config()
+	env, err := newToolEnv(cfg, opts.Workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	// 失败的审查同样消耗 token，结束时统一上报
+	meter := newUsageMeter(cfg, opts.Provider.Model())
+	if opts.OnUsage != nil {
+		defer func() { opts.OnUsage(meter.usage, err) }()
+	}
+
 	messages := []Message{
-		{Role: "system", Content: systemPrompt},
+		{Role: "system", Content: cfg.systemPrompt()},
 		{Role: "user", Content: request},
 	}
 
-	// Agent Loop - 最多循环 10 次
-	for i := 0; i < 100; i++ {
-		resp, err := callDeepSeek(ctx, messages, true)
+	// Agent Loop - 最多循环 max_rounds 次；上下文接近 context_window 时压缩历史，
+	// 累计用量达到 token_budget 后只允许调用 submit_review
+	budget := newTokenBudget(cfg, tools)
+	reminders := 0
+	for i := 0; i < cfg.MaxRounds; i++ {
+		round := i + 1
+		opts.emit(ReviewEvent{Type: EventRoundStart, Round: round})
+
+		roundTools := tools
+		if budget.exhausted() {
+			if budget.usage.Exhausted {
+				return nil, fmt.Errorf("超出 token 预算（约 %d / %d），模型未提交审查结果", budget.usage.EstimatedTokens, cfg.TokenBudget)
+			}
+			budget.usage.Exhausted = true
+			messages = append(messages, Message{Role: "user", Content: budgetExhaustedReminder})
+			roundTools = []Tool{submitReviewToolDef}
+		}
+		var note string
+		if messages, note = budget.fit(messages); note != "" {
+			opts.emit(ReviewEvent{Type: EventCompact, Round: round, Content: note})
+		}
+
+		resp, err := chatRound(ctx, opts, round, ChatRequest{Messages: messages, Tools: roundTools})
 		if err != nil {
-			return "", fmt.Errorf("调用 LLM 失败: %w", err)
+			return nil, fmt.Errorf("调用 LLM 失败: %w", err)
 		}
 
 		if len(resp.Choices) == 0 {
-			return "", fmt.Errorf("LLM 未返回响应")
+			return nil, fmt.Errorf("LLM 未返回响应")
 		}
 
 		choice := resp.Choices[0]
 		assistantMsg := choice.Message
-		log.Printf("[轮次 %d] finish_reason=%s, tool_calls=%d",
-			i+1, choice.FinishReason, len(assistantMsg.ToolCalls))
+		prompt, completion := budget.record(messages, assistantMsg)
+		meter.add(resp.Usage, prompt, completion)
+		log.Printf("[轮次 %d] finish_reason=%s, tool_calls=%d, tokens=%d",
+			i+1, choice.FinishReason, len(assistantMsg.ToolCalls), meter.usage.TotalTokens)
 
 		// 添加 assistant 消息到历史
 		messages = append(messages, assistantMsg)
 
-		// 如果没有 tool_calls，说明 LLM 已经完成分析
+		// 没有 tool_calls 说明模型直接输出了文本，提醒它用 submit_review 提交；
+		// 多次提醒无效或预算已用完时把文本当作总结返回
 		if len(assistantMsg.ToolCalls) == 0 {
-			return assistantMsg.Content, nil
+			if reminders < maxSubmitReminders && !budget.usage.Exhausted {
+				reminders++
+				messages = append(messages, Message{Role: "user", Content: submitReviewReminder})
+				continue
+			}
+			// run_linter 的诊断仍然并入结果；没有诊断时原样返回模型的文本
+			result := newReviewResult(assistantMsg.Content, env.mergeDiagnostics(nil))
+			if len(result.Findings) == 0 {
+				result.Markdown = assistantMsg.Content
+			}
+			opts.finalize(round, budget, meter, result)
+			// 没有结构化结果时无法判断模型发现的严重程度，至少给出 warn
+			if result.Verdict != VerdictBlock {
+				result.Verdict = VerdictWarn
+			}
+			opts.emit(ReviewEvent{Type: EventFinal, Round: round, Content: result.Markdown, Result: result})
+			return result, nil
 		}
 
-		// 执行所有 tool calls
-		for _, tc := range assistantMsg.ToolCalls {
-			var args map[string]interface{}
-			json.Unmarshal([]byte(tc.Function.Arguments), &args)
-
-			log.Printf("执行工具: %s, 参数: %v", tc.Function.Name, args)
-
-			result, err := executeTool(tc.Function.Name, args)
-			if err != nil {
-				result = fmt.Sprintf("❌ 工具执行失败: %s\n错误详情: %v", tc.Function.Name, err)
-				log.Printf("工具执行失败: %s, 错误: %v", tc.Function.Name, err)
-			} else {
-				log.Printf("工具执行成功: %s", tc.Function.Name)
+		// 并发执行 tool calls，submit_review 在其余工具完成后处理
+		calls := assistantMsg.ToolCalls
+		results := make([]string, len(calls))
+		forEachParallel(len(calls), maxParallelTools, func(i int) {
+			if calls[i].Function.Name != submitReviewTool {
+				results[i] = runToolCall(ctx, opts, env, round, calls[i])
+			}
+		})
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("审查已取消: %w", err)
+		}
+		var report *ReviewReport
+		for i, tc := range calls {
+			if tc.Function.Name == submitReviewTool {
+				results[i], report = handleSubmitReview(opts, round, tc, report)
 			}
 
-			// 添加 tool 结果消息
+			// 按调用顺序添加 tool 结果消息
 			messages = append(messages, Message{
 				Role:       "tool",
-				Content:    result,
+				Content:    results[i],
 				ToolCallID: tc.ID,
 			})
 		}
+
+		if report != nil {
+			result := newReviewResult(report.Summary, env.mergeDiagnostics(report.Findings))
+			opts.finalize(round, budget, meter, result)
+			opts.emit(ReviewEvent{Type: EventFinal, Round: round, Content: result.Markdown, Result: result})
+			return result, nil
+		}
+	}
+
+	return nil, fmt.Errorf("达到最大循环次数")
+}
+
+// maxParallelTools 是同一轮中同时执行的工具调用数
+const maxParallelTools = 4
+
+// runToolCall 执行一次工具调用，失败或超时时把错误作为结果返回给模型
+func runToolCall(ctx context.Context, opts ReviewOptions, env *ToolEnv, round int, tc ToolCall) string {
+	var args map[string]interface{}
+	json.Unmarshal([]byte(tc.Function.Arguments), &args)
+
+	log.Printf("执行工具: %s, 参数: %v", tc.Function.Name, args)
+	opts.emit(ReviewEvent{
+		Type: EventToolStart, Round: round,
+		Tool: tc.Function.Name, ToolCallID: tc.ID, Arguments: tc.Function.Arguments,
+	})
+
+	start := time.Now()
+	timeout := env.Config.toolTimeout(tc.Function.Name)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type outcome struct {
+		result string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := executeTool(ctx, env, tc.Function.Name, args)
+		done <- outcome{result, err}
+	}()
+	var out outcome
+	select {
+	case out = <-done:
+	case <-ctx.Done():
+		// 工具都会响应 ctx；这里兜底，子进程等迟迟不退出时不再等待，结果直接丢弃
+		out.err = ctx.Err()
 	}
 
-	return "", fmt.Errorf("达到最大循环次数")
+	opts.emit(ReviewEvent{
+		Type: EventToolEnd, Round: round,
+		Tool: tc.Function.Name, ToolCallID: tc.ID, Arguments: tc.Function.Arguments,
+		Success: out.err == nil, DurationMs: time.Since(start).Milliseconds(),
+	})
+	switch {
+	case errors.Is(out.err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded:
+		log.Printf("工具执行超时: %s (%s)，可在 .ai-cr.yaml 的 tool_timeouts 中调整", tc.Function.Name, timeout)
+		return fmt.Sprintf("⏱️ 工具执行超时: %s 超过 %s 未完成，已终止。请缩小范围（如指定子目录、行号范围或更少的文件）后重试", tc.Function.Name, timeout)
+	case out.err != nil:
+		log.Printf("工具执行失败: %s, 错误: %v", tc.Function.Name, out.err)
+		return fmt.Sprintf("❌ 工具执行失败: %s\n错误详情: %v", tc.Function.Name, out.err)
+	}
+	log.Printf("工具执行成功: %s", tc.Function.Name)
+	return out.result
+}
+
+// forEachParallel 用最多 workers 个 goroutine 对 0..n-1 调用 fn，全部完成后返回
+func forEachParallel(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// handleSubmitReview 校验 submit_review 的参数；格式错误时返回错误说明让模型重试
+func handleSubmitReview(opts ReviewOptions, round int, tc ToolCall, prev *ReviewReport) (string, *ReviewReport) {
+	opts.emit(ReviewEvent{
+		Type: EventToolStart, Round: round,
+		Tool: tc.Function.Name, ToolCallID: tc.ID, Arguments: tc.Function.Arguments,
+	})
+	report, err := parseReviewReport(tc.Function.Arguments)
+	opts.emit(ReviewEvent{
+		Type: EventToolEnd, Round: round,
+		Tool: tc.Function.Name, ToolCallID: tc.ID, Success: err == nil,
+	})
+	if err != nil {
+		log.Printf("submit_review 格式错误: %v", err)
+		return fmt.Sprintf("❌ 审查结果格式错误，请修正后重新调用 submit_review:\n%v", err), prev
+	}
+	log.Printf("收到结构化审查结果: %d 个问题", len(report.Findings))
+	return "✅ 审查结果已提交", report
 }
 
 /* ===================== Gin Handler ===================== */
 
+// serverProvider / serverPolicy 是服务端默认配置，单次请求可以覆盖；
+// serverConfig 是启动时加载的 .ai-cr.yaml，serverWorkspace 是工作区根目录，请求不能修改；
+// serverBaseURLs 是请求可以指定的 base_url（--allow-base-url），为空时不允许请求自定义地址
+var (
+	serverProvider  ProviderConfig
+	serverPolicy    VerdictPolicy
+	serverConfig    *Config
+	serverWorkspace string
+	serverBaseURLs  []string
+)
+
+// reviewPayload 是 /api/review 的请求体
+type reviewPayload struct {
+	Request string `json:"request" binding:"required"`
+	// User / Repo 标识发起审查的用户和仓库，用于 /api/usage 统计，可为空。
+	// 服务端不做认证，这两个字段由客户端自报，不能作为计费依据
+	User string `json:"user"`
+	Repo string `json:"repo"`
+	ProviderConfig
+	VerdictPolicy
+}
+
+// options 合并服务端默认配置，生成本次审查的参数
+func (p reviewPayload) options() (ReviewOptions, error) {
+	policy := serverPolicy.override(p.VerdictPolicy)
+	if err := policy.validate(); err != nil {
+		return ReviewOptions{}, err
+	}
+	// 任意地址会让服务端替请求方访问内网（SSRF），每个地址还会各占一个熔断器
+	if p.BaseURL != "" && !containsBaseURL(serverBaseURLs, p.BaseURL) {
+		return ReviewOptions{}, fmt.Errorf("不允许指定 base_url %s（服务端可用 --allow-base-url 放行）", p.BaseURL)
+	}
+	provider, err := newProvider(serverProvider.override(p.ProviderConfig))
+	if err != nil {
+		return ReviewOptions{}, err
+	}
+	opts := ReviewOptions{Provider: provider, Policy: policy, Config: serverConfig, Workspace: serverWorkspace}
+	user, repo := strings.TrimSpace(p.User), strings.TrimSpace(p.Repo)
+	opts.OnUsage = func(usage ReviewUsage, err error) {
+		if usage.Requests == 0 {
+			return
+		}
+		usageLedger.Add(UsageRecord{
+			Time: time.Now(), User: user, Repo: repo,
+			Provider: provider.Name(), Model: provider.Model(),
+			Failed: err != nil, ReviewUsage: usage,
+		})
+	}
+	return opts, nil
+}
+
 func reviewHandlerGin(c *gin.Context) {
-	var payload struct {
-		Request string `json:"request" binding:"required"`
+	if !checkFormat(c) {
+		return
 	}
 
+	var payload reviewPayload
+
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Invalid request: " + err.Error(),
@@ -754,19 +1303,67 @@ func reviewHandlerGin(c *gin.Context) {
 		return
 	}
 
-	log.Printf("收到 Code Review 请求: %s", payload.Request)
-
-	result, err := codeReview(c.Request.Context(), payload.Request)
+	opts, err := payload.options()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"review": result,
-	})
+	log.Printf("收到 Code Review 请求 [%s/%s]: %s", opts.Provider.Name(), opts.Provider.Model(), payload.Request)
+
+	if err := jobs.wait(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": waitError(err),
+		})
+		return
+	}
+	defer jobs.release()
+
+	result, err := codeReview(c.Request.Context(), opts, payload.Request)
+	if err != nil {
+		status, retryAfter := errorStatus(err)
+		setRetryAfter(c.Writer.Header(), retryAfter)
+		c.JSON(status, gin.H{
+			"error":      err.Error(),
+			"error_type": apiErrorKind(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, formatResult(c.Query("format"), result))
+}
+
+// waitError 返回排队失败时给客户端的错误信息
+func waitError(err error) string {
+	if errors.Is(err, errQueueFull) {
+		return err.Error()
+	}
+	// 客户端在排队期间断开或超时，连接可能已不可写，仍尽量回复
+	return "等待并发名额时请求被取消: " + err.Error()
+}
+
+// outputFormats 是 API 和 CLI 支持的结果格式
+var outputFormats = map[string]bool{"": true, "text": true, "json": true, "sarif": true}
+
+// formatResult 按格式转换审查结果，sarif 输出 SARIF 2.1.0，其余输出原始结构
+func formatResult(format string, result *ReviewResult) interface{} {
+	if format == "sarif" {
+		return toSARIF(result)
+	}
+	return result
+}
+
+// checkFormat 在开始审查前校验 ?format= 参数
+func checkFormat(c *gin.Context) bool {
+	if format := c.Query("format"); !outputFormats[format] || format == "text" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "不支持的 format: " + format + "（可选: json, sarif）",
+		})
+		return false
+	}
+	return true
 }
 
 func healthHandler(c *gin.Context) {
@@ -778,26 +1375,36 @@ func healthHandler(c *gin.Context) {
 /* ===================== 原生 HTTP Handler (CLI 模式用) ===================== */
 
 func reviewHandler(w http.ResponseWriter, r *http.Request) {
-	var payload struct {
-		Request string `json:"request"`
-	}
+	var payload reviewPayload
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "Invalid request", 400)
 		return
 	}
 
+	opts, err := payload.options()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	log.Printf("收到 Code Review 请求: %s", payload.Request)
 
-	result, err := codeReview(r.Context(), payload.Request)
+	if err := jobs.wait(r.Context()); err != nil {
+		http.Error(w, waitError(err), http.StatusServiceUnavailable)
+		return
+	}
+	defer jobs.release()
+
+	result, err := codeReview(r.Context(), opts, payload.Request)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		status, retryAfter := errorStatus(err)
+		setRetryAfter(w.Header(), retryAfter)
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"review": result,
-	})
+	json.NewEncoder(w).Encode(formatResult(r.URL.Query().Get("format"), result))
 }
 
 func cors(next http.Handler) http.Handler {
@@ -818,61 +1425,219 @@ func health(w http.ResponseWriter, r *http.Request) {
 
 /* ===================== CLI 模式 ===================== */
 
+// review / diff 的退出码，hook 和 CI 可以据此判断结论
+const (
+	exitPass  = 0
+	exitError = 1
+	exitWarn  = 10
+	exitBlock = 20
+)
+
+var verdictExitCodes = map[string]int{
+	VerdictPass:  exitPass,
+	VerdictWarn:  exitWarn,
+	VerdictBlock: exitBlock,
+}
+
+func printUsage() {
+	fmt.Println("用法:")
+	fmt.Println("  ai-cr review [选项] <file>    - 审查指定文件")
+	fmt.Println("  ai-cr diff [选项]             - 审查 git diff")
+	fmt.Println("  ai-cr server [选项]           - 启动 HTTP 服务")
+	fmt.Println("")
+	fmt.Println("选项:")
+	fmt.Println("  --provider <name>             - LLM 后端: " + strings.Join(providerNames(), ", "))
+	fmt.Println("  --base-url <url>              - OpenAI 兼容接口地址")
+	fmt.Println("  --model <name>                - 模型名称")
+	fmt.Println("  --api-key <key>               - API Key（默认读取环境变量）")
+	fmt.Println("  --api <native|openai>         - 本地后端（ollama/llamacpp）的接口模式")
+	fmt.Println("  --record <file>               - 录制每轮请求/响应")
+	fmt.Println("  --replay <file>               - 回放录制文件，不访问网络")
+	fmt.Println("  --format <text|json|sarif>    - 输出格式，json 包含结构化问题列表，sarif 为 SARIF 2.1.0")
+	fmt.Println("  --block-on <severity>         - 达到该严重程度时结论为 block（默认 high）")
+	fmt.Println("  --warn-on <severity>          - 达到该严重程度时结论为 warn（默认 medium）")
+	fmt.Println("  --config <file>               - 项目配置文件（默认从审查路径向上查找 .ai-cr.yaml）")
+	fmt.Println("  --max-rounds <n>              - Agent 最大轮次（默认 100）")
+	fmt.Println("  --token-budget <n>            - 单次审查的 token 预算（估算值，默认 2000000）")
+	fmt.Println("  --workspace <dir>             - 工作区根目录，文件工具不能访问其外的路径（默认当前目录）")
+	fmt.Println("  --port <n>                    - server: 监听端口（默认 8083）")
+	fmt.Println("  --workers <n>                 - server: 同时运行的审查数量上限（默认 4）")
+	fmt.Println("  --max-queue <n>               - server: 异步任务排队上限（默认 100）")
+	fmt.Println("  --usage-log <file>            - server: 用量日志（JSON Lines），重启后恢复 /api/usage 的统计")
+	fmt.Println("")
+	fmt.Println("退出码: 0=pass, 1=审查失败, 10=warn, 20=block")
+}
+
 func runCLI() {
 	if len(os.Args) < 2 {
-		fmt.Println("用法:")
-		fmt.Println("  ai-cr review <file>           - 审查指定文件")
-		fmt.Println("  ai-cr diff                    - 审查 git diff")
-		fmt.Println("  ai-cr server                  - 启动 HTTP 服务")
+		printUsage()
 		os.Exit(1)
 	}
 
 	command := os.Args[1]
 	ctx := context.Background()
 
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	providerCfg := registerProviderFlags(fs)
+	var format string
+	fs.StringVar(&format, "format", "text", "输出格式: text, json, sarif")
+	// flags 中的字段覆盖 .ai-cr.yaml，零值表示未指定
+	var flags Config
+	fs.StringVar(&flags.Severity.BlockOn, "block-on", "", "达到该严重程度时结论为 block: "+strings.Join(severityOrder, ", ")+", none")
+	fs.StringVar(&flags.Severity.WarnOn, "warn-on", "", "达到该严重程度时结论为 warn")
+	fs.IntVar(&flags.MaxRounds, "max-rounds", 0, "Agent 最大轮次（默认 100）")
+	fs.IntVar(&flags.TokenBudget, "token-budget", 0, "单次审查的 token 预算（估算值，默认 2000000）")
+	var configPath, workspace string
+	fs.StringVar(&configPath, "config", "", "项目配置文件（默认从审查路径向上查找 .ai-cr.yaml）")
+	fs.StringVar(&workspace, "workspace", "", "工作区根目录，文件工具不能访问其外的路径（默认当前目录）")
+	var workers, maxQueue int
+	var usageLog, allowBaseURLs string
+	if command == "server" {
+		fs.StringVar(&allowBaseURLs, "allow-base-url", "", "允许 HTTP 请求指定的 base_url，逗号分隔（默认不允许）")
+		fs.IntVar(&workers, "workers", 4, "同时运行的审查数量上限")
+		fs.IntVar(&maxQueue, "max-queue", 100, "排队等待的审查上限（同步、流式和异步任务共用）")
+		fs.StringVar(&usageLog, "usage-log", "", "用量日志文件（JSON Lines），为空时只在内存中统计")
+		fs.IntVar(&flags.Port, "port", 0, "监听端口（默认 8083）")
+	}
+	fs.Parse(os.Args[2:])
+	if err := flags.Severity.validate(); err != nil {
+		log.Fatalf("❌ 错误: %v", err)
+	}
+	if !outputFormats[format] {
+		log.Fatalf("❌ 错误: 不支持的输出格式 %s（可选: text, json, sarif）", format)
+	}
+
+	// review 从被审查的文件向上查找配置，其余命令从工作区（默认当前目录）查找。
+	// server 只审查启动时指定的工作区，配置在启动时加载一次，对所有请求生效
+	start := fs.Arg(0)
+	if command != "review" {
+		start = workspace
+	}
+	cfg, err := loadConfig(start, configPath, &flags)
+	if err != nil {
+		log.Fatalf("❌ 错误: %v", err)
+	}
+	for _, source := range cfg.Sources {
+		log.Printf("📄 使用配置文件: %s", source)
+	}
+	policy := cfg.Severity
+
 	switch command {
 	case "review":
-		if len(os.Args) < 3 {
+		if fs.NArg() < 1 {
 			fmt.Println("请指定要审查的文件")
 			os.Exit(1)
 		}
-		filePath := os.Args[2]
+		filePath := fs.Arg(0)
 		request := fmt.Sprintf("请审查文件: %s", filePath)
 
-		fmt.Println("🔍 开始代码审查...")
-		result, err := codeReview(ctx, request)
-		if err != nil {
-			fmt.Printf("❌ 审查失败: %v\n", err)
-			os.Exit(1)
-		}
-		fmt.Println("\n📝 审查结果:")
-		fmt.Println(result)
+		fmt.Fprintln(os.Stderr, "🔍 开始代码审查...")
+		runCLIReview(ctx, ReviewOptions{Provider: mustProvider(*providerCfg), Policy: policy, Config: cfg, Workspace: workspace}, request, format)
 
 	case "diff":
 		request := "请审查当前的 git diff 变更"
-
-		fmt.Println("🔍 开始审查代码变更...")
-		result, err := codeReview(ctx, request)
-		if err != nil {
-			fmt.Printf("❌ 审查失败: %v\n", err)
-			os.Exit(1)
+		// 预先展开变更所在的函数，省去模型逐个 read_file 的轮次
+		if env, err := newToolEnv(cfg, workspace); err == nil {
+			if diff, err := diffWithContext(ctx, env, gitDiffSpec{}); err == nil && diff != "" {
+				request += "\n\n以下是相对 HEAD 的变更，每个 hunk 后附有新版本中所在代码块的完整源码：\n\n" + diff
+			}
 		}
-		fmt.Println("\n📝 审查结果:")
-		fmt.Println(result)
+
+		fmt.Fprintln(os.Stderr, "🔍 开始审查代码变更...")
+		runCLIReview(ctx, ReviewOptions{Provider: mustProvider(*providerCfg), Policy: policy, Config: cfg, Workspace: workspace}, request, format)
 
 	case "server":
+		// 录制文件按单次审查设计，服务端并发请求会互相截断、交错写入
+		if providerCfg.Record != "" || providerCfg.Replay != "" {
+			log.Fatalf("❌ 错误: server 模式不支持 --record / --replay，请在 review 命令中使用")
+		}
+		serverProvider = providerCfg.withEnv()
+		if _, err := newProvider(serverProvider); err != nil {
+			log.Fatalf("❌ 错误: %v", err)
+		}
+		serverPolicy = policy
+		serverConfig = cfg
+		env, err := newToolEnv(cfg, workspace)
+		if err != nil {
+			log.Fatalf("❌ 错误: %v", err)
+		}
+		serverWorkspace = env.Root
+		for _, u := range strings.Split(allowBaseURLs, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				serverBaseURLs = append(serverBaseURLs, u)
+			}
+		}
+		jobs = newJobManager(workers, maxQueue)
+		if usageLedger, err = newUsageLedger(usageLog); err != nil {
+			log.Fatalf("❌ 错误: %v", err)
+		}
 		startServer()
 
 	default:
 		fmt.Printf("未知命令: %s\n", command)
+		printUsage()
 		os.Exit(1)
 	}
 }
 
+// runCLIReview 执行审查并实时渲染事件流，按结论退出；
+// format 为 json / sarif 时进度输出到 stderr，stdout 只输出结果
+func runCLIReview(ctx context.Context, opts ReviewOptions, request, format string) {
+	progress := io.Writer(os.Stdout)
+	if format != "text" {
+		progress = os.Stderr
+	}
+	renderer := &cliRenderer{out: progress}
+	opts.OnEvent = renderer.render
+	result, err := codeReview(ctx, opts, request)
+	if err != nil {
+		fmt.Fprintf(progress, "\n❌ 审查失败: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	switch format {
+	case "json", "sarif":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(formatResult(format, result))
+	default:
+		fmt.Println("\n📝 审查结果:")
+		fmt.Println(result.Markdown)
+		fmt.Printf("\n🚦 结论: %s\n", result.Verdict)
+		fmt.Printf("💰 用量: %s\n", result.Usage)
+	}
+	os.Exit(verdictExitCodes[result.Verdict])
+}
+
+// mustProvider 创建 CLI 使用的 Provider，失败时直接退出
+func mustProvider(cfg ProviderConfig) Provider {
+	provider, err := newProvider(cfg.withEnv())
+	if err != nil {
+		log.Fatalf("❌ 错误: %v", err)
+	}
+	return provider
+}
+
 func startServer() {
 	// 设置 Gin 模式
 	gin.SetMode(gin.ReleaseMode)
 
+	r := newRouter()
+
+	addr := fmt.Sprintf(":%d", serverConfig.Port)
+	log.Printf("🚀 AI Code Review 服务启动 %s (provider=%s)", addr, serverProvider.Provider)
+	log.Println("📌 POST /api/review {\"request\": \"请审查 main.go\"}")
+	log.Println("📌 POST /api/review/stream（SSE 实时输出）")
+	log.Println("📌 POST /api/reviews（异步任务）, GET/DELETE /api/reviews/:id")
+	log.Println("📌 GET /api/usage?group_by=user,repo（按用户、仓库统计 token 用量和费用）")
+
+	if err := r.Run(addr); err != nil {
+		log.Fatalf("服务启动失败: %v", err)
+	}
+}
+
+// newRouter 注册所有路由和中间件
+func newRouter() *gin.Engine {
 	r := gin.Default()
 
 	// CORS 中间件
@@ -892,13 +1657,13 @@ func startServer() {
 	// 路由
 	r.GET("/health", healthHandler)
 	r.POST("/api/review", reviewHandlerGin)
+	r.POST("/api/review/stream", reviewStreamHandler)
+	r.POST("/api/reviews", createJobHandler)
+	r.GET("/api/reviews/:id", getJobHandler)
+	r.DELETE("/api/reviews/:id", cancelJobHandler)
+	r.GET("/api/usage", usageHandler)
 
-	log.Println("🚀 AI Code Review 服务启动 :8083")
-	log.Println("📌 POST /api/review {\"request\": \"请审查 main.go\"}")
-
-	if err := r.Run(":8083"); err != nil {
-		log.Fatalf("服务启动失败: %v", err)
-	}
+	return r
 }
 
 /* ===================== main ===================== */
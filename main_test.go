@@ -0,0 +1,892 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mockSubmit 构造一条调用 submit_review 的 assistant 消息
+func mockSubmit(summary string, findings ...Finding) Message {
+	if findings == nil {
+		findings = []Finding{}
+	}
+	args, _ := json.Marshal(ReviewReport{Summary: summary, Findings: findings})
+	return Message{ToolCalls: []ToolCall{mockToolCall("call_submit", submitReviewTool, string(args))}}
+}
+
+func TestCodeReviewAgentLoop(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "hello.go", "package hello\n\nfunc Hello() {}\n")
+
+	args, _ := json.Marshal(map[string]string{"file_path": path})
+	mock := NewMockProvider(
+		Message{ToolCalls: []ToolCall{mockToolCall("call_1", "read_file", string(args))}},
+		mockSubmit("没有问题"),
+	)
+
+	result, err := codeReview(context.Background(), ReviewOptions{Provider: mock, Workspace: dir}, "请审查 hello.go")
+	if err != nil {
+		t.Fatalf("codeReview: %v", err)
+	}
+	if result.Summary != "没有问题" || len(result.Findings) != 0 {
+		t.Errorf("result = %+v", result)
+	}
+	if !strings.Contains(result.Markdown, "未发现问题") {
+		t.Errorf("markdown = %q", result.Markdown)
+	}
+
+	if len(mock.Requests) != 2 {
+		t.Fatalf("rounds = %d, want 2", len(mock.Requests))
+	}
+	if len(mock.Requests[0].Tools) != len(tools) {
+		t.Errorf("tools not sent to provider")
+	}
+	msgs := mock.Requests[1].Messages
+	last := msgs[len(msgs)-1]
+	if last.Role != "tool" || last.ToolCallID != "call_1" {
+		t.Fatalf("last message = %+v, want tool result for call_1", last)
+	}
+	if !strings.Contains(last.Content, "func Hello()") {
+		t.Errorf("tool result missing file content: %q", last.Content)
+	}
+}
+
+func TestCodeReviewToolErrorIsReportedToModel(t *testing.T) {
+	mock := NewMockProvider(
+		Message{ToolCalls: []ToolCall{mockToolCall("call_1", "no_such_tool", "{}")}},
+		mockSubmit("done"),
+	)
+
+	if _, err := codeReview(context.Background(), ReviewOptions{Provider: mock}, "review"); err != nil {
+		t.Fatalf("codeReview: %v", err)
+	}
+	msgs := mock.Requests[1].Messages
+	if got := msgs[len(msgs)-1].Content; !strings.Contains(got, "unknown tool") {
+		t.Errorf("tool error not reported: %q", got)
+	}
+}
+
+func TestCodeReviewSubmitReviewRetry(t *testing.T) {
+	bad := `{"summary": "x", "findings": [{"file": "a.go", "severity": "severe", "category": "bug", "message": "m"}]}`
+	mock := NewMockProvider(
+		Message{ToolCalls: []ToolCall{mockToolCall("call_1", submitReviewTool, bad)}},
+		mockSubmit("ok", Finding{File: "a.go", StartLine: 1, Severity: SeverityHigh, Category: CategoryBug, Message: "m"}),
+	)
+
+	result, err := codeReview(context.Background(), ReviewOptions{Provider: mock}, "review")
+	if err != nil {
+		t.Fatalf("codeReview: %v", err)
+	}
+	if len(result.Findings) != 1 || result.Findings[0].Severity != SeverityHigh {
+		t.Errorf("findings = %+v", result.Findings)
+	}
+	msgs := mock.Requests[1].Messages
+	if got := msgs[len(msgs)-1].Content; !strings.Contains(got, "findings[0].severity") {
+		t.Errorf("schema error not reported: %q", got)
+	}
+}
+
+func TestCodeReviewPlainTextFallback(t *testing.T) {
+	mock := NewMockProvider(
+		Message{Content: "看起来没问题"},
+		Message{Content: "看起来没问题"},
+		Message{Content: "看起来没问题"},
+	)
+
+	result, err := codeReview(context.Background(), ReviewOptions{Provider: mock}, "review")
+	if err != nil {
+		t.Fatalf("codeReview: %v", err)
+	}
+	if result.Markdown != "看起来没问题" || len(mock.Requests) != maxSubmitReminders+1 {
+		t.Errorf("result = %+v, rounds = %d", result, len(mock.Requests))
+	}
+}
+
+func TestCodeReviewProviderError(t *testing.T) {
+	if _, err := codeReview(context.Background(), ReviewOptions{Provider: NewMockProvider()}, "review"); err == nil {
+		t.Fatal("expected error when provider fails")
+	}
+}
+
+func TestCodeReviewParallelToolCalls(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 12; i++ {
+		writeTestFile(t, dir, fmt.Sprintf("f%02d.go", i), fmt.Sprintf("package p // file %02d\n", i))
+	}
+	var calls []ToolCall
+	for i := 0; i < 8; i++ {
+		calls = append(calls, mockToolCall(fmt.Sprintf("call_%d", i), "read_file", fmt.Sprintf(`{"file_path": "f%02d.go"}`, i)))
+	}
+	var paths []string
+	for i := 11; i >= 0; i-- {
+		paths = append(paths, fmt.Sprintf("f%02d.go", i))
+	}
+	multi, _ := json.Marshal(map[string]interface{}{"file_paths": paths})
+	calls = append(calls, mockToolCall("call_multi", "read_multiple_files", string(multi)))
+	mock := NewMockProvider(Message{ToolCalls: calls}, mockSubmit("done"))
+
+	if _, err := codeReview(context.Background(), ReviewOptions{Provider: mock, Workspace: dir}, "review"); err != nil {
+		t.Fatalf("codeReview: %v", err)
+	}
+	msgs := mock.Requests[1].Messages
+	results := msgs[len(msgs)-len(calls):]
+	for i, m := range results[:8] {
+		if m.ToolCallID != calls[i].ID || !strings.Contains(m.Content, fmt.Sprintf("file %02d", i)) {
+			t.Errorf("result %d = %s %q", i, m.ToolCallID, m.Content)
+		}
+	}
+	// read_multiple_files 按传入顺序输出，超过 10 个截断
+	got := results[8].Content
+	if strings.Index(got, "file 11") > strings.Index(got, "file 10") || strings.Contains(got, "file 01") ||
+		!strings.Contains(got, "超过10个文件，已截断") {
+		t.Errorf("read_multiple_files:\n%s", got)
+	}
+}
+
+func TestRunToolCallTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	cfg := defaultConfig()
+	cfg.BuildCommand = []string{"sleep", "30"}
+	cfg.ToolTimeouts = map[string]int{"run_build": 1}
+	env, err := newToolEnv(cfg, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	got := runToolCall(context.Background(), ReviewOptions{}, env, 1, mockToolCall("call_1", "run_build", "{}"))
+	if !strings.Contains(got, "工具执行超时: run_build 超过 1s") {
+		t.Errorf("result = %q", got)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("timeout took %s", elapsed)
+	}
+
+	// 审查被取消时工具立即返回
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := runToolCall(ctx, ReviewOptions{}, env, 1, mockToolCall("call_2", "list_files", `{"recursive": true}`)); !strings.Contains(got, "context canceled") {
+		t.Errorf("canceled result = %q", got)
+	}
+}
+
+func TestForEachParallel(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	done := make([]bool, 20)
+	forEachParallel(len(done), 3, func(i int) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		done[i] = true
+		mu.Unlock()
+	})
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("item %d not processed", i)
+		}
+	}
+	if peak > 3 || peak < 2 {
+		t.Errorf("peak concurrency = %d, want 2..3", peak)
+	}
+	forEachParallel(0, 3, func(int) { t.Error("called for empty input") })
+}
+
+func TestExecuteTool(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\n// TODO: fix\n")
+	writeTestFile(t, dir, "b.txt", "hello\n")
+
+	tests := []struct {
+		name    string
+		tool    string
+		args    map[string]interface{}
+		want    string
+		wantErr bool
+	}{
+		{"working directory", "get_working_directory", nil, "当前工作目录", false},
+		{"read file", "read_file", map[string]interface{}{"file_path": filepath.Join(dir, "a.go")}, "package a", false},
+		{"read file missing arg", "read_file", map[string]interface{}{}, "", true},
+		{"read multiple files bad arg", "read_multiple_files", map[string]interface{}{"file_paths": "a.go"}, "", true},
+		{"list files", "list_files", map[string]interface{}{"directory": dir, "pattern": "*.go"}, "a.go", false},
+		{"search", "search_in_files", map[string]interface{}{"directory": dir, "pattern": "TODO"}, "L2: // TODO: fix", false},
+		{"analyze", "analyze_directory", map[string]interface{}{"directory": dir}, "文件总数: 2", false},
+		{"unknown", "nope", nil, "", true},
+	}
+
+	env, err := newToolEnv(defaultConfig(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := executeTool(context.Background(), env, tt.tool, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("result = %q, want substring %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFilesPathPattern(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "main.go", "package main\n")
+	for _, sub := range []string{"cmd", filepath.Join("cmd", "tool")} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Join(dir, sub), "run.go", "package main\n")
+	}
+	env, err := newToolEnv(defaultConfig(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recursive := range []bool{false, true} {
+		got, err := listFiles(context.Background(), env, ".", "cmd/*.go", walkOptions{Recursive: recursive})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// * 不跨目录，cmd/tool/run.go 和 main.go 都不匹配
+		if !strings.Contains(got, "找到 1 个文件") || !strings.Contains(got, filepath.Join("cmd", "run.go")) {
+			t.Errorf("recursive=%v:\n%s", recursive, got)
+		}
+	}
+	got, _ := listFiles(context.Background(), env, "cmd", "tool/*.go", walkOptions{})
+	if !strings.Contains(got, filepath.Join("cmd", "tool", "run.go")) {
+		t.Errorf("relative to directory:\n%s", got)
+	}
+	got, _ = listFiles(context.Background(), env, ".", "*.go", walkOptions{})
+	if !strings.Contains(got, "找到 1 个文件") || !strings.Contains(got, "main.go") {
+		t.Errorf("base name pattern:\n%s", got)
+	}
+}
+
+func TestReadFileRange(t *testing.T) {
+	dir := t.TempDir()
+	var content strings.Builder
+	for i := 1; i <= 50; i++ {
+		content.WriteString(fmt.Sprintf("// 第 %d 行注释\n", i))
+	}
+	writeTestFile(t, dir, "big.go", content.String())
+	writeTestFile(t, dir, "long.go", strings.Repeat("中", 100)+"\n")
+	writeTestFile(t, dir, "empty.go", "")
+
+	cfg := defaultConfig()
+	cfg.ReadFileMaxBytes = 200
+	env, err := newToolEnv(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    map[string]interface{}
+		want    []string
+		notWant []string
+		wantErr bool
+	}{
+		{
+			name:    "paginates at byte budget",
+			args:    map[string]interface{}{"file_path": "big.go"},
+			want:    []string{"(第 1-", "共 50 行", "     1\t// 第 1 行注释", "继续读取请使用 start_line="},
+			notWant: []string{"第 50 行注释"},
+		},
+		{
+			name:    "line range",
+			args:    map[string]interface{}{"file_path": "big.go", "start_line": float64(10), "end_line": float64(12)},
+			want:    []string{"(第 10-12 行，共 50 行)", "    10\t// 第 10 行注释", "    12\t// 第 12 行注释", "之后还有 38 行，继续读取请使用 start_line=13"},
+			notWant: []string{"第 9 行注释", "第 13 行注释"},
+		},
+		{
+			name: "offset and limit",
+			args: map[string]interface{}{"file_path": "big.go", "offset": float64(48), "limit": float64(5)},
+			want: []string{"(第 49-50 行，共 50 行)", "    50\t// 第 50 行注释"},
+		},
+		{
+			name: "long line cut on rune boundary",
+			args: map[string]interface{}{"file_path": "long.go"},
+			want: []string{"该行过长，已截断"},
+		},
+		{
+			name: "empty file",
+			args: map[string]interface{}{"file_path": "empty.go"},
+			want: []string{"空文件"},
+		},
+		{
+			name:    "start beyond end of file",
+			args:    map[string]interface{}{"file_path": "big.go", "start_line": float64(51)},
+			wantErr: true,
+		},
+		{
+			name:    "inverted range",
+			args:    map[string]interface{}{"file_path": "big.go", "start_line": float64(5), "end_line": float64(3)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := executeTool(context.Background(), env, "read_file", tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("output is not valid UTF-8: %q", got)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("result missing %q:\n%s", w, got)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("result contains %q:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	script := []Message{
+		{ToolCalls: []ToolCall{mockToolCall("call_1", "get_working_directory", "{}")}},
+		mockSubmit("LGTM"),
+	}
+
+	recorder, err := newRecordingProvider(NewMockProvider(script...), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := codeReview(context.Background(), ReviewOptions{Provider: recorder}, "review")
+	if err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	replay, err := newReplayProvider(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := codeReview(context.Background(), ReviewOptions{Provider: replay}, "review")
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if got.Markdown != want.Markdown {
+		t.Errorf("replay = %q, want %q", got.Markdown, want.Markdown)
+	}
+
+	replay, _ = newReplayProvider(path, true)
+	if _, err := codeReview(context.Background(), ReviewOptions{Provider: replay}, "another request"); err == nil {
+		t.Error("strict replay should reject a different request")
+	}
+}
+
+func TestParseTextToolCalls(t *testing.T) {
+	content := "先读文件\n```json\n{\"name\": \"read_file\", \"arguments\": {\"file_path\": \"a.go\"}}\n```"
+	rest, calls := parseTextToolCalls(content, tools)
+	if len(calls) != 1 || calls[0].Function.Name != "read_file" {
+		t.Fatalf("calls = %+v", calls)
+	}
+	if calls[0].Function.Arguments != `{"file_path":"a.go"}` {
+		t.Errorf("arguments = %s", calls[0].Function.Arguments)
+	}
+	if rest != "先读文件" {
+		t.Errorf("rest = %q", rest)
+	}
+	// 每次解析生成的 ID 都不同，不会和之前轮次的调用冲突
+	if _, again := parseTextToolCalls(content, tools); again[0].ID == calls[0].ID {
+		t.Errorf("duplicate tool call ID %s", calls[0].ID)
+	}
+
+	if _, calls := parseTextToolCalls(`cfg := {"name": "rm_rf"}`, tools); len(calls) != 0 {
+		t.Errorf("unknown tool parsed: %+v", calls)
+	}
+}
+
+func setupMockServer(t *testing.T, responses ...Message) *MockProvider {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	mock := NewMockProvider(responses...)
+	providerFactories["mock"] = func(ProviderConfig) (Provider, error) { return mock, nil }
+	t.Cleanup(func() { delete(providerFactories, "mock") })
+	return mock
+}
+
+func TestReviewHandlerGin(t *testing.T) {
+	setupMockServer(t, mockSubmit("没有发现问题", Finding{
+		File: "main.go", StartLine: 3, Severity: SeverityLow, Category: CategoryQuality, Message: "命名不清晰",
+	}))
+	r := newRouter()
+
+	body := `{"request": "请审查 main.go", "provider": "mock"}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/review", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp ReviewResult
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Summary != "没有发现问题" || len(resp.Findings) != 1 {
+		t.Errorf("resp = %+v", resp)
+	}
+	if !strings.Contains(resp.Markdown, "main.go:3") {
+		t.Errorf("review = %q", resp.Markdown)
+	}
+}
+
+func TestReviewHandlerGinBadRequest(t *testing.T) {
+	setupMockServer(t)
+	r := newRouter()
+
+	for _, body := range []string{
+		`{}`,
+		`{"request": "x", "provider": "unknown"}`,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/review", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("body %s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ok") {
+		t.Errorf("health = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReviewStreamHandler(t *testing.T) {
+	setupMockServer(t,
+		Message{ToolCalls: []ToolCall{mockToolCall("call_1", "get_working_directory", "{}")}},
+		mockSubmit("LGTM"),
+	)
+	r := newRouter()
+
+	body := `{"request": "review", "provider": "mock"}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/review/stream", strings.NewReader(body)))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	out := w.Body.String()
+	for _, want := range []string{"event:round_start", "event:tool_start", "event:tool_end", "event:final", `"summary":"LGTM"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stream missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestReviewPayloadBaseURL(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer srv.Close()
+
+	oldProvider, oldURLs := serverProvider, serverBaseURLs
+	t.Cleanup(func() { serverProvider, serverBaseURLs = oldProvider, oldURLs })
+	serverProvider = ProviderConfig{Provider: "openai", BaseURL: "https://api.openai.com/v1", Model: "gpt-4o", APIKey: "server-key"}
+	serverBaseURLs = nil
+
+	payload := reviewPayload{Request: "review", ProviderConfig: ProviderConfig{BaseURL: "http://169.254.169.254/latest"}}
+	if _, err := payload.options(); err == nil || !strings.Contains(err.Error(), "--allow-base-url") {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 放行的地址也不能带上服务端的密钥
+	serverBaseURLs = []string{srv.URL + "/"}
+	for _, p := range []ProviderConfig{{BaseURL: srv.URL}, {Provider: "deepseek", BaseURL: srv.URL, APIKey: "client-key"}} {
+		payload.ProviderConfig = p
+		opts, err := payload.options()
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth = ""
+		opts.Provider.Chat(context.Background(), ChatRequest{})
+		if want := "Bearer " + p.APIKey; p.APIKey != "" && auth != want || strings.Contains(auth, "server-key") {
+			t.Errorf("%+v: Authorization = %q", p, auth)
+		}
+	}
+}
+
+func TestOpenAIProviderChatStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Error("stream_options.include_usage not set")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"choices":[{"index":0,"delta":{"role":"assistant","content":"看一下"}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"read_file","arguments":"{\"file_"}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"path\":\"a.go\"}"}}]},"finish_reason":"tool_calls"}]}`,
+			`{"choices":[],"usage":{"prompt_tokens":120,"completion_tokens":30,"total_tokens":150,"prompt_cache_hit_tokens":64}}`,
+			`[DONE]`,
+		} {
+			w.Write([]byte("data: " + chunk + "\n\n"))
+		}
+	}))
+	defer srv.Close()
+
+	p, err := newOpenAIProvider(ProviderConfig{BaseURL: srv.URL, Model: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deltas []string
+	resp, err := p.(StreamingProvider).ChatStream(context.Background(), ChatRequest{}, func(s string) {
+		deltas = append(deltas, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	choice := resp.Choices[0]
+	if choice.Message.Content != "看一下" || len(deltas) != 1 {
+		t.Errorf("content = %q, deltas = %v", choice.Message.Content, deltas)
+	}
+	if choice.FinishReason != "tool_calls" || len(choice.Message.ToolCalls) != 1 {
+		t.Fatalf("choice = %+v", choice)
+	}
+	if got := choice.Message.ToolCalls[0].Function.Arguments; got != `{"file_path":"a.go"}` {
+		t.Errorf("arguments = %s", got)
+	}
+	if resp.Usage == nil || resp.Usage.PromptTokens != 120 || resp.Usage.cachedTokens() != 64 {
+		t.Errorf("usage = %+v", resp.Usage)
+	}
+}
+
+func TestOpenAIProviderChatStreamWithoutStreamOptions(t *testing.T) {
+	var withOptions, without int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.StreamOptions != nil {
+			withOptions++
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Unrecognized request argument supplied: stream_options","type":"invalid_request_error"}}`))
+			return
+		}
+		without++
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"ok\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	p, err := newOpenAIProvider(ProviderConfig{BaseURL: srv.URL, Model: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一次 400 后去掉 stream_options 重试，之后的请求直接不带
+	for i := 0; i < 2; i++ {
+		resp, err := p.(StreamingProvider).ChatStream(context.Background(), ChatRequest{}, func(string) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Choices[0].Message.Content != "ok" || resp.Usage != nil {
+			t.Errorf("resp = %+v", resp)
+		}
+	}
+	if withOptions != 1 || without != 2 {
+		t.Errorf("requests with stream_options = %d, without = %d", withOptions, without)
+	}
+}
+
+func waitJob(t *testing.T, r http.Handler, id string) ReviewJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/reviews/"+id, nil))
+		var job ReviewJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.finished() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return ReviewJob{}
+}
+
+func TestReviewJobLifecycle(t *testing.T) {
+	setupMockServer(t,
+		Message{ToolCalls: []ToolCall{mockToolCall("call_1", "get_working_directory", "{}")}},
+		mockSubmit("LGTM"),
+	)
+	r := newRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/reviews",
+		strings.NewReader(`{"request": "review", "provider": "mock"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var created ReviewJob
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	job := waitJob(t, r, created.ID)
+	if job.Status != JobSucceeded || job.Result == nil || job.Result.Summary != "LGTM" {
+		t.Errorf("job = %+v", job)
+	}
+	if job.Rounds != 2 || job.ToolCalls != 1 {
+		t.Errorf("rounds = %d, tool_calls = %d", job.Rounds, job.ToolCalls)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/reviews/"+created.ID, nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("cancel finished job: status = %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/reviews/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status = %d", w.Code)
+	}
+}
+
+// blockingProvider 一直阻塞到 ctx 被取消
+type blockingProvider struct{ started chan struct{} }
+
+func (p *blockingProvider) Name() string  { return "blocking" }
+func (p *blockingProvider) Model() string { return "blocking" }
+func (p *blockingProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	close(p.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestReviewJobCancel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	provider := &blockingProvider{started: make(chan struct{})}
+	providerFactories["blocking"] = func(ProviderConfig) (Provider, error) { return provider, nil }
+	t.Cleanup(func() { delete(providerFactories, "blocking") })
+	r := newRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/reviews",
+		strings.NewReader(`{"request": "review", "provider": "blocking"}`)))
+	var created ReviewJob
+	json.Unmarshal(w.Body.Bytes(), &created)
+	<-provider.started
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/reviews/"+created.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if job := waitJob(t, r, created.ID); job.Status != JobCanceled {
+		t.Errorf("status = %s, want canceled", job.Status)
+	}
+}
+
+// unwindingProvider 在取消后等待 release 关闭才返回，模拟退出较慢的审查
+type unwindingProvider struct{ started, release chan struct{} }
+
+func (p *unwindingProvider) Name() string  { return "unwinding" }
+func (p *unwindingProvider) Model() string { return "unwinding" }
+func (p *unwindingProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	close(p.started)
+	<-ctx.Done()
+	<-p.release
+	return nil, ctx.Err()
+}
+
+func TestJobManagerSubmitWhileCanceling(t *testing.T) {
+	m := newJobManager(2, 10)
+	slow := &unwindingProvider{started: make(chan struct{}), release: make(chan struct{})}
+	job, err := m.Submit(ReviewOptions{Provider: slow}, "review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-slow.started
+	if _, err := m.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 被取消的任务尚未退出时，提交新任务会清理过期任务，不能因 FinishedAt 为空而 panic
+	if got, _ := m.Get(job.ID); got.finished() || got.FinishedAt != nil {
+		t.Errorf("job finished before unwinding: %+v", got)
+	}
+	if _, err := m.Submit(ReviewOptions{Provider: NewMockProvider(mockSubmit("ok"))}, "review"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(slow.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := m.Get(job.ID)
+		if got.finished() {
+			if got.Status != JobCanceled || got.FinishedAt == nil {
+				t.Errorf("job = %+v", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyncReviewQueueLimit(t *testing.T) {
+	setupMockServer(t, mockSubmit("ok"))
+	saved := jobs
+	jobs = newJobManager(1, 1)
+	t.Cleanup(func() { jobs = saved })
+	r := newRouter()
+	post := func(ctx context.Context, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"request": "review", "provider": "mock"}`))
+		r.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+
+	// 占满唯一的并发名额，第一个同步请求进入排队
+	if err := jobs.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan *httptest.ResponseRecorder)
+	go func() { waiting <- post(context.Background(), "/api/review") }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jobs.mu.Lock()
+		queued := jobs.queued
+		jobs.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 排队已满：同步接口、SSE 接口和异步任务都立即返回 503
+	for _, path := range []string{"/api/review", "/api/review/stream"} {
+		if w := post(context.Background(), path); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "排队任务已达上限") {
+			t.Errorf("%s: status = %d, body = %s", path, w.Code, w.Body.String())
+		}
+	}
+	if _, err := jobs.Submit(ReviewOptions{Provider: NewMockProvider()}, "review"); !errors.Is(err, errQueueFull) {
+		t.Errorf("Submit err = %v", err)
+	}
+
+	jobs.release()
+	if w := <-waiting; w.Code != http.StatusOK {
+		t.Errorf("queued request: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// 排队期间客户端断开也会收到错误响应，而不是空响应
+	if err := jobs.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer jobs.release()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if w := post(ctx, "/api/review"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "请求被取消") {
+		t.Errorf("canceled: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReviewHandlerSARIF(t *testing.T) {
+	setupMockServer(t, mockSubmit("发现问题", Finding{
+		File: "controller/login.go", StartLine: 177, EndLine: 180,
+		Severity: SeverityHigh, Category: CategorySecurity, Message: "泄露错误信息", Suggestion: "使用错误码",
+	}))
+	r := newRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/review?format=sarif",
+		strings.NewReader(`{"request": "review", "provider": "mock"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var log sarifLog
+	if err := json.Unmarshal(w.Body.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("log = %+v", log)
+	}
+	run := log.Runs[0]
+	if run.Tool.Driver.Properties["provider"] != "mock" || len(run.Tool.Driver.Rules) != len(categoryOrder)-1+len(severityOrder) {
+		t.Errorf("driver = %+v", run.Tool.Driver)
+	}
+	if len(run.Results) != 1 {
+		t.Fatalf("results = %+v", run.Results)
+	}
+	res := run.Results[0]
+	loc := res.Locations[0].PhysicalLocation
+	rule := run.Tool.Driver.Rules[res.RuleIndex]
+	if res.RuleID != "ai-cr/security/high" || res.Level != "error" || rule.ID != res.RuleID || res.Properties["security-severity"] != nil {
+		t.Errorf("result = %+v", res)
+	}
+	// GitHub 从规则上读取 security-severity
+	if rule.Properties["security-severity"] != "8.0" || rule.Name != "SecurityHigh" {
+		t.Errorf("rule = %+v", rule)
+	}
+	if loc.ArtifactLocation.URI != "controller/login.go" || loc.Region.StartLine != 177 || loc.Region.EndLine != 180 {
+		t.Errorf("location = %+v", loc)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/review?format=xml",
+		strings.NewReader(`{"request": "review", "provider": "mock"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status = %d", w.Code)
+	}
+
+	// 流式接口不转换格式，明确拒绝而不是忽略
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/review/stream?format=sarif",
+		strings.NewReader(`{"request": "review", "provider": "mock"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "/api/review") {
+		t.Errorf("stream format: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
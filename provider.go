@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* ===================== LLM Provider ===================== */
+
+const (
+	deepseekBaseURL = "https://api.deepseek.com/v1"
+	deepseekModel   = "deepseek-chat"
+)
+
+// Provider 是支持 tool calling 的对话模型后端，codeReview 只依赖这个接口
+type Provider interface {
+	// Name 返回后端名称，如 deepseek、openai
+	Name() string
+	// Model 返回实际使用的模型名
+	Model() string
+	// Chat 发送一轮对话（可带 tools），返回模型响应
+	Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error)
+}
+
+// ProviderConfig 描述要使用的 Provider，CLI 参数和 HTTP 请求共用
+type ProviderConfig struct {
+	Provider string `json:"provider,omitempty"`
+	BaseURL  string `json:"base_url,omitempty"`
+	Model    string `json:"model,omitempty"`
+	APIKey   string `json:"api_key,omitempty"`
+	// API 是本地后端的接口模式: native 或 openai
+	API string `json:"api,omitempty"`
+
+	// Record / Replay 是录制和回放文件路径，只能通过 CLI 参数设置
+	Record string `json:"-"`
+	Replay string `json:"-"`
+}
+
+type providerFactory func(cfg ProviderConfig) (Provider, error)
+
+// providerFactories 按名称注册所有可选的 Provider
+var providerFactories = map[string]providerFactory{
+	"deepseek": newDeepSeekProvider,
+	"openai":   newOpenAIProvider,
+}
+
+// newProvider 根据配置创建 Provider，未指定时默认 deepseek
+func newProvider(cfg ProviderConfig) (Provider, error) {
+	if cfg.Replay != "" {
+		return newReplayProvider(cfg.Replay, false)
+	}
+
+	name := cfg.Provider
+	if name == "" {
+		name = "deepseek"
+	}
+	factory, ok := providerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("未知的 provider: %s（可选: %s）", name, strings.Join(providerNames(), ", "))
+	}
+	provider, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Record != "" {
+		return newRecordingProvider(provider, cfg.Record)
+	}
+	return provider, nil
+}
+
+func providerNames() []string {
+	names := make([]string, 0, len(providerFactories))
+	for name := range providerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withEnv 用环境变量补全未显式指定的字段
+func (c ProviderConfig) withEnv() ProviderConfig {
+	if c.Provider == "" {
+		c.Provider = os.Getenv("AI_CR_PROVIDER")
+	}
+	if c.Provider == "" {
+		c.Provider = "deepseek"
+	}
+	if c.Model == "" {
+		c.Model = os.Getenv("AI_CR_MODEL")
+	}
+	if c.BaseURL == "" {
+		c.BaseURL = os.Getenv("AI_CR_BASE_URL")
+	}
+	if c.APIKey == "" {
+		c.APIKey = os.Getenv("AI_CR_API_KEY")
+	}
+	if c.APIKey == "" {
+		switch c.Provider {
+		case "deepseek":
+			c.APIKey = os.Getenv("DEEPSEEK_API_KEY")
+		case "openai":
+			c.APIKey = os.Getenv("OPENAI_API_KEY")
+		}
+	}
+	return c
+}
+
+// override 用单次请求里的字段覆盖服务端默认配置
+func (c ProviderConfig) override(o ProviderConfig) ProviderConfig {
+	if o.Provider != "" && o.Provider != c.Provider {
+		c = ProviderConfig{Provider: o.Provider, Record: c.Record, Replay: c.Replay}.withEnv()
+	}
+	if o.Model != "" {
+		c.Model = o.Model
+	}
+	if o.BaseURL != "" {
+		// 自定义地址不继承服务端的密钥，避免把密钥发到任意地址
+		c.BaseURL = o.BaseURL
+		c.APIKey = o.APIKey
+	}
+	if o.APIKey != "" {
+		c.APIKey = o.APIKey
+	}
+	if o.API != "" {
+		c.API = o.API
+	}
+	return c
+}
+
+// containsBaseURL 判断 url 是否在 allowed 中，忽略末尾的 /
+func containsBaseURL(allowed []string, url string) bool {
+	for _, a := range allowed {
+		if strings.TrimRight(a, "/") == strings.TrimRight(url, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// registerProviderFlags 给子命令注册 provider 相关参数
+func registerProviderFlags(fs *flag.FlagSet) *ProviderConfig {
+	cfg := &ProviderConfig{}
+	fs.StringVar(&cfg.Provider, "provider", "", "LLM 后端: "+strings.Join(providerNames(), ", "))
+	fs.StringVar(&cfg.BaseURL, "base-url", "", "OpenAI 兼容接口地址，如 https://api.openai.com/v1")
+	fs.StringVar(&cfg.Model, "model", "", "模型名称")
+	fs.StringVar(&cfg.APIKey, "api-key", "", "API Key（默认读取环境变量）")
+	fs.StringVar(&cfg.API, "api", "", "本地后端接口模式: native（/api/chat）或 openai（/v1/chat/completions）")
+	fs.StringVar(&cfg.Record, "record", "", "把每轮请求/响应录制到指定文件")
+	fs.StringVar(&cfg.Replay, "replay", "", "从录制文件回放响应，不访问网络")
+	return cfg
+}
+
+/* ===================== OpenAI 兼容实现 ===================== */
+
+// OpenAIProvider 调用任意 OpenAI 兼容的 /chat/completions 接口
+type OpenAIProvider struct {
+	name    string
+	baseURL string
+	model   string
+	apiKey  string
+	client  *llmClient
+	// noStreamOptions 记录服务端拒绝过 stream_options，之后的流式请求不再发送
+	noStreamOptions atomic.Bool
+}
+
+func newOpenAIProvider(cfg ProviderConfig) (Provider, error) {
+	if cfg.BaseURL == "" {
+		return nil, fmt.Errorf("openai provider 需要指定 base_url（--base-url 或 AI_CR_BASE_URL）")
+	}
+	if cfg.Model == "" {
+		return nil, fmt.Errorf("openai provider 需要指定 model（--model 或 AI_CR_MODEL）")
+	}
+	return &OpenAIProvider{
+		name:    "openai",
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		model:   cfg.Model,
+		apiKey:  cfg.APIKey,
+		client:  newLLMClient("openai", cfg.BaseURL, 300*time.Second),
+	}, nil
+}
+
+// newDeepSeekProvider 是预置了 DeepSeek 地址和模型的 OpenAI 兼容实现
+func newDeepSeekProvider(cfg ProviderConfig) (Provider, error) {
+	if cfg.APIKey == "" {
+		return nil, fmt.Errorf("未设置 DEEPSEEK_API_KEY 环境变量\n" +
+			"请设置: export DEEPSEEK_API_KEY=your-api-key")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = deepseekBaseURL
+	}
+	if cfg.Model == "" {
+		cfg.Model = deepseekModel
+	}
+	return &OpenAIProvider{
+		name:    "deepseek",
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		model:   cfg.Model,
+		apiKey:  cfg.APIKey,
+		client:  newLLMClient("deepseek", cfg.BaseURL, 300*time.Second),
+	}, nil
+}
+
+func (p *OpenAIProvider) Name() string  { return p.name }
+func (p *OpenAIProvider) Model() string { return p.model }
+
+func (p *OpenAIProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	req.Model = p.model
+
+	resp, err := p.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var cr ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		return nil, fmt.Errorf("解析 %s 响应失败: %w", p.name, err)
+	}
+	return &cr, nil
+}
+
+// post 发送 /chat/completions 请求，失败时按 llmClient 的策略重试，非 2xx 响应返回 *APIError
+func (p *OpenAIProvider) post(ctx context.Context, req ChatRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return p.client.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(
+			ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(body),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if p.apiKey != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		if req.Stream {
+			httpReq.Header.Set("Accept", "text/event-stream")
+		}
+		return httpReq, nil
+	})
+}
+
+// openAIStreamChunk 是 stream: true 时每个 data 行的结构
+type openAIStreamChunk struct {
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role      string `json:"role"`
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	// Usage 只在 include_usage 时的最后一个分片中出现，该分片的 choices 为空
+	Usage *Usage `json:"usage"`
+}
+
+// ChatStream 以 SSE 方式调用 /chat/completions，边收边回调文本增量，
+// 并把分片的 tool_calls 拼装成完整响应
+func (p *OpenAIProvider) ChatStream(ctx context.Context, req ChatRequest, onDelta func(string)) (*ChatResponse, error) {
+	req.Model = p.model
+	req.Stream = true
+	if !p.noStreamOptions.Load() {
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	resp, err := p.post(ctx, req)
+	var apiErr *APIError
+	if req.StreamOptions != nil && errors.As(err, &apiErr) &&
+		apiErr.StatusCode == http.StatusBadRequest && apiErr.Kind == ErrKindInvalidRequest {
+		// 部分兼容接口不认识 stream_options 并返回 400，去掉后重试一次；没有 usage 时按估算计费
+		req.StreamOptions = nil
+		if resp, err = p.post(ctx, req); err == nil {
+			p.noStreamOptions.Store(true)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// 部分兼容接口忽略 stream 参数，直接返回完整的 JSON
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		var cr ChatResponse
+		if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+			return nil, fmt.Errorf("解析 %s 响应失败: %w", p.name, err)
+		}
+		return &cr, nil
+	}
+
+	msg := Message{Role: "assistant"}
+	var content strings.Builder
+	var finish string
+	var usage *Usage
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("解析流式响应失败: %w", err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, ch := range chunk.Choices {
+			if ch.Index != 0 {
+				continue
+			}
+			if ch.Delta.Content != "" {
+				content.WriteString(ch.Delta.Content)
+				onDelta(ch.Delta.Content)
+			}
+			for _, d := range ch.Delta.ToolCalls {
+				for len(msg.ToolCalls) <= d.Index {
+					msg.ToolCalls = append(msg.ToolCalls, ToolCall{Type: "function"})
+				}
+				tc := &msg.ToolCalls[d.Index]
+				if d.ID != "" {
+					tc.ID = d.ID
+				}
+				if d.Type != "" {
+					tc.Type = d.Type
+				}
+				tc.Function.Name += d.Function.Name
+				tc.Function.Arguments += d.Function.Arguments
+			}
+			if ch.FinishReason != nil {
+				finish = *ch.FinishReason
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	msg.Content = content.String()
+	return &ChatResponse{Choices: []Choice{{Message: msg, FinishReason: finish}}, Usage: usage}, nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ===================== 本地模型 (Ollama / llama.cpp) ===================== */
+
+const (
+	ollamaBaseURL   = "http://localhost:11434"
+	ollamaModel     = "qwen2.5-coder:7b"
+	llamacppBaseURL = "http://localhost:8080/v1"
+	llamacppModel   = "local"
+)
+
+// LocalProvider 对接本地 Ollama 或 llama.cpp server，代码不会离开本机。
+// api 为 native 时走 Ollama 原生 /api/chat，为 openai 时走 OpenAI 兼容接口。
+type LocalProvider struct {
+	name    string
+	api     string
+	baseURL string
+	model   string
+	client  *llmClient
+	openai  *OpenAIProvider
+
+	// 模型不支持原生 tools 时，改为把工具说明写进提示词
+	mu          sync.Mutex
+	promptTools bool
+}
+
+func init() {
+	providerFactories["ollama"] = newOllamaProvider
+	providerFactories["llamacpp"] = newLlamaCppProvider
+}
+
+func newOllamaProvider(cfg ProviderConfig) (Provider, error) {
+	if cfg.API == "" {
+		cfg.API = "native"
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = ollamaBaseURL
+		if cfg.API == "openai" {
+			cfg.BaseURL += "/v1"
+		}
+	}
+	if cfg.Model == "" {
+		cfg.Model = ollamaModel
+	}
+	return newLocalProvider("ollama", cfg)
+}
+
+func newLlamaCppProvider(cfg ProviderConfig) (Provider, error) {
+	if cfg.API == "" {
+		cfg.API = "openai"
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = llamacppBaseURL
+	}
+	if cfg.Model == "" {
+		cfg.Model = llamacppModel
+	}
+	return newLocalProvider("llamacpp", cfg)
+}
+
+func newLocalProvider(name string, cfg ProviderConfig) (*LocalProvider, error) {
+	p := &LocalProvider{
+		name:    name,
+		api:     cfg.API,
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		model:   cfg.Model,
+		// 本地推理较慢，给足时间
+		client: newLLMClient(name, cfg.BaseURL, 600*time.Second),
+	}
+	switch cfg.API {
+	case "native":
+	case "openai":
+		p.openai = &OpenAIProvider{
+			name:    name,
+			baseURL: p.baseURL,
+			model:   p.model,
+			apiKey:  cfg.APIKey,
+			client:  p.client,
+		}
+	default:
+		return nil, fmt.Errorf("不支持的接口模式: %s（可选: native, openai）", cfg.API)
+	}
+	return p, nil
+}
+
+func (p *LocalProvider) Name() string  { return p.name }
+func (p *LocalProvider) Model() string { return p.model }
+
+func (p *LocalProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	return p.do(ctx, req, nil)
+}
+
+func (p *LocalProvider) ChatStream(ctx context.Context, req ChatRequest, onDelta func(string)) (*ChatResponse, error) {
+	return p.do(ctx, req, onDelta)
+}
+
+func (p *LocalProvider) do(ctx context.Context, req ChatRequest, onDelta func(string)) (*ChatResponse, error) {
+	tools := req.Tools
+
+	p.mu.Lock()
+	promptTools := p.promptTools
+	p.mu.Unlock()
+
+	resp, err := p.chat(ctx, req, promptTools, onDelta)
+	if err != nil && !promptTools && len(tools) > 0 && isToolsUnsupported(err) {
+		p.mu.Lock()
+		p.promptTools = true
+		p.mu.Unlock()
+		resp, err = p.chat(ctx, req, true, onDelta)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 模型没有给出原生 tool_calls 时，尝试从文本中解析 JSON 形式的工具调用
+	for i := range resp.Choices {
+		msg := &resp.Choices[i].Message
+		if len(msg.ToolCalls) > 0 || len(tools) == 0 {
+			continue
+		}
+		rest, calls := parseTextToolCalls(msg.Content, tools)
+		if len(calls) > 0 {
+			msg.Content = rest
+			msg.ToolCalls = calls
+			resp.Choices[i].FinishReason = "tool_calls"
+		}
+	}
+	return resp, nil
+}
+
+func (p *LocalProvider) chat(ctx context.Context, req ChatRequest, promptTools bool, onDelta func(string)) (*ChatResponse, error) {
+	if promptTools {
+		req.Messages = withPromptTools(req.Messages, req.Tools)
+		req.Tools = nil
+	}
+	if p.api == "openai" {
+		if onDelta != nil {
+			return p.openai.ChatStream(ctx, req, onDelta)
+		}
+		return p.openai.Chat(ctx, req)
+	}
+	return p.chatNative(ctx, req, onDelta)
+}
+
+/* ===================== Ollama 原生 /api/chat ===================== */
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []Tool          `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+}
+
+type ollamaChatResponse struct {
+	Message    ollamaMessage `json:"message"`
+	Done       bool          `json:"done"`
+	DoneReason string        `json:"done_reason"`
+	Error      string        `json:"error"`
+	// PromptEvalCount / EvalCount 是输入和输出的 token 数，只在 done 时出现
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// chatNative 调用 Ollama /api/chat；onDelta 不为 nil 时使用流式（NDJSON）输出
+func (p *LocalProvider) chatNative(ctx context.Context, req ChatRequest, onDelta func(string)) (*ChatResponse, error) {
+	oreq := ollamaChatRequest{
+		Model:  p.model,
+		Tools:  req.Tools,
+		Stream: onDelta != nil,
+	}
+	for _, m := range req.Messages {
+		om := ollamaMessage{Role: m.Role, Content: m.Content}
+		for _, tc := range m.ToolCalls {
+			var otc ollamaToolCall
+			otc.Function.Name = tc.Function.Name
+			otc.Function.Arguments = json.RawMessage(tc.Function.Arguments)
+			if !json.Valid(otc.Function.Arguments) {
+				otc.Function.Arguments = json.RawMessage("{}")
+			}
+			om.ToolCalls = append(om.ToolCalls, otc)
+		}
+		oreq.Messages = append(oreq.Messages, om)
+	}
+
+	body, err := json.Marshal(oreq)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/chat", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		return httpReq, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// 非流式时只有一行；流式时每行一个分片，最后一行 done=true
+	var or ollamaChatResponse
+	var content strings.Builder
+	var toolCalls []ollamaToolCall
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var chunk ollamaChatResponse
+		if err := dec.Decode(&chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("解析 %s 响应失败 (HTTP %d): %w", p.name, resp.StatusCode, err)
+		}
+		if chunk.Error != "" {
+			return nil, fmt.Errorf("%s 返回错误 (HTTP %d): %s", p.name, resp.StatusCode, chunk.Error)
+		}
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			if onDelta != nil {
+				onDelta(chunk.Message.Content)
+			}
+		}
+		toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+		or = chunk
+		if chunk.Done {
+			break
+		}
+	}
+	or.Message.Content = content.String()
+	or.Message.ToolCalls = toolCalls
+
+	msg := Message{Role: "assistant", Content: or.Message.Content}
+	for _, otc := range or.Message.ToolCalls {
+		args := string(otc.Function.Arguments)
+		if args == "" || args == "null" {
+			args = "{}"
+		}
+		// 原生接口不返回 ID，自行生成
+		msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+			ID:       newToolCallID(),
+			Type:     "function",
+			Function: FunctionCall{Name: otc.Function.Name, Arguments: args},
+		})
+	}
+
+	finish := or.DoneReason
+	if len(msg.ToolCalls) > 0 {
+		finish = "tool_calls"
+	}
+	var usage *Usage
+	if or.PromptEvalCount > 0 || or.EvalCount > 0 {
+		usage = &Usage{
+			PromptTokens:     or.PromptEvalCount,
+			CompletionTokens: or.EvalCount,
+			TotalTokens:      or.PromptEvalCount + or.EvalCount,
+		}
+	}
+	return &ChatResponse{Choices: []Choice{{Message: msg, FinishReason: finish}}, Usage: usage}, nil
+}
+
+/* ===================== 文本工具调用兜底 ===================== */
+
+// toolCallSeq 为本地模型生成工具调用 ID。历史中的 ID 需要在整个对话内唯一，不能每轮从 0 开始
+var toolCallSeq atomic.Uint64
+
+func newToolCallID() string {
+	return fmt.Sprintf("call_%d", toolCallSeq.Add(1))
+}
+
+// isToolsUnsupported 判断模型是否拒绝了原生 tools，此时改用提示词描述工具
+func isToolsUnsupported(err error) bool {
+	return apiErrorKind(err) == ErrKindInvalidTools
+}
+
+// withPromptTools 把工具说明写进 system 消息，并把历史中的工具调用改写成普通文本，
+// 供不支持原生 tools 的模型使用
+func withPromptTools(messages []Message, tools []Tool) []Message {
+	var sb strings.Builder
+	sb.WriteString("\n\n你可以调用以下工具。需要调用时，只输出一个 JSON 对象，格式为 ")
+	sb.WriteString(`{"name": "工具名", "arguments": {参数}}`)
+	sb.WriteString("，不要输出其他内容；不需要工具时直接给出审查结果。\n\n工具列表：\n")
+	for _, t := range tools {
+		params, _ := json.Marshal(t.Function.Parameters)
+		sb.WriteString(fmt.Sprintf("- %s: %s\n  参数: %s\n", t.Function.Name, t.Function.Description, params))
+	}
+
+	out := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		switch {
+		case m.Role == "system":
+			m.Content += sb.String()
+		case m.Role == "tool":
+			m = Message{Role: "user", Content: "工具返回结果：\n" + m.Content}
+		case len(m.ToolCalls) > 0:
+			var calls []string
+			for _, tc := range m.ToolCalls {
+				calls = append(calls, fmt.Sprintf(`{"name": %q, "arguments": %s}`, tc.Function.Name, tc.Function.Arguments))
+			}
+			m = Message{Role: m.Role, Content: strings.TrimSpace(m.Content + "\n" + strings.Join(calls, "\n"))}
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+var toolCallWrapper = regexp.MustCompile("(?s)```(?:json)?\\s*```|</?tool_call>")
+
+// parseTextToolCalls 从模型的文本输出中解析 JSON 形式的工具调用，
+// 兼容 {"name","arguments"}、{"tool","parameters"}、{"function":{...}} 等常见写法。
+// 只识别 tools 中存在的工具名，返回去掉这些 JSON 后剩余的文本。
+func parseTextToolCalls(content string, tools []Tool) (string, []ToolCall) {
+	known := make(map[string]bool, len(tools))
+	for _, t := range tools {
+		known[t.Function.Name] = true
+	}
+
+	var calls []ToolCall
+	var rest strings.Builder
+	last := 0
+	for i := 0; i < len(content); i++ {
+		if content[i] != '{' {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(content[i:]))
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			continue
+		}
+		name, args, ok := toolCallFromObject(obj)
+		if !ok || !known[name] {
+			continue
+		}
+		calls = append(calls, ToolCall{
+			ID:       newToolCallID(),
+			Type:     "function",
+			Function: FunctionCall{Name: name, Arguments: args},
+		})
+		end := i + int(dec.InputOffset())
+		rest.WriteString(content[last:i])
+		last = end
+		i = end - 1
+	}
+	if len(calls) == 0 {
+		return content, nil
+	}
+	rest.WriteString(content[last:])
+	return strings.TrimSpace(toolCallWrapper.ReplaceAllString(rest.String(), "")), calls
+}
+
+func toolCallFromObject(obj map[string]interface{}) (string, string, bool) {
+	if fn, ok := obj["function"].(map[string]interface{}); ok {
+		return toolCallFromObject(fn)
+	}
+
+	var name string
+	for _, key := range []string{"name", "tool", "tool_name"} {
+		if s, ok := obj[key].(string); ok && s != "" {
+			name = s
+			break
+		}
+	}
+	if name == "" {
+		return "", "", false
+	}
+
+	var args interface{} = map[string]interface{}{}
+	for _, key := range []string{"arguments", "parameters", "args", "input"} {
+		if v, ok := obj[key]; ok && v != nil {
+			args = v
+			break
+		}
+	}
+	// 有的模型会把参数写成 JSON 字符串
+	if s, ok := args.(string); ok {
+		if !json.Valid([]byte(s)) {
+			return "", "", false
+		}
+		return name, s, true
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", "", false
+	}
+	return name, string(data), true
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+/* ===================== Mock Provider ===================== */
+
+// MockProvider 按顺序返回预设的 assistant 消息，不访问网络，供测试使用
+type MockProvider struct {
+	mu        sync.Mutex
+	responses []Message
+	next      int
+
+	// Requests 记录收到的每一轮请求，便于断言
+	Requests []ChatRequest
+}
+
+func NewMockProvider(responses ...Message) *MockProvider {
+	return &MockProvider{responses: responses}
+}
+
+func (p *MockProvider) Name() string  { return "mock" }
+func (p *MockProvider) Model() string { return "mock" }
+
+func (p *MockProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Requests = append(p.Requests, req)
+	if p.next >= len(p.responses) {
+		return nil, fmt.Errorf("mock: 预设响应已用完（共 %d 条）", len(p.responses))
+	}
+	msg := p.responses[p.next]
+	p.next++
+
+	if msg.Role == "" {
+		msg.Role = "assistant"
+	}
+	finish := "stop"
+	if len(msg.ToolCalls) > 0 {
+		finish = "tool_calls"
+	}
+	return &ChatResponse{Choices: []Choice{{Message: msg, FinishReason: finish}}}, nil
+}
+
+// mockToolCall 构造一条工具调用，args 为 JSON 字符串
+func mockToolCall(id, name, args string) ToolCall {
+	return ToolCall{
+		ID:       id,
+		Type:     "function",
+		Function: FunctionCall{Name: name, Arguments: args},
+	}
+}
+
+/* ===================== 录制 / 回放 ===================== */
+
+// transcriptEntry 是录制文件中的一行：一轮请求及其响应
+type transcriptEntry struct {
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response"`
+}
+
+// RecordingProvider 透传给真实 Provider，并把每轮请求/响应追加写入录制文件（JSON Lines）
+type RecordingProvider struct {
+	inner Provider
+	mu    sync.Mutex
+	file  *os.File
+}
+
+func newRecordingProvider(inner Provider, path string) (*RecordingProvider, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("创建录制文件失败: %w", err)
+	}
+	return &RecordingProvider{inner: inner, file: f}, nil
+}
+
+func (p *RecordingProvider) Name() string  { return p.inner.Name() }
+func (p *RecordingProvider) Model() string { return p.inner.Model() }
+
+func (p *RecordingProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	resp, err := p.inner.Chat(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Model = p.inner.Model()
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	respData, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(transcriptEntry{Request: reqData, Response: respData})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("写入录制文件失败: %w", err)
+	}
+	return resp, nil
+}
+
+// ReplayProvider 按顺序回放录制文件中的响应。
+// strict 为 true 时，请求必须和录制时逐字节一致，否则报错；否则只打印警告。
+type ReplayProvider struct {
+	mu      sync.Mutex
+	model   string
+	entries []transcriptEntry
+	next    int
+	strict  bool
+}
+
+func newReplayProvider(path string, strict bool) (*ReplayProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开回放文件失败: %w", err)
+	}
+	defer f.Close()
+
+	p := &ReplayProvider{strict: strict}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry transcriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("解析回放文件第 %d 轮失败: %w", len(p.entries)+1, err)
+		}
+		p.entries = append(p.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取回放文件失败: %w", err)
+	}
+	if len(p.entries) == 0 {
+		return nil, fmt.Errorf("回放文件为空: %s", path)
+	}
+
+	var first ChatRequest
+	if err := json.Unmarshal(p.entries[0].Request, &first); err == nil {
+		p.model = first.Model
+	}
+	return p, nil
+}
+
+func (p *ReplayProvider) Name() string  { return "replay" }
+func (p *ReplayProvider) Model() string { return p.model }
+
+func (p *ReplayProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next >= len(p.entries) {
+		return nil, fmt.Errorf("replay: 录制只有 %d 轮，请求超出", len(p.entries))
+	}
+	entry := p.entries[p.next]
+	p.next++
+
+	req.Model = p.model
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(reqData, entry.Request) {
+		if p.strict {
+			return nil, fmt.Errorf("replay: 第 %d 轮请求与录制不一致", p.next)
+		}
+		log.Printf("⚠️ replay: 第 %d 轮请求与录制不一致，仍按录制回放", p.next)
+	}
+
+	var resp ChatResponse
+	if err := json.Unmarshal(entry.Response, &resp); err != nil {
+		return nil, fmt.Errorf("replay: 解析第 %d 轮响应失败: %w", p.next, err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+/* ===================== SARIF 2.1.0 导出 ===================== */
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+	toolName     = "ai-cr"
+	toolInfoURI  = "https://github.com/ichenss/ai-cr"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string                 `json:"name"`
+	InformationURI string                 `json:"informationUri"`
+	Rules          []sarifRule            `json:"rules"`
+	Properties     map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifRule struct {
+	ID                   string                 `json:"id"`
+	Name                 string                 `json:"name"`
+	ShortDescription     sarifMessage           `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration     `json:"defaultConfiguration"`
+	Properties           map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string                 `json:"ruleId"`
+	RuleIndex  int                    `json:"ruleIndex"`
+	Level      string                 `json:"level"`
+	Message    sarifMessage           `json:"message"`
+	Locations  []sarifLocation        `json:"locations,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+	EndLine   int `json:"endLine,omitempty"`
+}
+
+// categoryRuleNames 是每个分类对应的 SARIF 规则名
+var categoryRuleNames = map[string]string{
+	CategoryQuality:      "CodeQuality",
+	CategoryBug:          "PotentialBug",
+	CategoryPerformance:  "Performance",
+	CategorySecurity:     "Security",
+	CategoryBestPractice: "BestPractice",
+}
+
+// severityLevels 把严重程度映射为 SARIF level
+var severityLevels = map[string]string{
+	SeverityCritical: "error",
+	SeverityHigh:     "error",
+	SeverityMedium:   "warning",
+	SeverityLow:      "note",
+	SeverityInfo:     "note",
+}
+
+// securitySeverity 写在安全规则的 properties 中，供 GitHub code scanning 按分数展示安全问题
+var securitySeverity = map[string]string{
+	SeverityCritical: "9.5",
+	SeverityHigh:     "8.0",
+	SeverityMedium:   "5.5",
+	SeverityLow:      "3.0",
+	SeverityInfo:     "1.0",
+}
+
+// ruleID 返回分类对应的规则 ID，安全问题带上严重程度，如 ai-cr/security/high
+func ruleID(category, severity string) string {
+	if category == CategorySecurity {
+		return toolName + "/" + category + "/" + severity
+	}
+	return toolName + "/" + category
+}
+
+// toSARIF 把审查结果转换成 SARIF 2.1.0，每个分类一条规则，安全分类每个严重程度一条
+func toSARIF(result *ReviewResult) *sarifLog {
+	driver := sarifDriver{
+		Name:           toolName,
+		InformationURI: toolInfoURI,
+		Properties: map[string]interface{}{
+			"provider": result.Provider,
+			"model":    result.Model,
+		},
+	}
+	// GitHub 只读取规则上的 security-severity，安全问题按严重程度拆成多条规则
+	ruleIndex := make(map[string]int, len(categoryOrder)+len(severityOrder))
+	addRule := func(id, name, description, severity string, props map[string]interface{}) {
+		ruleIndex[id] = len(driver.Rules)
+		driver.Rules = append(driver.Rules, sarifRule{
+			ID:                   id,
+			Name:                 name,
+			ShortDescription:     sarifMessage{Text: description},
+			DefaultConfiguration: sarifConfiguration{Level: severity},
+			Properties:           props,
+		})
+	}
+	for _, category := range categoryOrder {
+		if category != CategorySecurity {
+			addRule(ruleID(category, ""), categoryRuleNames[category], categoryLabels[category], "warning",
+				map[string]interface{}{"tags": []string{category}})
+			continue
+		}
+		for _, severity := range severityOrder {
+			addRule(ruleID(category, severity), categoryRuleNames[category]+strings.ToUpper(severity[:1])+severity[1:],
+				categoryLabels[category]+"（"+severityLabels[severity]+"）", severityLevels[severity],
+				map[string]interface{}{"tags": []string{category, "security"}, "security-severity": securitySeverity[severity]})
+		}
+	}
+
+	results := make([]sarifResult, 0, len(result.Findings))
+	for _, f := range result.Findings {
+		text := f.Message
+		if f.Suggestion != "" {
+			text += "\n建议：" + f.Suggestion
+		}
+		id := ruleID(f.Category, f.Severity)
+		r := sarifResult{
+			RuleID:    id,
+			RuleIndex: ruleIndex[id],
+			Level:     severityLevels[f.Severity],
+			Message:   sarifMessage{Text: text},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactURI(f.File),
+				Region:           sarifRegionOf(f),
+			}}},
+			Properties: map[string]interface{}{"severity": f.Severity},
+		}
+		if f.Source != "" {
+			r.Properties["source"] = f.Source
+		}
+		results = append(results, r)
+	}
+
+	return &sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	}
+}
+
+// sarifArtifactURI 相对路径以 %SRCROOT% 为基准，绝对路径转成 file:// URI
+func sarifArtifactURI(path string) sarifArtifactLocation {
+	path = filepath.ToSlash(path)
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") {
+		return sarifArtifactLocation{URI: "file://" + path}
+	}
+	return sarifArtifactLocation{URI: strings.TrimPrefix(path, "./"), URIBaseID: "%SRCROOT%"}
+}
+
+func sarifRegionOf(f Finding) *sarifRegion {
+	if f.StartLine == 0 {
+		return nil
+	}
+	region := &sarifRegion{StartLine: f.StartLine}
+	if f.EndLine > f.StartLine {
+		region.EndLine = f.EndLine
+	}
+	return region
+}
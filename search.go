@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+/* ===================== search_in_files ===================== */
+
+const (
+	defaultSearchResults = 100
+	maxSearchResults     = 1000
+	maxSearchContext     = 10
+	// 超过该长度的行截断显示
+	maxSearchLineLen = 300
+	// 检测二进制文件时读取的字节数
+	binarySniffLen = 8000
+	// 超过该大小的文件不搜索，避免整个读入内存
+	maxSearchFileBytes = 4 << 20
+)
+
+// SearchOptions 是 search_in_files 的参数
+type SearchOptions struct {
+	Directory string
+	Pattern   string
+	// FixedStrings 为 true 时按字面量匹配，否则按 RE2 正则匹配
+	FixedStrings bool
+	IgnoreCase   bool
+	Before       int
+	After        int
+	// Extensions 为空时搜索所有文本文件
+	Extensions []string
+	// Include / Exclude 是相对工作区的路径 glob
+	Include    []string
+	Exclude    []string
+	MaxResults int
+	// TrackedOnly 为 true 时只搜索 git ls-files 列出的文件
+	TrackedOnly bool
+}
+
+func searchOptionsFromArgs(args map[string]interface{}) SearchOptions {
+	around := getIntArg(args, "context", 0)
+	opts := SearchOptions{
+		Directory:    getStringArg(args, "directory", "."),
+		Pattern:      getStringArg(args, "pattern", ""),
+		FixedStrings: getBoolArg(args, "fixed_strings", false),
+		IgnoreCase:   getBoolArg(args, "ignore_case", false),
+		Before:       getIntArg(args, "before_context", around),
+		After:        getIntArg(args, "after_context", around),
+		Include:      getStringSliceArg(args, "include"),
+		Exclude:      getStringSliceArg(args, "exclude"),
+		MaxResults:   getIntArg(args, "max_results", defaultSearchResults),
+	}
+	exts := getStringSliceArg(args, "file_extensions")
+	if ext := getStringArg(args, "file_extension", ""); ext != "" {
+		exts = append(exts, strings.Split(ext, ",")...)
+	}
+	for _, ext := range exts {
+		ext = strings.TrimSpace(ext)
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		opts.Extensions = append(opts.Extensions, ext)
+	}
+	return opts
+}
+
+// compile 生成匹配用的正则
+func (o SearchOptions) compile() (*regexp.Regexp, error) {
+	if o.Pattern == "" {
+		return nil, fmt.Errorf("pattern is required")
+	}
+	expr := o.Pattern
+	if o.FixedStrings {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if o.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	// 先对整个文件预筛，多行模式下 ^ / $ 匹配每行的行首行尾，与逐行匹配的结果一致
+	re, err := regexp.Compile("(?m)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("无效的正则表达式 %q: %v（按字面量搜索请设置 fixed_strings: true）", o.Pattern, err)
+	}
+	return re, nil
+}
+
+// fileMatches 是单个文件的搜索结果
+type fileMatches struct {
+	lines   []string
+	matched []int
+	binary  bool
+	// large 表示文件超过 maxSearchFileBytes，未搜索
+	large bool
+}
+
+func searchInFiles(ctx context.Context, env *ToolEnv, opts SearchOptions) (string, error) {
+	re, err := opts.compile()
+	if err != nil {
+		return "", err
+	}
+	root, err := env.resolve(opts.Directory)
+	if err != nil {
+		return "", err
+	}
+	opts.Before = clamp(opts.Before, 0, maxSearchContext)
+	opts.After = clamp(opts.After, 0, maxSearchContext)
+	if opts.MaxResults <= 0 {
+		opts.MaxResults = defaultSearchResults
+	}
+	opts.MaxResults = clamp(opts.MaxResults, 1, maxSearchResults)
+	include, exclude := newGlobSet(opts.Include), newGlobSet(opts.Exclude)
+
+	// 先遍历出候选文件，再并发扫描
+	var files []string
+	err = env.walk(ctx, root, walkOptions{Recursive: true, TrackedOnly: opts.TrackedOnly}, func(path string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel := env.display(path)
+		if len(opts.Extensions) > 0 && !containsString(opts.Extensions, filepath.Ext(path)) {
+			return nil
+		}
+		if exclude.match(rel) || (!include.empty() && !include.match(rel)) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("搜索失败: %w", err)
+	}
+
+	results := make([]fileMatches, len(files))
+	forEachParallel(len(files), runtime.NumCPU(), func(i int) {
+		if ctx.Err() == nil {
+			results[i] = searchFile(files[i], re)
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return renderSearch(env, opts, files, results), nil
+}
+
+// searchFile 扫描单个文件，二进制文件、过大的文件和读取失败的文件返回空结果
+func searchFile(path string, re *regexp.Regexp) fileMatches {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileMatches{}
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSearchFileBytes+1))
+	if err != nil {
+		return fileMatches{}
+	}
+	if len(data) > maxSearchFileBytes {
+		return fileMatches{large: true}
+	}
+	sniff := data
+	if len(sniff) > binarySniffLen {
+		sniff = sniff[:binarySniffLen]
+	}
+	if bytes.IndexByte(sniff, 0) >= 0 {
+		return fileMatches{binary: true}
+	}
+	if !re.Match(data) {
+		return fileMatches{}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	var matched []int
+	for i, line := range lines {
+		if re.MatchString(strings.TrimSuffix(line, "\r")) {
+			matched = append(matched, i)
+		}
+	}
+	return fileMatches{lines: lines, matched: matched}
+}
+
+// renderSearch 按文件顺序输出结果，匹配行用 L12:，上下文行用 L12-，不连续的片段之间用 -- 分隔
+func renderSearch(env *ToolEnv, opts SearchOptions, files []string, results []fileMatches) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("在 %s 中搜索 '%s'：\n\n", opts.Directory, opts.Pattern))
+
+	total, fileCount, binaries, large := 0, 0, 0, 0
+	for _, r := range results {
+		if r.binary {
+			binaries++
+		}
+		if r.large {
+			large++
+		}
+	}
+	truncated := false
+	for i, r := range results {
+		if len(r.matched) == 0 {
+			continue
+		}
+		if total >= opts.MaxResults {
+			truncated = true
+			break
+		}
+		shown := r.matched
+		if remaining := opts.MaxResults - total; len(shown) > remaining {
+			shown = shown[:remaining]
+			truncated = true
+		}
+		total += len(shown)
+		fileCount++
+		sb.WriteString(fmt.Sprintf("📄 %s\n", env.display(files[i])))
+
+		isMatch := make(map[int]bool, len(shown))
+		for _, m := range shown {
+			isMatch[m] = true
+		}
+		last := -1
+		for _, m := range shown {
+			start := m - opts.Before
+			if start < 0 {
+				start = 0
+			}
+			if start <= last {
+				start = last + 1
+			} else if last >= 0 {
+				sb.WriteString("  --\n")
+			}
+			end := m + opts.After
+			if end >= len(r.lines) {
+				end = len(r.lines) - 1
+			}
+			for n := start; n <= end; n++ {
+				sep := "-"
+				if isMatch[n] {
+					sep = ":"
+				}
+				sb.WriteString(fmt.Sprintf("  L%d%s %s\n", n+1, sep, truncateLine(r.lines[n])))
+			}
+			if end > last {
+				last = end
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	if total == 0 {
+		return "未找到匹配的内容"
+	}
+	sb.WriteString(fmt.Sprintf("共 %d 处匹配，涉及 %d 个文件", total, fileCount))
+	if binaries > 0 {
+		sb.WriteString(fmt.Sprintf("，跳过 %d 个二进制文件", binaries))
+	}
+	if large > 0 {
+		sb.WriteString(fmt.Sprintf("，跳过 %d 个超过 %d MB 的文件", large, maxSearchFileBytes>>20))
+	}
+	sb.WriteString("\n")
+	if truncated {
+		sb.WriteString(fmt.Sprintf("... (匹配结果超过 %d 条，已截断；请缩小搜索范围或调大 max_results)\n", opts.MaxResults))
+	}
+	return sb.String()
+}
+
+func truncateLine(line string) string {
+	line = strings.TrimSuffix(line, "\r")
+	if len(line) > maxSearchLineLen {
+		return truncateUTF8(line, maxSearchLineLen) + "..."
+	}
+	return line
+}
+
+func clamp(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
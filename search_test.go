@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSearchInFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"pkg", "node_modules/dep", ".git", "vendor"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, root, "main.go", "package main\n\nfunc main() {\n\t// TODO: handle err\n\tdoWork()\n}\n")
+	writeTestFile(t, filepath.Join(root, "pkg"), "util.ts", "export const x = 1 // todo later\n")
+	writeTestFile(t, filepath.Join(root, "pkg"), "util_test.go", "package pkg // TODO test\n")
+	writeTestFile(t, filepath.Join(root, "node_modules/dep"), "index.js", "// TODO dep\n")
+	writeTestFile(t, filepath.Join(root, ".git"), "HEAD", "TODO\n")
+	writeTestFile(t, filepath.Join(root, "vendor"), "v.go", "// TODO vendored\n")
+	writeTestFile(t, root, "blob.bin", "TODO\x00\x01binary")
+	var many strings.Builder
+	for i := 0; i < 30; i++ {
+		many.WriteString("FIXME\n")
+	}
+	writeTestFile(t, root, "many.txt", many.String())
+	writeTestFile(t, root, "huge.log", strings.Repeat("HUGE\n", maxSearchFileBytes/5+1))
+
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    map[string]interface{}
+		want    []string
+		notWant []string
+		wantErr bool
+	}{
+		{
+			name:    "regex skips vcs, deps and binaries",
+			args:    map[string]interface{}{"pattern": `TODO:?\s+\w+`},
+			want:    []string{"L4: \t// TODO: handle err", "pkg/util_test.go", "vendor/v.go", "跳过 1 个二进制文件"},
+			notWant: []string{"node_modules", ".git", "blob.bin", "util.ts"},
+		},
+		{
+			name: "ignore case",
+			args: map[string]interface{}{"pattern": "todo later", "ignore_case": true},
+			want: []string{"pkg/util.ts", "L1: export const x"},
+		},
+		{
+			name: "context lines",
+			args: map[string]interface{}{"pattern": "TODO", "context": float64(1), "file_extension": "go", "exclude": []interface{}{"vendor", "pkg"}},
+			want: []string{"L3- func main() {", "L4: \t// TODO", "L5- \tdoWork()", "共 1 处匹配"},
+		},
+		{
+			name:    "multiple extensions and include",
+			args:    map[string]interface{}{"pattern": "(?i)todo", "file_extensions": []interface{}{".ts", ".go"}, "include": []interface{}{"pkg/**"}},
+			want:    []string{"pkg/util.ts", "pkg/util_test.go"},
+			notWant: []string{"main.go", "vendor"},
+		},
+		{
+			name:    "anchored pattern",
+			args:    map[string]interface{}{"pattern": `^func \w+\(\) \{$`},
+			want:    []string{"L3: func main() {", "共 1 处匹配"},
+			notWant: []string{"L1:"},
+		},
+		{
+			name:    "large files skipped",
+			args:    map[string]interface{}{"pattern": "HUGE|doWork"},
+			want:    []string{"L5: \tdoWork()", "跳过 1 个超过 4 MB 的文件"},
+			notWant: []string{"huge.log"},
+		},
+		{
+			name:    "fixed strings",
+			args:    map[string]interface{}{"pattern": "main()", "fixed_strings": true},
+			want:    []string{"L3: func main() {"},
+			notWant: []string{"L1:"},
+		},
+		{
+			name: "max results",
+			args: map[string]interface{}{"pattern": "FIXME", "max_results": float64(5)},
+			want: []string{"L5: FIXME", "共 5 处匹配", "已截断"},
+		},
+		{
+			name:    "invalid regex",
+			args:    map[string]interface{}{"pattern": "main("},
+			wantErr: true,
+		},
+		{
+			name:    "missing pattern",
+			args:    map[string]interface{}{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := executeTool(context.Background(), env, "search_in_files", tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("result missing %q:\n%s", w, got)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("result contains %q:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	line := strings.Repeat("中", maxSearchLineLen)
+	got := truncateLine(line)
+	if !utf8.ValidString(got) || !strings.HasSuffix(got, "...") || len(got) > maxSearchLineLen+3 {
+		t.Errorf("truncateLine = %q", got)
+	}
+	if got := truncateLine("short\r"); got != "short" {
+		t.Errorf("truncateLine = %q", got)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* ===================== 审查事件 ===================== */
+
+const (
+	EventRoundStart = "round_start"
+	EventToken      = "token"
+	EventToolStart  = "tool_start"
+	EventToolEnd    = "tool_end"
+	EventCompact    = "compact"
+	EventFinal      = "final"
+	EventError      = "error"
+)
+
+// ReviewEvent 是审查过程中的一个事件，SSE 接口和 CLI 共用
+type ReviewEvent struct {
+	Type       string `json:"type"`
+	Round      int    `json:"round,omitempty"`
+	Tool       string `json:"tool,omitempty"`
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	Arguments  string `json:"arguments,omitempty"`
+	Success    bool   `json:"success,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	// Content 在 token 事件中是增量文本，在 compact 事件中是压缩前后的 token 估算，在 final 事件中是完整审查结果
+	Content string `json:"content,omitempty"`
+	// Result 只在 final 事件中出现，包含结构化的问题列表
+	Result *ReviewResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	// ErrorType 只在 error 事件中出现，是 LLM 接口错误的分类
+	ErrorType APIErrorKind `json:"error_type,omitempty"`
+}
+
+// StreamingProvider 是支持 stream: true 逐 token 输出的 Provider
+type StreamingProvider interface {
+	Provider
+	// ChatStream 与 Chat 相同，但每收到一段文本就回调 onDelta，最后返回完整响应
+	ChatStream(ctx context.Context, req ChatRequest, onDelta func(string)) (*ChatResponse, error)
+}
+
+// chatRound 调用一轮 LLM；有事件订阅且 Provider 支持流式时逐 token 推送
+func chatRound(ctx context.Context, opts ReviewOptions, round int, req ChatRequest) (*ChatResponse, error) {
+	sp, ok := opts.Provider.(StreamingProvider)
+	if !ok || opts.OnEvent == nil {
+		return opts.Provider.Chat(ctx, req)
+	}
+	return sp.ChatStream(ctx, req, func(delta string) {
+		opts.emit(ReviewEvent{Type: EventToken, Round: round, Content: delta})
+	})
+}
+
+/* ===================== SSE Handler ===================== */
+
+// reviewStreamHandler 以 Server-Sent Events 实时推送审查过程
+func reviewStreamHandler(c *gin.Context) {
+	// 事件本身是 JSON，不支持按 format 转换；需要 SARIF 时用同步接口或异步任务
+	if format := c.Query("format"); format != "" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "流式接口不支持 format: " + format + "（SARIF 请使用 /api/review 或 /api/reviews/:id）",
+		})
+		return
+	}
+
+	var payload reviewPayload
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	opts, err := payload.options()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	log.Printf("收到流式 Code Review 请求 [%s/%s]: %s", opts.Provider.Name(), opts.Provider.Model(), payload.Request)
+
+	if err := jobs.wait(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": waitError(err),
+		})
+		return
+	}
+	defer jobs.release()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	var mu sync.Mutex
+	send := func(ev ReviewEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		c.SSEvent(ev.Type, ev)
+		c.Writer.Flush()
+	}
+
+	opts.OnEvent = send
+	_, err = codeReview(c.Request.Context(), opts, payload.Request)
+	if err != nil {
+		send(ReviewEvent{Type: EventError, Error: err.Error(), ErrorType: apiErrorKind(err)})
+	}
+}
+
+/* ===================== CLI 渲染 ===================== */
+
+// cliRenderer 把事件流实时打印到终端
+type cliRenderer struct {
+	mu          sync.Mutex
+	out         io.Writer
+	roundTokens bool
+}
+
+func (r *cliRenderer) render(ev ReviewEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch ev.Type {
+	case EventRoundStart:
+		if r.roundTokens {
+			fmt.Fprintln(r.out)
+		}
+		r.roundTokens = false
+	case EventToken:
+		if !r.roundTokens {
+			fmt.Fprintf(r.out, "\n💬 [轮次 %d] ", ev.Round)
+			r.roundTokens = true
+		}
+		fmt.Fprint(r.out, ev.Content)
+	case EventToolStart:
+		if r.roundTokens {
+			fmt.Fprintln(r.out)
+			r.roundTokens = false
+		}
+		fmt.Fprintf(r.out, "🔧 [轮次 %d] %s %s\n", ev.Round, ev.Tool, abbreviate(ev.Arguments, 120))
+	case EventToolEnd:
+		status := "✅"
+		if !ev.Success {
+			status = "❌"
+		}
+		fmt.Fprintf(r.out, "   %s %s (%dms)\n", status, ev.Tool, ev.DurationMs)
+	case EventCompact:
+		fmt.Fprintf(r.out, "🗜️ [轮次 %d] 压缩历史消息：%s\n", ev.Round, ev.Content)
+	case EventFinal:
+		if r.roundTokens {
+			fmt.Fprintln(r.out)
+			r.roundTokens = false
+		}
+	}
+}
+
+// abbreviate 把文本压成一行并截断到 n 个字符
+func abbreviate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+/* ===================== Go 符号工具 ===================== */
+
+const (
+	maxSymbolResults    = 300
+	maxReferenceResults = 200
+	maxDefinitions      = 10
+)
+
+// goProgram 是加载并做过类型检查的 Go 代码
+type goProgram struct {
+	env  *ToolEnv
+	fset *token.FileSet
+	pkgs []*goPackage
+	// module 为 true 表示通过 go/packages 按模块加载，可以跨包解析引用；
+	// 否则每个目录单独做类型检查，只能解析包内引用
+	module bool
+	// sources 缓存读取过的源文件，程序会被同一审查中并发的工具调用共用
+	mu      sync.Mutex
+	sources map[string][]byte
+}
+
+type goPackage struct {
+	name  string
+	path  string
+	files []*ast.File
+	info  *types.Info
+}
+
+// goDecl 是一个顶层声明，或者结构体字段、接口方法
+type goDecl struct {
+	pkg  *goPackage
+	kind string
+	name string
+	// recv 是方法的接收者类型名，或字段所属的类型名
+	recv  string
+	ident *ast.Ident
+	node  ast.Node
+	doc   *ast.CommentGroup
+}
+
+const (
+	declFunc   = "func"
+	declMethod = "method"
+	declType   = "type"
+	declConst  = "const"
+	declVar    = "var"
+	declField  = "field"
+)
+
+var declKindLabels = map[string]string{
+	declType:   "类型",
+	declFunc:   "函数",
+	declMethod: "方法",
+	declConst:  "常量",
+	declVar:    "变量",
+	declField:  "字段",
+}
+
+// loadGoProgram 加载 directory 下的 Go 包，recursive 时包含所有子目录。
+// 有 go.mod 时使用 go/packages，失败或没有模块时逐目录解析
+func loadGoProgram(ctx context.Context, env *ToolEnv, directory string, recursive bool) (*goProgram, error) {
+	dir, err := env.resolve(directory)
+	if err != nil {
+		return nil, err
+	}
+	return env.programs.load(ctx, goProgramKey{dir, recursive}, func() (*goProgram, error) {
+		if env.findUp(dir, "go.mod") != "" {
+			prog, err := loadGoModule(ctx, env, dir, recursive)
+			if err == nil && len(prog.pkgs) > 0 {
+				return prog, nil
+			}
+			log.Printf("go/packages 加载 %s 失败，改为逐目录解析: %v", directory, err)
+		}
+		return parseGoDirs(ctx, env, dir, recursive)
+	})
+}
+
+// goProgramCache 缓存一次审查中加载过的 Go 代码，同一审查内多次调用符号工具时不再重复做类型检查。
+// 同时请求同一目录时只加载一次，加载失败不缓存
+type goProgramCache struct {
+	mu      sync.Mutex
+	entries map[goProgramKey]*goProgramEntry
+}
+
+type goProgramKey struct {
+	dir       string
+	recursive bool
+}
+
+type goProgramEntry struct {
+	ready chan struct{}
+	prog  *goProgram
+	err   error
+}
+
+func (c *goProgramCache) load(ctx context.Context, key goProgramKey, fn func() (*goProgram, error)) (*goProgram, error) {
+	for {
+		c.mu.Lock()
+		if c.entries == nil {
+			c.entries = make(map[goProgramKey]*goProgramEntry)
+		}
+		e, ok := c.entries[key]
+		if !ok {
+			e = &goProgramEntry{ready: make(chan struct{})}
+			c.entries[key] = e
+			c.mu.Unlock()
+			e.prog, e.err = fn()
+			if e.err != nil {
+				c.mu.Lock()
+				delete(c.entries, key)
+				c.mu.Unlock()
+			}
+			close(e.ready)
+			return e.prog, e.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// 别的调用加载失败（如超时）时自己重新加载
+		if e.err == nil {
+			return e.prog, nil
+		}
+	}
+}
+
+func loadGoModule(ctx context.Context, env *ToolEnv, dir string, recursive bool) (*goProgram, error) {
+	pattern := "."
+	if recursive {
+		pattern = "./..."
+	}
+	cfg := &packages.Config{
+		Context: ctx,
+		Mode:    packages.NeedName | packages.NeedFiles | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo,
+		Dir:     dir,
+		Tests:   true,
+		Fset:    token.NewFileSet(),
+	}
+	pkgs, err := packages.Load(cfg, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tests 模式下同一个包会出现普通版本和测试版本，只保留包含测试文件的版本
+	variants := make(map[string]bool)
+	for _, p := range pkgs {
+		if i := strings.Index(p.ID, " ["); i > 0 {
+			variants[p.ID[:i]] = true
+		}
+	}
+	prog := &goProgram{env: env, fset: cfg.Fset, module: true, sources: make(map[string][]byte)}
+	for _, p := range pkgs {
+		if p.TypesInfo == nil || variants[p.ID] || strings.HasSuffix(p.ID, ".test") {
+			continue
+		}
+		prog.pkgs = append(prog.pkgs, &goPackage{name: p.Name, path: p.PkgPath, files: p.Syntax, info: p.TypesInfo})
+	}
+	return prog, nil
+}
+
+// parseGoDirs 逐目录解析并做包内类型检查，导入的包用空包代替
+func parseGoDirs(ctx context.Context, env *ToolEnv, dir string, recursive bool) (*goProgram, error) {
+	byDir := make(map[string][]string)
+	var dirs []string
+	err := env.walk(ctx, dir, walkOptions{Recursive: recursive}, func(path string, info os.FileInfo) error {
+		if filepath.Ext(path) != ".go" {
+			return nil
+		}
+		d := filepath.Dir(path)
+		if _, ok := byDir[d]; !ok {
+			dirs = append(dirs, d)
+		}
+		byDir[d] = append(byDir[d], path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prog := &goProgram{env: env, fset: token.NewFileSet(), sources: make(map[string][]byte)}
+	imp := stubImporter{}
+	for _, d := range dirs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		byName := make(map[string][]*ast.File)
+		var names []string
+		for _, path := range byDir[d] {
+			f, err := parser.ParseFile(prog.fset, path, nil, parser.ParseComments)
+			if err != nil {
+				continue
+			}
+			if _, ok := byName[f.Name.Name]; !ok {
+				names = append(names, f.Name.Name)
+			}
+			byName[f.Name.Name] = append(byName[f.Name.Name], f)
+		}
+		for _, name := range names {
+			pkg := &goPackage{
+				name:  name,
+				path:  env.display(d),
+				files: byName[name],
+				info:  &types.Info{Defs: make(map[*ast.Ident]types.Object), Uses: make(map[*ast.Ident]types.Object)},
+			}
+			conf := types.Config{Importer: imp, FakeImportC: true, Error: func(error) {}}
+			conf.Check(pkg.path, prog.fset, pkg.files, pkg.info)
+			prog.pkgs = append(prog.pkgs, pkg)
+		}
+	}
+	if len(prog.pkgs) == 0 {
+		return nil, fmt.Errorf("%s 下没有找到 Go 源文件", env.display(dir))
+	}
+	return prog, nil
+}
+
+// stubImporter 把所有导入解析为空包，类型错误会被忽略，只保证包内的符号可以解析
+type stubImporter map[string]*types.Package
+
+func (s stubImporter) Import(path string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	if pkg, ok := s[path]; ok {
+		return pkg, nil
+	}
+	pkg := types.NewPackage(path, filepath.Base(path))
+	pkg.MarkComplete()
+	s[path] = pkg
+	return pkg, nil
+}
+
+// inWorkspace 判断源文件是否在工作区内，go/packages 生成的测试主文件等不在
+func (p *goProgram) inWorkspace(file *ast.File) bool {
+	_, err := p.env.resolve(p.fset.File(file.Pos()).Name())
+	return err == nil
+}
+
+// files 遍历工作区内的源文件
+func (p *goProgram) files(fn func(pkg *goPackage, file *ast.File)) {
+	for _, pkg := range p.pkgs {
+		for _, file := range pkg.files {
+			if p.inWorkspace(file) {
+				fn(pkg, file)
+			}
+		}
+	}
+}
+
+// decls 收集所有文件中的声明
+func (p *goProgram) decls() []goDecl {
+	var decls []goDecl
+	p.files(func(pkg *goPackage, file *ast.File) {
+		decls = append(decls, fileDecls(pkg, file)...)
+	})
+	return decls
+}
+
+// fileDecls 收集文件中的顶层声明以及结构体字段和接口方法
+func fileDecls(pkg *goPackage, file *ast.File) []goDecl {
+	var decls []goDecl
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			kind, recv := declFunc, ""
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				kind, recv = declMethod, receiverTypeName(d.Recv.List[0].Type)
+			}
+			decls = append(decls, goDecl{pkg: pkg, kind: kind, name: d.Name.Name, recv: recv, ident: d.Name, node: d, doc: d.Doc})
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				decls = append(decls, specDecls(pkg, d, spec)...)
+			}
+		}
+	}
+	return decls
+}
+
+func specDecls(pkg *goPackage, gen *ast.GenDecl, spec ast.Spec) []goDecl {
+	doc := func(own *ast.CommentGroup) *ast.CommentGroup {
+		if own == nil && len(gen.Specs) == 1 {
+			return gen.Doc
+		}
+		return own
+	}
+
+	var decls []goDecl
+	switch s := spec.(type) {
+	case *ast.TypeSpec:
+		decls = append(decls, goDecl{pkg: pkg, kind: declType, name: s.Name.Name, ident: s.Name, node: s, doc: doc(s.Doc)})
+		var fields *ast.FieldList
+		kind := declField
+		switch t := s.Type.(type) {
+		case *ast.StructType:
+			fields = t.Fields
+		case *ast.InterfaceType:
+			fields, kind = t.Methods, declMethod
+		}
+		if fields != nil {
+			for _, field := range fields.List {
+				for _, name := range field.Names {
+					decls = append(decls, goDecl{pkg: pkg, kind: kind, name: name.Name, recv: s.Name.Name, ident: name, node: field, doc: field.Doc})
+				}
+			}
+		}
+	case *ast.ValueSpec:
+		kind := declVar
+		if gen.Tok == token.CONST {
+			kind = declConst
+		}
+		for _, name := range s.Names {
+			decls = append(decls, goDecl{pkg: pkg, kind: kind, name: name.Name, ident: name, node: s, doc: doc(s.Doc)})
+		}
+	}
+	return decls
+}
+
+// receiverTypeName 去掉指针和类型参数，返回接收者的类型名
+func receiverTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexListExpr:
+		return receiverTypeName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// match 判断声明是否匹配 symbol：Name、Type.Method、Type.Field 或 pkg.Name
+func (d goDecl) match(symbol string) bool {
+	qualifier, name := "", symbol
+	if i := strings.LastIndex(symbol, "."); i >= 0 {
+		qualifier, name = strings.Trim(symbol[:i], "()*"), symbol[i+1:]
+	}
+	if d.name != name {
+		return false
+	}
+	if qualifier == "" {
+		return d.kind != declField
+	}
+	return d.recv == qualifier || (d.recv == "" && d.pkg.name == qualifier)
+}
+
+func (d goDecl) title() string {
+	if d.recv != "" {
+		return d.recv + "." + d.name
+	}
+	return d.name
+}
+
+func (p *goProgram) findDecls(symbol string, keep func(goDecl) bool) []goDecl {
+	var found []goDecl
+	for _, d := range p.decls() {
+		if d.match(symbol) && (keep == nil || keep(d)) {
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+/* ===================== 源码和位置 ===================== */
+
+func (p *goProgram) position(pos token.Pos) token.Position {
+	return p.fset.Position(pos)
+}
+
+// location 返回 file:line 形式的位置，文件路径相对工作区
+func (p *goProgram) location(pos token.Pos) string {
+	position := p.position(pos)
+	return fmt.Sprintf("%s:%d", p.env.display(position.Filename), position.Line)
+}
+
+func (p *goProgram) source(filename string) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if data, ok := p.sources[filename]; ok {
+		return data
+	}
+	data, _ := os.ReadFile(filename)
+	p.sources[filename] = data
+	return data
+}
+
+// lines 返回 [from, to] 范围内带行号的源码，超出 budget 字节时截断
+func (p *goProgram) lines(from, to token.Pos, budget int) string {
+	start, end := p.position(from), p.position(to)
+	all := strings.Split(string(p.source(start.Filename)), "\n")
+	var sb strings.Builder
+	for n := start.Line; n <= end.Line && n <= len(all); n++ {
+		entry := fmt.Sprintf("%6d\t%s\n", n, strings.TrimRight(all[n-1], "\r"))
+		if sb.Len()+len(entry) > budget {
+			sb.WriteString(fmt.Sprintf("... (输出已达上限，剩余部分请用 read_file 读取 %s 的第 %d-%d 行)\n",
+				p.env.display(start.Filename), n, end.Line))
+			break
+		}
+		sb.WriteString(entry)
+	}
+	return sb.String()
+}
+
+// signature 返回声明的单行摘要，函数不含函数体，类型只显示种类
+func (p *goProgram) signature(d goDecl) string {
+	var buf bytes.Buffer
+	switch n := d.node.(type) {
+	case *ast.FuncDecl:
+		printer.Fprint(&buf, p.fset, &ast.FuncDecl{Recv: n.Recv, Name: n.Name, Type: n.Type})
+	case *ast.TypeSpec:
+		buf.WriteString("type " + n.Name.Name)
+		if n.TypeParams != nil {
+			buf.WriteString("[")
+			printer.Fprint(&buf, p.fset, n.TypeParams)
+			buf.WriteString("]")
+		}
+		if n.Assign.IsValid() {
+			buf.WriteString(" =")
+		}
+		switch n.Type.(type) {
+		case *ast.StructType:
+			buf.WriteString(" struct")
+		case *ast.InterfaceType:
+			buf.WriteString(" interface")
+		default:
+			buf.WriteString(" ")
+			printer.Fprint(&buf, p.fset, n.Type)
+		}
+	case *ast.ValueSpec:
+		buf.WriteString(d.kind + " " + d.name)
+		if n.Type != nil {
+			buf.WriteString(" ")
+			printer.Fprint(&buf, p.fset, n.Type)
+		}
+	case *ast.Field:
+		buf.WriteString(d.name + " ")
+		printer.Fprint(&buf, p.fset, n.Type)
+	}
+	return abbreviate(buf.String(), 200)
+}
+
+/* ===================== 工具实现 ===================== */
+
+// listPackageSymbols 列出目录中 Go 包的顶层符号
+func listPackageSymbols(ctx context.Context, env *ToolEnv, directory string, exportedOnly bool) (string, error) {
+	prog, err := loadGoProgram(ctx, env, directory, false)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	total := 0
+	for _, pkg := range prog.pkgs {
+		groups := make(map[string][]string)
+		for _, file := range pkg.files {
+			if !prog.inWorkspace(file) {
+				continue
+			}
+			for _, d := range fileDecls(pkg, file) {
+				// 字段和接口方法随类型一起查看，这里不单独列出
+				if d.kind == declField || (d.kind == declMethod && !isFuncDecl(d)) {
+					continue
+				}
+				if exportedOnly && !ast.IsExported(d.name) {
+					continue
+				}
+				groups[d.kind] = append(groups[d.kind], fmt.Sprintf("  - %s (%s) %s", d.title(), prog.location(d.ident.Pos()), prog.signature(d)))
+			}
+		}
+		if len(groups) == 0 {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("📦 package %s (%s)\n", pkg.name, pkg.path))
+		for _, kind := range []string{declType, declFunc, declMethod, declConst, declVar} {
+			if len(groups[kind]) == 0 {
+				continue
+			}
+			sb.WriteString(declKindLabels[kind] + ":\n")
+			for _, line := range groups[kind] {
+				if total >= maxSymbolResults {
+					break
+				}
+				sb.WriteString(line + "\n")
+				total++
+			}
+		}
+		sb.WriteString("\n")
+	}
+	if total == 0 {
+		return "未找到符号", nil
+	}
+	if total >= maxSymbolResults {
+		sb.WriteString(fmt.Sprintf("... (超过 %d 个符号，已截断)\n", maxSymbolResults))
+	}
+	return sb.String(), nil
+}
+
+func isFuncDecl(d goDecl) bool {
+	_, ok := d.node.(*ast.FuncDecl)
+	return ok
+}
+
+// findDefinition 查找符号的定义位置；类型、常量、变量返回完整声明，函数只返回签名
+func findDefinition(ctx context.Context, env *ToolEnv, symbol, directory string) (string, error) {
+	if symbol == "" {
+		return "", fmt.Errorf("symbol is required")
+	}
+	prog, err := loadGoProgram(ctx, env, directory, true)
+	if err != nil {
+		return "", err
+	}
+	decls := prog.findDecls(symbol, nil)
+	if len(decls) == 0 {
+		return fmt.Sprintf("未找到 %s 的定义", symbol), nil
+	}
+
+	var sb strings.Builder
+	for i, d := range decls {
+		if i >= maxDefinitions {
+			sb.WriteString(fmt.Sprintf("... (共 %d 个定义，只显示前 %d 个)\n", len(decls), maxDefinitions))
+			break
+		}
+		sb.WriteString(fmt.Sprintf("📍 %s %s (package %s) %s\n", declKindLabels[d.kind], d.title(), d.pkg.name, prog.location(d.ident.Pos())))
+		if isFuncDecl(d) {
+			sb.WriteString(prog.signature(d) + "\n")
+			sb.WriteString("（使用 get_function_source 查看函数体）\n\n")
+			continue
+		}
+		from := d.node.Pos()
+		if d.doc != nil {
+			from = d.doc.Pos()
+		}
+		sb.WriteString(prog.lines(from, d.node.End(), env.Config.ReadFileMaxBytes))
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// getFunctionSource 返回函数或方法的完整源码（含注释）
+func getFunctionSource(ctx context.Context, env *ToolEnv, symbol, directory string) (string, error) {
+	if symbol == "" {
+		return "", fmt.Errorf("symbol is required")
+	}
+	prog, err := loadGoProgram(ctx, env, directory, true)
+	if err != nil {
+		return "", err
+	}
+	decls := prog.findDecls(symbol, isFuncDecl)
+	if len(decls) == 0 {
+		return fmt.Sprintf("未找到函数或方法 %s", symbol), nil
+	}
+
+	var sb strings.Builder
+	budget := env.Config.ReadFileMaxBytes
+	for i, d := range decls {
+		if i >= maxDefinitions || sb.Len() >= budget {
+			sb.WriteString(fmt.Sprintf("... (共 %d 个匹配，其余已省略，可用 Type.Method 或 pkg.Func 缩小范围)\n", len(decls)))
+			break
+		}
+		from := d.node.Pos()
+		if d.doc != nil {
+			from = d.doc.Pos()
+		}
+		start, end := prog.position(from), prog.position(d.node.End())
+		sb.WriteString(fmt.Sprintf("=== %s (package %s) %s:%d-%d ===\n", d.title(), d.pkg.name,
+			env.display(start.Filename), start.Line, end.Line))
+		sb.WriteString(prog.lines(from, d.node.End(), budget-sb.Len()))
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// reference 是一处引用
+type reference struct {
+	pos  token.Position
+	line string
+}
+
+// findReferences 基于类型信息查找符号的所有引用
+func findReferences(ctx context.Context, env *ToolEnv, symbol, directory string) (string, error) {
+	if symbol == "" {
+		return "", fmt.Errorf("symbol is required")
+	}
+	prog, err := loadGoProgram(ctx, env, directory, true)
+	if err != nil {
+		return "", err
+	}
+	decls := prog.findDecls(symbol, nil)
+	if len(decls) == 0 {
+		return fmt.Sprintf("未找到 %s 的定义", symbol), nil
+	}
+
+	// 用定义位置标识对象：测试变体等会重复类型检查同一文件，对象指针不同但位置相同
+	targets := make(map[token.Position]bool)
+	for _, d := range decls {
+		if obj := d.pkg.info.Defs[d.ident]; obj != nil {
+			targets[prog.position(obj.Pos())] = true
+		}
+	}
+	if len(targets) == 0 {
+		return fmt.Sprintf("%s 没有类型信息，无法查找引用，请改用 search_in_files", symbol), nil
+	}
+
+	seen := make(map[token.Position]bool)
+	var refs []reference
+	prog.files(func(pkg *goPackage, file *ast.File) {
+		ast.Inspect(file, func(n ast.Node) bool {
+			id, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			obj := pkg.info.Uses[id]
+			if obj == nil || !targets[prog.position(originOf(obj).Pos())] {
+				return true
+			}
+			pos := prog.position(id.Pos())
+			if seen[pos] {
+				return true
+			}
+			seen[pos] = true
+			all := strings.Split(string(prog.source(pos.Filename)), "\n")
+			line := ""
+			if pos.Line <= len(all) {
+				line = strings.TrimSpace(all[pos.Line-1])
+			}
+			refs = append(refs, reference{pos: pos, line: line})
+			return true
+		})
+	})
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].pos.Filename != refs[j].pos.Filename {
+			return refs[i].pos.Filename < refs[j].pos.Filename
+		}
+		return refs[i].pos.Offset < refs[j].pos.Offset
+	})
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🔎 %s 的引用（%d 处）：\n", symbol, len(refs)))
+	if !prog.module {
+		sb.WriteString("（未通过 go/packages 加载模块，只能解析同一个包内的引用）\n")
+	}
+	for i, ref := range refs {
+		if i >= maxReferenceResults {
+			sb.WriteString(fmt.Sprintf("... (超过 %d 处，已截断)\n", maxReferenceResults))
+			break
+		}
+		sb.WriteString(fmt.Sprintf("- %s:%d:%d: %s\n", env.display(ref.pos.Filename), ref.pos.Line, ref.pos.Column, abbreviate(ref.line, maxSearchLineLen)))
+	}
+	return sb.String(), nil
+}
+
+// originOf 返回泛型实例化前的原始对象
+func originOf(obj types.Object) types.Object {
+	switch o := obj.(type) {
+	case *types.Func:
+		return o.Origin()
+	case *types.Var:
+		return o.Origin()
+	}
+	return obj
+}
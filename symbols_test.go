@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const storeSource = `package store
+
+// Store 保存数据
+type Store interface {
+	// Get 读取一个值
+	Get(key string) (string, error)
+}
+
+// MemStore 是内存实现
+type MemStore struct {
+	data map[string]string
+}
+
+// Get 实现 Store
+func (m *MemStore) Get(key string) (string, error) {
+	return m.data[key], nil
+}
+
+const DefaultKey = "k"
+
+func helper() string { return DefaultKey }
+`
+
+const apiSource = `package api
+
+import "example.com/demo/store"
+
+func Lookup(s store.Store) string {
+	v, _ := s.Get(store.DefaultKey)
+	return v
+}
+
+func Get() string { return "unrelated" }
+`
+
+func writeGoProject(t *testing.T, withModule bool) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"store", "api"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(root, "store"), "store.go", storeSource)
+	writeTestFile(t, filepath.Join(root, "api"), "api.go", apiSource)
+	if withModule {
+		writeTestFile(t, root, "go.mod", "module example.com/demo\n\ngo 1.21\n")
+	}
+	return root
+}
+
+func TestGoSymbolTools(t *testing.T) {
+	for _, withModule := range []bool{true, false} {
+		name := "module"
+		if !withModule {
+			name = "no module"
+		}
+		t.Run(name, func(t *testing.T) {
+			env, err := newToolEnv(defaultConfig(), writeGoProject(t, withModule))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				tool    string
+				args    map[string]interface{}
+				want    []string
+				notWant []string
+			}{
+				{
+					tool:    "list_package_symbols",
+					args:    map[string]interface{}{"directory": "store"},
+					want:    []string{"package store", "Store (store/store.go:4) type Store interface", "MemStore.Get (store/store.go:15) func (m *MemStore) Get(key string) (string, error)", "helper", "DefaultKey"},
+					notWant: []string{"data map"},
+				},
+				{
+					tool:    "list_package_symbols",
+					args:    map[string]interface{}{"directory": "store", "exported_only": true},
+					notWant: []string{"helper"},
+				},
+				{
+					tool: "find_definition",
+					args: map[string]interface{}{"symbol": "store.Store"},
+					want: []string{"类型 Store (package store) store/store.go:4", "// Store 保存数据", "Get(key string) (string, error)"},
+				},
+				{
+					tool:    "find_definition",
+					args:    map[string]interface{}{"symbol": "MemStore.Get"},
+					want:    []string{"方法 MemStore.Get", "func (m *MemStore) Get(key string) (string, error)", "get_function_source"},
+					notWant: []string{"return m.data"},
+				},
+				{
+					tool:    "get_function_source",
+					args:    map[string]interface{}{"symbol": "(*MemStore).Get"},
+					want:    []string{"store/store.go:14-17", "// Get 实现 Store", "    16\t\treturn m.data[key], nil"},
+					notWant: []string{"unrelated"},
+				},
+				{
+					tool:    "find_references",
+					args:    map[string]interface{}{"symbol": "DefaultKey", "directory": "store"},
+					want:    []string{"store/store.go:21:", "return DefaultKey"},
+					notWant: []string{"store/store.go:19:"},
+				},
+				{
+					tool: "find_definition",
+					args: map[string]interface{}{"symbol": "Nope"},
+					want: []string{"未找到 Nope 的定义"},
+				},
+			}
+			if withModule {
+				// 有模块时可以跨包解析：只匹配接口方法的调用，不匹配同名函数 api.Get
+				tests = append(tests, struct {
+					tool    string
+					args    map[string]interface{}
+					want    []string
+					notWant []string
+				}{
+					tool:    "find_references",
+					args:    map[string]interface{}{"symbol": "Store.Get"},
+					want:    []string{"api/api.go:6:12: v, _ := s.Get(store.DefaultKey)", "（1 处）"},
+					notWant: []string{"api/api.go:10"},
+				})
+			}
+
+			for _, tt := range tests {
+				got, err := executeTool(context.Background(), env, tt.tool, tt.args)
+				if err != nil {
+					t.Errorf("%s %v: %v", tt.tool, tt.args, err)
+					continue
+				}
+				for _, w := range tt.want {
+					if !strings.Contains(got, w) {
+						t.Errorf("%s %v missing %q:\n%s", tt.tool, tt.args, w, got)
+					}
+				}
+				for _, w := range tt.notWant {
+					if strings.Contains(got, w) {
+						t.Errorf("%s %v contains %q:\n%s", tt.tool, tt.args, w, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGoProgramCache(t *testing.T) {
+	env, err := newToolEnv(defaultConfig(), writeGoProject(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := loadGoProgram(context.Background(), env, ".", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadGoProgram(context.Background(), env, "./", true); again != first {
+		t.Error("program reloaded for the same directory")
+	}
+	if other, _ := loadGoProgram(context.Background(), env, "store", true); other == first {
+		t.Error("different directories share a program")
+	}
+
+	// 并发请求只加载一次，失败的结果不缓存
+	var c goProgramCache
+	var calls int32
+	key := goProgramKey{dir: "x"}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.load(context.Background(), key, func() (*goProgram, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(10 * time.Millisecond)
+				return first, nil
+			})
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("loaded %d times", calls)
+	}
+	failing := goProgramKey{dir: "y"}
+	c.load(context.Background(), failing, func() (*goProgram, error) { return nil, errors.New("timeout") })
+	if prog, err := c.load(context.Background(), failing, func() (*goProgram, error) { return first, nil }); err != nil || prog != first {
+		t.Errorf("failure cached: %v", err)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* ===================== Token 用量与费用 ===================== */
+
+// Usage 是 OpenAI 兼容接口响应中的 usage。命中缓存的输入 DeepSeek 放在 prompt_cache_hit_tokens，
+// OpenAI 放在 prompt_tokens_details.cached_tokens，两者都包含在 prompt_tokens 中
+type Usage struct {
+	PromptTokens         int `json:"prompt_tokens"`
+	CompletionTokens     int `json:"completion_tokens"`
+	TotalTokens          int `json:"total_tokens"`
+	PromptCacheHitTokens int `json:"prompt_cache_hit_tokens,omitempty"`
+	PromptTokensDetails  *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details,omitempty"`
+}
+
+// cachedTokens 返回命中缓存的输入 token 数
+func (u *Usage) cachedTokens() int {
+	if u.PromptCacheHitTokens > 0 {
+		return u.PromptCacheHitTokens
+	}
+	if u.PromptTokensDetails != nil {
+		return u.PromptTokensDetails.CachedTokens
+	}
+	return 0
+}
+
+// ModelPrice 是模型每百万 token 的价格，cached_input 未设置（为 0）时按 input 计价
+type ModelPrice struct {
+	Input       float64 `yaml:"input" json:"input"`
+	CachedInput float64 `yaml:"cached_input" json:"cached_input"`
+	Output      float64 `yaml:"output" json:"output"`
+}
+
+// cost 计算一次请求的费用
+func (p ModelPrice) cost(prompt, cached, completion int) float64 {
+	cachedPrice := p.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	return (float64(prompt-cached)*p.Input + float64(cached)*cachedPrice + float64(completion)*p.Output) / 1e6
+}
+
+// defaultPrices 是内置的价格表（美元），以各厂商公布的价格为准，可以在 .ai-cr.yaml 的 prices 中覆盖
+func defaultPrices() map[string]ModelPrice {
+	return map[string]ModelPrice{
+		"deepseek-chat":     {Input: 0.28, CachedInput: 0.028, Output: 0.42},
+		"deepseek-reasoner": {Input: 0.28, CachedInput: 0.028, Output: 0.42},
+		"gpt-4o":            {Input: 2.50, CachedInput: 1.25, Output: 10.00},
+		"gpt-4o-mini":       {Input: 0.15, CachedInput: 0.075, Output: 0.60},
+	}
+}
+
+// ReviewUsage 是一次审查各轮请求累计的 token 用量和费用，以接口返回的 usage 为准
+type ReviewUsage struct {
+	Requests         int `json:"requests"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	// CachedTokens 是 PromptTokens 中命中缓存的部分
+	CachedTokens int     `json:"cached_tokens"`
+	TotalTokens  int     `json:"total_tokens"`
+	Cost         float64 `json:"cost"`
+	Currency     string  `json:"currency,omitempty"`
+	// Estimated 表示有轮次的响应不含 usage，这部分按字符估算
+	Estimated bool `json:"estimated,omitempty"`
+	// Unpriced 表示模型不在价格表中，cost 为 0
+	Unpriced bool `json:"unpriced,omitempty"`
+}
+
+// String 返回 CLI 结尾显示的一行用量说明
+func (u ReviewUsage) String() string {
+	s := fmt.Sprintf("%d 次请求，输入 %d tokens（缓存命中 %d），输出 %d tokens",
+		u.Requests, u.PromptTokens, u.CachedTokens, u.CompletionTokens)
+	if u.Estimated {
+		s += "，部分按字符估算"
+	}
+	if u.Unpriced {
+		return s + "；模型不在价格表中，未计算费用"
+	}
+	return s + fmt.Sprintf("；费用约 %.4f %s", u.Cost, u.Currency)
+}
+
+// usageMeter 累计一次审查各轮的用量并按模型价格计费
+type usageMeter struct {
+	usage ReviewUsage
+	price ModelPrice
+}
+
+func newUsageMeter(cfg *Config, model string) *usageMeter {
+	price, ok := cfg.Prices[model]
+	return &usageMeter{usage: ReviewUsage{Currency: cfg.Currency, Unpriced: !ok}, price: price}
+}
+
+// add 累计一轮的用量；响应不含 usage 时使用按字符估算的 prompt / completion
+func (m *usageMeter) add(u *Usage, prompt, completion int) {
+	cached := 0
+	if u != nil {
+		prompt, completion, cached = u.PromptTokens, u.CompletionTokens, u.cachedTokens()
+	} else {
+		m.usage.Estimated = true
+	}
+	m.usage.Requests++
+	m.usage.PromptTokens += prompt
+	m.usage.CompletionTokens += completion
+	m.usage.CachedTokens += cached
+	m.usage.TotalTokens += prompt + completion
+	m.usage.Cost += m.price.cost(prompt, cached, completion)
+}
+
+/* ===================== 用量统计 ===================== */
+
+// UsageRecord 是服务端一次审查的用量，按 JSON Lines 写入用量日志
+type UsageRecord struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	Repo     string    `json:"repo,omitempty"`
+	Provider string    `json:"provider"`
+	Model    string    `json:"model"`
+	// Failed 表示审查失败或被取消，已消耗的 token 同样计入
+	Failed bool `json:"failed,omitempty"`
+	ReviewUsage
+}
+
+// UsageLedger 按天汇总服务端每次审查的用量，供 /api/usage 按用户、仓库查询。
+// 内存中只保存每天每个用户、仓库、模型的合计，不保存逐条记录
+type UsageLedger struct {
+	mu      sync.Mutex
+	buckets map[usageKey]*UsageTotal
+	// file 不为 nil 时每条记录追加写入，重启后从中恢复
+	file *os.File
+}
+
+// usageKey 标识一个汇总桶，Day 是 UTC 日期（2006-01-02）
+type usageKey struct {
+	Day                         string
+	User, Repo, Model, Currency string
+}
+
+// usageBucket 是用量日志中压缩后的一行：一天内同一用户、仓库、模型的合计
+type usageBucket struct {
+	Day string `json:"day"`
+	UsageTotal
+}
+
+// usageLedger 是服务端的用量记录，默认只保存在内存中
+var usageLedger = &UsageLedger{}
+
+// newUsageLedger 打开用量日志并加载已有记录；path 为空时只保存在内存中。
+// 加载后把日志压缩为每个汇总桶一行，启动时间不随审查次数增长
+func newUsageLedger(path string) (*UsageLedger, error) {
+	l := &UsageLedger{}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("打开用量日志失败: %w", err)
+	}
+	if f != nil {
+		err := l.load(f, path)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := l.compact(path); err != nil {
+		log.Printf("⚠️  压缩用量日志失败，继续追加写入: %v", err)
+	}
+	if l.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, fmt.Errorf("打开用量日志失败: %w", err)
+	}
+	return l, nil
+}
+
+// load 读取用量日志，每行是一条审查记录（UsageRecord）或压缩后的汇总（usageBucket）
+func (l *UsageLedger) load(f *os.File, path string) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var kind struct {
+			Day string `json:"day"`
+		}
+		var err error
+		if err = json.Unmarshal(scanner.Bytes(), &kind); err == nil && kind.Day != "" {
+			var b usageBucket
+			if err = json.Unmarshal(scanner.Bytes(), &b); err == nil {
+				l.bucket(usageKey{b.Day, b.User, b.Repo, b.Model, b.Currency}).merge(b.UsageTotal)
+			}
+		} else if err == nil {
+			var rec UsageRecord
+			if err = json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+				l.bucket(rec.key()).add(rec)
+			}
+		}
+		if err != nil {
+			log.Printf("⚠️  用量日志 %s 第 %d 行无法解析，已跳过: %v", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取用量日志失败: %w", err)
+	}
+	return nil
+}
+
+// compact 把当前的汇总写入临时文件后替换用量日志
+func (l *UsageLedger) compact(path string) error {
+	keys := make([]usageKey, 0, len(l.buckets))
+	for key := range l.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		return a.Day+"\x00"+a.User+"\x00"+a.Repo+"\x00"+a.Model+"\x00"+a.Currency <
+			b.Day+"\x00"+b.User+"\x00"+b.Repo+"\x00"+b.Model+"\x00"+b.Currency
+	})
+	var buf bytes.Buffer
+	for _, key := range keys {
+		data, _ := json.Marshal(usageBucket{Day: key.Day, UsageTotal: *l.buckets[key]})
+		buf.Write(append(data, '\n'))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// bucket 返回 key 对应的汇总，不存在时创建
+func (l *UsageLedger) bucket(key usageKey) *UsageTotal {
+	if l.buckets == nil {
+		l.buckets = make(map[usageKey]*UsageTotal)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &UsageTotal{User: key.User, Repo: key.Repo, Model: key.Model, Currency: key.Currency}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+func (rec UsageRecord) key() usageKey {
+	return usageKey{rec.Time.UTC().Format(usageDayLayout), rec.User, rec.Repo, rec.Model, rec.Currency}
+}
+
+// Add 计入一条记录，写日志失败时只记录错误
+func (l *UsageLedger) Add(rec UsageRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket(rec.key()).add(rec)
+	if l.file == nil {
+		return
+	}
+	data, _ := json.Marshal(rec)
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		log.Printf("⚠️  写入用量日志失败: %v", err)
+	}
+}
+
+// usageGroupFields 是 group_by 可选的字段
+var usageGroupFields = []string{"user", "repo", "model"}
+
+// usageQuery 是 /api/usage 的查询条件，零值表示不限制
+type usageQuery struct {
+	GroupBy      []string
+	User, Repo   string
+	Since, Until time.Time
+}
+
+// usageDayLayout 是汇总桶的日期格式，按 UTC 划分
+const usageDayLayout = "2006-01-02"
+
+// parseUsageQuery 解析 group_by、user、repo、since、until 参数，时间支持 RFC 3339 或 2006-01-02（UTC）
+func parseUsageQuery(values url.Values) (usageQuery, error) {
+	q := usageQuery{User: values.Get("user"), Repo: values.Get("repo"), GroupBy: []string{"user", "repo"}}
+	if groupBy := values.Get("group_by"); groupBy != "" {
+		q.GroupBy = nil
+		for _, field := range strings.Split(groupBy, ",") {
+			field = strings.TrimSpace(field)
+			if !containsString(usageGroupFields, field) {
+				return q, fmt.Errorf("不支持的 group_by: %s（可选: %s）", field, strings.Join(usageGroupFields, ", "))
+			}
+			q.GroupBy = append(q.GroupBy, field)
+		}
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			if parsed, err = time.Parse(usageDayLayout, value); err != nil {
+				return q, fmt.Errorf("%s 格式错误: %s（示例: 2026-10-01 或 2026-10-01T08:00:00Z）", name, value)
+			}
+		}
+		*t = parsed
+	}
+	return q, nil
+}
+
+// match 判断汇总桶是否满足查询条件；统计按天汇总，与 [Since, Until) 有重叠的整天都会计入
+func (q usageQuery) match(key usageKey) bool {
+	day, err := time.Parse(usageDayLayout, key.Day)
+	if err != nil {
+		return false
+	}
+	return (q.User == "" || key.User == q.User) &&
+		(q.Repo == "" || key.Repo == q.Repo) &&
+		(q.Since.IsZero() || day.AddDate(0, 0, 1).After(q.Since)) &&
+		(q.Until.IsZero() || day.Before(q.Until))
+}
+
+// UsageTotal 是一组审查的用量合计；未参与分组的字段为空
+type UsageTotal struct {
+	User             string  `json:"user,omitempty"`
+	Repo             string  `json:"repo,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Currency         string  `json:"currency"`
+	Reviews          int     `json:"reviews"`
+	Failed           int     `json:"failed"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CachedTokens     int     `json:"cached_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	// Estimated / Unpriced 表示其中有按字符估算或未计费的审查
+	Estimated bool `json:"estimated,omitempty"`
+	Unpriced  bool `json:"unpriced,omitempty"`
+}
+
+func (t *UsageTotal) add(rec UsageRecord) {
+	t.Reviews++
+	if rec.Failed {
+		t.Failed++
+	}
+	t.Requests += rec.Requests
+	t.PromptTokens += rec.PromptTokens
+	t.CompletionTokens += rec.CompletionTokens
+	t.CachedTokens += rec.CachedTokens
+	t.TotalTokens += rec.TotalTokens
+	t.Cost += rec.Cost
+	t.Estimated = t.Estimated || rec.Estimated
+	t.Unpriced = t.Unpriced || rec.Unpriced
+}
+
+// merge 把另一组合计加到 t 上
+func (t *UsageTotal) merge(o UsageTotal) {
+	t.Reviews += o.Reviews
+	t.Failed += o.Failed
+	t.Requests += o.Requests
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.CachedTokens += o.CachedTokens
+	t.TotalTokens += o.TotalTokens
+	t.Cost += o.Cost
+	t.Estimated = t.Estimated || o.Estimated
+	t.Unpriced = t.Unpriced || o.Unpriced
+}
+
+// UsageSummary 是 /api/usage 的响应
+type UsageSummary struct {
+	GroupBy []string     `json:"group_by"`
+	Groups  []UsageTotal `json:"groups"`
+	// Totals 是所有匹配记录按货币的合计，价格表的货币不变时只有一项
+	Totals []UsageTotal `json:"totals"`
+}
+
+// Summary 按查询条件汇总用量，分组按费用从高到低排列
+func (l *UsageLedger) Summary(q usageQuery) UsageSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	groups := make(map[UsageTotal]*UsageTotal)
+	totals := make(map[string]*UsageTotal)
+	for key, b := range l.buckets {
+		if !q.match(key) {
+			continue
+		}
+		group := UsageTotal{Currency: key.Currency}
+		for _, field := range q.GroupBy {
+			switch field {
+			case "user":
+				group.User = key.User
+			case "repo":
+				group.Repo = key.Repo
+			case "model":
+				group.Model = key.Model
+			}
+		}
+		if groups[group] == nil {
+			g := group
+			groups[group] = &g
+		}
+		groups[group].merge(*b)
+		if totals[key.Currency] == nil {
+			totals[key.Currency] = &UsageTotal{Currency: key.Currency}
+		}
+		totals[key.Currency].merge(*b)
+	}
+
+	summary := UsageSummary{GroupBy: q.GroupBy, Groups: []UsageTotal{}, Totals: []UsageTotal{}}
+	for _, g := range groups {
+		summary.Groups = append(summary.Groups, *g)
+	}
+	for _, t := range totals {
+		summary.Totals = append(summary.Totals, *t)
+	}
+	for _, list := range [][]UsageTotal{summary.Groups, summary.Totals} {
+		sort.Slice(list, func(i, j int) bool {
+			a, b := list[i], list[j]
+			if a.Cost != b.Cost {
+				return a.Cost > b.Cost
+			}
+			if a.TotalTokens != b.TotalTokens {
+				return a.TotalTokens > b.TotalTokens
+			}
+			return a.User+"\x00"+a.Repo+"\x00"+a.Model+"\x00"+a.Currency < b.User+"\x00"+b.Repo+"\x00"+b.Model+"\x00"+b.Currency
+		})
+	}
+	return summary
+}
+
+/* ===================== 用量接口 ===================== */
+
+// usageHandler 汇总用量。user / repo 由客户端自行填写，按它们的分组只能作为参考
+func usageHandler(c *gin.Context) {
+	q, err := parseUsageQuery(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, usageLedger.Summary(q))
+}
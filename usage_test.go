@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageMeter(t *testing.T) {
+	cfg := defaultConfig()
+	meter := newUsageMeter(cfg, "deepseek-chat")
+
+	var deepseek, openai Usage
+	json.Unmarshal([]byte(`{"prompt_tokens": 1000000, "completion_tokens": 100000, "total_tokens": 1100000,
+		"prompt_cache_hit_tokens": 400000, "prompt_cache_miss_tokens": 600000}`), &deepseek)
+	json.Unmarshal([]byte(`{"prompt_tokens": 2000, "completion_tokens": 10, "total_tokens": 2010,
+		"prompt_tokens_details": {"cached_tokens": 1024}}`), &openai)
+	if deepseek.cachedTokens() != 400000 || openai.cachedTokens() != 1024 {
+		t.Fatalf("cached = %d, %d", deepseek.cachedTokens(), openai.cachedTokens())
+	}
+
+	meter.add(&deepseek, 1, 1)
+	// 0.6M * 0.28 + 0.4M * 0.028 + 0.1M * 0.42
+	if want := 0.168 + 0.0112 + 0.042; math.Abs(meter.usage.Cost-want) > 1e-9 {
+		t.Errorf("cost = %v, want %v", meter.usage.Cost, want)
+	}
+	meter.add(nil, 300, 20)
+	u := meter.usage
+	if u.Requests != 2 || u.PromptTokens != 1000300 || u.CompletionTokens != 100020 || u.CachedTokens != 400000 ||
+		u.TotalTokens != 1100320 || !u.Estimated || u.Unpriced || u.Currency != "USD" {
+		t.Errorf("usage = %+v", u)
+	}
+	if s := u.String(); !strings.Contains(s, "缓存命中 400000") || !strings.Contains(s, "部分按字符估算") ||
+		!strings.Contains(s, "费用约 0.2213 USD") {
+		t.Errorf("String() = %s", s)
+	}
+
+	local := newUsageMeter(cfg, "qwen2.5-coder:7b")
+	local.add(&Usage{PromptTokens: 10, CompletionTokens: 5}, 0, 0)
+	if !local.usage.Unpriced || local.usage.Cost != 0 || !strings.Contains(local.usage.String(), "未计算费用") {
+		t.Errorf("unpriced usage = %+v", local.usage)
+	}
+
+	// cached_input 未设置时按 input 计价
+	if got := (ModelPrice{Input: 1, Output: 2}).cost(1000000, 500000, 1000000); got != 3 {
+		t.Errorf("cost without cached price = %v", got)
+	}
+}
+
+func TestUsageLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger, err := newUsageLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	record := func(user, repo, model string, cost float64, failed bool, at time.Time) {
+		ledger.Add(UsageRecord{
+			Time: at, User: user, Repo: repo, Provider: "deepseek", Model: model, Failed: failed,
+			ReviewUsage: ReviewUsage{Requests: 2, PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110, Cost: cost, Currency: "USD"},
+		})
+	}
+	record("alice@example.com", "api", "deepseek-chat", 0.25, false, day)
+	record("alice@example.com", "api", "deepseek-chat", 0.25, false, day.Add(time.Minute))
+	record("alice@example.com", "web", "deepseek-chat", 0.25, true, day.Add(time.Hour))
+	record("bob@example.com", "api", "deepseek-reasoner", 1.5, false, day.AddDate(0, 0, 1))
+
+	// 重新打开后从日志恢复，日志压缩为每天每个用户、仓库、模型一行
+	ledger.file.Close()
+	if ledger, err = newUsageLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 3 || !strings.Contains(string(data), `"day":"2026-10-01"`) {
+		t.Fatalf("compacted log:\n%s", data)
+	}
+	// 压缩后的汇总和之后追加的逐条记录可以一起恢复
+	record("alice@example.com", "api", "deepseek-chat", 0.25, false, day.Add(2*time.Hour))
+	ledger.file.Close()
+	if ledger, err = newUsageLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.file.Close()
+
+	s := ledger.Summary(usageQuery{GroupBy: []string{"user"}})
+	if len(s.Groups) != 2 || s.Groups[0].User != "bob@example.com" || s.Groups[0].Repo != "" {
+		t.Fatalf("groups = %+v", s.Groups)
+	}
+	alice := s.Groups[1]
+	if alice.Reviews != 4 || alice.Failed != 1 || alice.Requests != 8 || alice.TotalTokens != 440 || alice.Cost != 1 {
+		t.Errorf("alice = %+v", alice)
+	}
+	if len(s.Totals) != 1 || s.Totals[0].Reviews != 5 || s.Totals[0].Cost != 2.5 || s.Totals[0].Currency != "USD" {
+		t.Errorf("totals = %+v", s.Totals)
+	}
+
+	q, err := parseUsageQuery(url.Values{"repo": {"api"}, "since": {"2026-10-01"}, "until": {"2026-10-02T00:00:00Z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = ledger.Summary(q)
+	if len(s.Groups) != 1 || s.Groups[0].User != "alice@example.com" || s.Groups[0].Repo != "api" {
+		t.Errorf("filtered = %+v", s.Groups)
+	}
+
+	for _, values := range []url.Values{{"group_by": {"team"}}, {"since": {"yesterday"}}} {
+		if _, err := parseUsageQuery(values); err == nil {
+			t.Errorf("%v: expected error", values)
+		}
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	setupMockServer(t, mockSubmit("没有发现问题"), mockSubmit("没有发现问题"))
+	cfg := defaultConfig()
+	cfg.Prices["mock"] = ModelPrice{Input: 1, Output: 1}
+	oldConfig, oldLedger := serverConfig, usageLedger
+	serverConfig, usageLedger = cfg, &UsageLedger{}
+	t.Cleanup(func() { serverConfig, usageLedger = oldConfig, oldLedger })
+	r := newRouter()
+
+	var review ReviewResult
+	for _, repo := range []string{"api", "web"} {
+		body := `{"request": "请审查 main.go", "provider": "mock", "user": "alice", "repo": "` + repo + `"}`
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/review", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		json.Unmarshal(w.Body.Bytes(), &review)
+	}
+	if u := review.Usage; u == nil || u.Requests != 1 || u.TotalTokens == 0 || !u.Estimated || u.Cost <= 0 {
+		t.Fatalf("usage = %+v", review.Usage)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/usage?group_by=user", nil))
+	var summary UsageSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Groups) != 1 || summary.Groups[0].User != "alice" || summary.Groups[0].Reviews != 2 ||
+		summary.Groups[0].TotalTokens != 2*review.Usage.TotalTokens {
+		t.Errorf("summary = %+v", summary)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/usage?group_by=branch", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad group_by: status = %d", w.Code)
+	}
+}
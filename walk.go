@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/* ===================== 目录遍历 ===================== */
+
+// walkSkipDirs 是始终跳过的目录：版本库元数据和依赖目录
+var walkSkipDirs = map[string]bool{
+	".git":         true,
+	".hg":          true,
+	".svn":         true,
+	"node_modules": true,
+}
+
+// ignoreFileNames 是每个目录下读取的忽略规则文件，语法同 .gitignore
+var ignoreFileNames = []string{".gitignore", ".ai-crignore"}
+
+// walkOptions 控制目录类工具的遍历范围
+type walkOptions struct {
+	// Recursive 为 false 时只遍历 root 下一层
+	Recursive bool
+	// TrackedOnly 为 true 时只遍历 git ls-files 列出的文件
+	TrackedOnly bool
+}
+
+// ignoreRule 是 .gitignore 中的一条规则
+type ignoreRule struct {
+	// base 是规则文件所在目录，带 / 的规则相对它匹配
+	base     string
+	re       *regexp.Regexp
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// walker 是 list_files / search_in_files / analyze_directory 共用的遍历器。
+// 依次应用 .ai-cr.yaml 的 ignore、.git/info/exclude、各级 .gitignore 和 .ai-crignore
+type walker struct {
+	env  *ToolEnv
+	opts walkOptions
+	// base 是规则的起点：git 仓库根目录，不在仓库内时为工作区根目录
+	base string
+	// rules 缓存每个目录生效的规则（含上级目录的规则）
+	rules map[string][]ignoreRule
+	// tracked 非 nil 时只遍历其中的文件及其上级目录
+	tracked map[string]bool
+}
+
+func newWalker(ctx context.Context, env *ToolEnv, opts walkOptions) (*walker, error) {
+	w := &walker{env: env, opts: opts, base: env.Root, rules: make(map[string][]ignoreRule)}
+	if root := gitRoot(env.Root); root != "" {
+		w.base = root
+	}
+	if opts.TrackedOnly {
+		tracked, err := gitTrackedFiles(ctx, env.Root)
+		if err != nil {
+			return nil, err
+		}
+		w.tracked = tracked
+	}
+	return w, nil
+}
+
+// walk 遍历 root（已通过 env.resolve 解析）下未被忽略的文件，对每个文件调用 fn。
+// root 本身即使命中忽略规则也会遍历，和 git / ripgrep 显式指定路径时的行为一致
+func (env *ToolEnv) walk(ctx context.Context, root string, opts walkOptions, fn func(path string, info os.FileInfo) error) error {
+	w, err := newWalker(ctx, env, opts)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// 每个条目都检查一次，遍历很大的目录时也能及时响应取消和超时
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == root {
+			if info.IsDir() {
+				return nil
+			}
+			return fn(path, info)
+		}
+		if skip, err := env.skip(root, path, info); skip {
+			return err
+		}
+		if info.IsDir() && (walkSkipDirs[info.Name()] || !opts.Recursive) {
+			return filepath.SkipDir
+		}
+		if w.excluded(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(path, info)
+	})
+}
+
+// excluded 判断路径是否被 git 忽略或不在 git ls-files 中
+func (w *walker) excluded(path string, isDir bool) bool {
+	if w.tracked != nil && !w.tracked[path] {
+		return true
+	}
+	ignored := false
+	for _, rule := range w.rulesFor(filepath.Dir(path)) {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		target := filepath.Base(path)
+		if rule.anchored {
+			rel, err := filepath.Rel(rule.base, path)
+			if err != nil {
+				continue
+			}
+			target = filepath.ToSlash(rel)
+		}
+		// 后面的规则覆盖前面的，! 规则重新包含
+		if rule.re.MatchString(target) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// rulesFor 返回目录 dir 中生效的规则，上级目录的规则在前
+func (w *walker) rulesFor(dir string) []ignoreRule {
+	if rules, ok := w.rules[dir]; ok {
+		return rules
+	}
+	var rules []ignoreRule
+	rel, err := filepath.Rel(w.base, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		rules = append(rules, parseIgnoreFile(filepath.Join(w.base, ".git", "info", "exclude"), w.base)...)
+		dir = w.base
+	} else {
+		rules = append(rules, w.rulesFor(filepath.Dir(dir))...)
+	}
+	for _, name := range ignoreFileNames {
+		rules = append(rules, parseIgnoreFile(filepath.Join(dir, name), dir)...)
+	}
+	w.rules[dir] = rules
+	return rules
+}
+
+// parseIgnoreFile 解析 .gitignore 语法的文件，文件不存在时返回 nil
+func parseIgnoreFile(path, base string) []ignoreRule {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// \# 和 \! 表示字面量
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// 开头或中间带 / 的规则相对规则文件所在目录匹配，否则匹配任意一级的名字
+		rule.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		rule.re = regexp.MustCompile("^" + globExpr(line) + "$")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// gitRoot 从 dir 向上查找 git 仓库根目录，找不到时返回空
+func gitRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// gitTrackedFiles 返回 git ls-files 列出的文件及其所有上级目录（绝对路径）
+func gitTrackedFiles(ctx context.Context, root string) (map[string]bool, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-files", "-z")
+	cmd.Dir = root
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("获取 git ls-files 失败（工作区不是 git 仓库？）: %w", err)
+	}
+
+	tracked := make(map[string]bool)
+	for _, file := range strings.Split(string(output), "\x00") {
+		if file == "" {
+			continue
+		}
+		for path := filepath.Join(root, filepath.FromSlash(file)); path != root && !tracked[path]; path = filepath.Dir(path) {
+			tracked[path] = true
+		}
+	}
+	return tracked, nil
+}
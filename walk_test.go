@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWalkHonoursIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":            "build/\n*.log\n!keep.log\n/root_only.txt\n# comment\n*.py[cod]\n[Oo]ut/\nv[!0-9].txt\n[z-a].txt\n[unclosed\n",
+		".ai-crignore":          "docs/generated/\n",
+		"main.go":               "package main\n",
+		"app.log":               "log\n",
+		"keep.log":              "log\n",
+		"root_only.txt":         "x\n",
+		"secret.txt":            "x\n",
+		"build/out.go":          "package build\n",
+		"docs/generated/api.md": "x\n",
+		"docs/guide.md":         "x\n",
+		"pkg/.gitignore":        "gen_*.go\n",
+		"pkg/gen_types.go":      "package pkg\n",
+		"pkg/types.go":          "package pkg\n",
+		"pkg/root_only.txt":     "x\n",
+		"node_modules/dep/x.js": "x\n",
+		"untracked/new.go":      "package untracked\n",
+		"tool.py":               "x\n",
+		"tool.pyc":              "x\n",
+		"Out/a.go":              "package out\n",
+		"out/b.go":              "package out\n",
+		"va.txt":                "x\n",
+		"v1.txt":                "x\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Dir(path), filepath.Base(path), content)
+	}
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	writeTestFile(t, filepath.Join(root, ".git", "info"), "exclude", "secret.txt\n")
+	git("add", "main.go", "keep.log", "pkg/types.go", "docs/guide.md")
+
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(dir string, opts walkOptions) []string {
+		t.Helper()
+		var got []string
+		w, _ := env.resolve(dir)
+		if err := env.walk(context.Background(), w, opts, func(path string, info os.FileInfo) error {
+			got = append(got, filepath.ToSlash(env.display(path)))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	got := strings.Join(list(".", walkOptions{Recursive: true}), " ")
+	for _, want := range []string{"main.go", "keep.log", "docs/guide.md", "pkg/types.go", "pkg/root_only.txt", "untracked/new.go", "tool.py", "v1.txt"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("walk missing %s: %s", want, got)
+		}
+	}
+	for _, skip := range []string{"app.log", " root_only.txt", "secret.txt", "build/", "docs/generated", "gen_types.go", "node_modules", "tool.pyc", "Out/", "out/", "va.txt"} {
+		if strings.Contains(" "+got, skip) {
+			t.Errorf("walk included ignored %s: %s", skip, got)
+		}
+	}
+
+	if got := list("build", walkOptions{Recursive: true}); len(got) != 1 || got[0] != "build/out.go" {
+		t.Errorf("explicit ignored root not walked: %v", got)
+	}
+	if got := list("pkg", walkOptions{}); strings.Join(got, " ") != "pkg/.gitignore pkg/root_only.txt pkg/types.go" {
+		t.Errorf("non-recursive walk = %v", got)
+	}
+
+	tracked := strings.Join(list(".", walkOptions{Recursive: true, TrackedOnly: true}), " ")
+	if tracked != "docs/guide.md keep.log main.go pkg/types.go" {
+		t.Errorf("tracked walk = %s", tracked)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := env.walk(ctx, env.Root, walkOptions{Recursive: true}, func(string, os.FileInfo) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled walk: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* ===================== 工作区沙箱 ===================== */
+
+// ToolEnv 是工具执行时的环境。所有文件工具只能访问 Root 之内的路径
+type ToolEnv struct {
+	Config *Config
+	// Root 是工作区根目录，已解析为不含符号链接的绝对路径
+	Root string
+	// diagnostics 收集 run_linter 的结果，审查结束时并入报告
+	diagnostics diagnosticSet
+	// programs 缓存符号工具加载的 Go 代码，ToolEnv 每次审查新建，缓存随审查结束失效
+	programs goProgramCache
+}
+
+// newToolEnv 创建工具环境，root 为空时使用当前目录
+func newToolEnv(cfg *Config, root string) (*ToolEnv, error) {
+	if root == "" {
+		root = "."
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("无效的工作区 %s: %w", root, err)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, fmt.Errorf("无效的工作区 %s: %w", root, err)
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return nil, fmt.Errorf("无效的工作区 %s: %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("无效的工作区 %s: 不是目录", root)
+	}
+	return &ToolEnv{Config: cfg, Root: real}, nil
+}
+
+// errOutsideWorkspace 表示路径解析后位于工作区之外
+var errOutsideWorkspace = errors.New("超出工作区，拒绝访问")
+
+// resolve 把模型传入的路径解析为工作区内的真实路径。
+// 相对路径以 Root 为基准；解析符号链接后仍需位于 Root 之内，否则返回错误
+func (env *ToolEnv) resolve(path string) (string, error) {
+	if path == "" {
+		path = "."
+	}
+	full := path
+	if !filepath.IsAbs(full) {
+		full = filepath.Join(env.Root, full)
+	}
+	real, err := evalExisting(filepath.Clean(full))
+	if err != nil {
+		return "", fmt.Errorf("解析路径 %s 失败: %w", path, err)
+	}
+	if !env.contains(real) {
+		return "", fmt.Errorf("路径 %s %w（工作区: %s）", path, errOutsideWorkspace, env.Root)
+	}
+	return real, nil
+}
+
+// contains 判断真实路径是否位于工作区内
+func (env *ToolEnv) contains(real string) bool {
+	rel, err := filepath.Rel(env.Root, real)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// findUp 从 start（文件或目录）开始逐级向上查找名为 name 的文件，到 Root 为止，找不到时返回空
+func (env *ToolEnv) findUp(start, name string) string {
+	dir := start
+	if !isDir(dir) {
+		dir = filepath.Dir(dir)
+	}
+	for env.contains(dir) {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return ""
+}
+
+// display 返回相对工作区的路径，用于工具输出
+func (env *ToolEnv) display(path string) string {
+	if rel, err := filepath.Rel(env.Root, path); err == nil && env.contains(path) {
+		return rel
+	}
+	return path
+}
+
+// escapes 判断遍历到的符号链接是否指向工作区之外（包括无法解析的链接）
+func (env *ToolEnv) escapes(path string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	_, err := env.resolve(path)
+	return err != nil
+}
+
+// evalExisting 解析路径中已存在部分的符号链接，不存在的尾部原样拼接
+func evalExisting(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return real, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	realParent, err := evalExisting(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(realParent, filepath.Base(path)), nil
+}
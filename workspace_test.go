@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceSandbox(t *testing.T) {
+	outside := t.TempDir()
+	secret := writeTestFile(t, outside, "id_rsa", "PRIVATE KEY")
+
+	root := t.TempDir()
+	writeTestFile(t, root, "main.go", "package main\n")
+	if err := os.Mkdir(filepath.Join(root, "pkg"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "pkg"), "util.go", "package pkg\n")
+	if err := os.Symlink(secret, filepath.Join(root, "leak.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "pkg"), filepath.Join(root, "alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"main.go", "pkg/util.go", "alias/util.go", filepath.Join(root, "main.go"), "pkg/../main.go"} {
+		if _, err := env.resolve(path); err != nil {
+			t.Errorf("resolve(%s): %v", path, err)
+		}
+	}
+	for _, path := range []string{"../id_rsa", secret, "/etc/passwd", "leak.go", "escape/id_rsa", "pkg/../../x"} {
+		if _, err := env.resolve(path); !errors.Is(err, errOutsideWorkspace) {
+			t.Errorf("resolve(%s) err = %v, want errOutsideWorkspace", path, err)
+		}
+	}
+
+	tests := []struct {
+		tool    string
+		args    map[string]interface{}
+		wantErr bool
+	}{
+		{"read_file", map[string]interface{}{"file_path": "leak.go"}, true},
+		{"read_file", map[string]interface{}{"file_path": "../../etc/passwd"}, true},
+		{"list_files", map[string]interface{}{"directory": "escape"}, true},
+		{"search_in_files", map[string]interface{}{"directory": "/", "pattern": "KEY"}, true},
+		{"analyze_directory", map[string]interface{}{"directory": ".."}, true},
+		{"search_in_files", map[string]interface{}{"directory": ".", "pattern": "KEY"}, false},
+		{"list_files", map[string]interface{}{"directory": ".", "pattern": "*", "recursive": true}, false},
+		{"read_multiple_files", map[string]interface{}{"file_paths": []interface{}{"main.go", secret}}, false},
+	}
+	for _, tt := range tests {
+		got, err := executeTool(context.Background(), env, tt.tool, tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %v: err = %v, wantErr %v", tt.tool, tt.args, err, tt.wantErr)
+		}
+		if strings.Contains(got, "PRIVATE KEY") || strings.Contains(got, "id_rsa (") {
+			t.Errorf("%s %v leaked outside file: %q", tt.tool, tt.args, got)
+		}
+	}
+
+	got, _ := executeTool(context.Background(), env, "get_working_directory", nil)
+	if !strings.Contains(got, root) {
+		t.Errorf("working directory = %q, want root %s", got, root)
+	}
+}
+
+func TestFindUpStopsAtRoot(t *testing.T) {
+	// 工作区是某个 Go 模块的子目录，不能把工作区外的 go.mod 当作所在模块
+	outer := t.TempDir()
+	writeTestFile(t, outer, "go.mod", "module example.com/outer\n")
+	root := filepath.Join(outer, "sub")
+	if err := os.MkdirAll(filepath.Join(root, "inner", "pkg"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "inner"), "go.mod", "module example.com/inner\n")
+	writeTestFile(t, root, "main.go", "package main\n")
+	writeTestFile(t, filepath.Join(root, "inner", "pkg"), "a.go", "package pkg\n")
+	env, err := newToolEnv(defaultConfig(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path := env.findUp(filepath.Join(env.Root, "main.go"), "go.mod"); path != "" {
+		t.Errorf("findUp escaped workspace: %s", path)
+	}
+	if _, _, ok := env.goPackageOf(filepath.Join(env.Root, "main.go")); ok {
+		t.Error("goPackageOf used go.mod outside workspace")
+	}
+	root, pkg, ok := env.goPackageOf(filepath.Join(env.Root, "inner", "pkg", "a.go"))
+	if !ok || root != filepath.Join(env.Root, "inner") || pkg != "./pkg" {
+		t.Errorf("goPackageOf = %s, %s, %v", root, pkg, ok)
+	}
+}